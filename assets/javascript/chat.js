@@ -24,8 +24,8 @@ function appendLog(item) {
   }
 }
 
-function currentTime() {
-  let date = new Date();
+function formatTime(time) {
+  let date = new Date(time);
   let hour = date.getHours();
   let minute = date.getMinutes();
   if (hour < 10) {
@@ -44,11 +44,117 @@ document.getElementById('form').onsubmit = function () {
   if (!msg.value) {
     return false;
   }
-  chatWs.send(msg.value);
+  let message = parseCommand(msg.value);
+  if (!message) {
+    return false;
+  }
+  sendChat(message);
   msg.value = '';
   return false;
 };
 
+// people maps the names seen in the chat to the IDs to whisper to them.
+let people = {};
+
+// parseCommand turns '/w name text' into a message to name only,
+// '/g group text' into a message to the group, e.g. hosts, and
+// '/mute name', '/unmute name' and '/kick name', followed by an optional
+// reason, into the commands of the hosts.
+function parseCommand(text) {
+  let match = text.match(/^\/(w|g) (\S+) (.+)$/) || text.match(/^\/(mute|unmute|kick) (\S+) ?(.*)$/);
+  if (!match) {
+    return { type: 'text', text: text };
+  }
+  if (match[1] === 'g') {
+    return { type: 'text', group: match[2], text: match[3] };
+  }
+  let id = people[match[2]];
+  if (!id) {
+    showMessage({ type: 'system', time: new Date(), text: 'nobody named ' + match[2] + ' in the chat' });
+    return null;
+  }
+  if (match[1] === 'w') {
+    return { type: 'text', to: id, text: match[3] };
+  }
+  return { type: match[1], target: id, text: match[3] };
+}
+
+// sendChat sends a chat message; the server fills in who sent it and when.
+function sendChat(message) {
+  if (chatWs && chatWs.readyState === WebSocket.OPEN) {
+    chatWs.send(JSON.stringify(message));
+  }
+}
+
+let lastTyping = 0;
+
+msg.oninput = function () {
+  if (Date.now() - lastTyping > 2000) {
+    lastTyping = Date.now();
+    sendChat({ type: 'typing' });
+  }
+};
+
+let typing = {};
+
+function showTyping() {
+  let names = Object.keys(typing);
+  let indicator = document.getElementById('typing');
+  if (!indicator) {
+    indicator = document.createElement('div');
+    indicator.id = 'typing';
+    log.parentNode.appendChild(indicator);
+  }
+  indicator.innerText = names.length ? names.join(', ') + ' typing...' : '';
+}
+
+function showMessage(m) {
+  switch (m.type) {
+    case 'typing':
+      clearTimeout(typing[m.name]);
+      typing[m.name] = setTimeout(() => {
+        delete typing[m.name];
+        showTyping();
+      }, 3000);
+      showTyping();
+      return;
+
+    case 'reaction':
+      let target = document.getElementById('chat-' + m.target);
+      if (target) {
+        target.title += (target.title ? '\n' : '') + m.name + ' ' + m.text;
+        target.dataset.reactions = (target.dataset.reactions || '') + m.text;
+        target.querySelector('.reactions').innerText = target.dataset.reactions;
+      }
+      return;
+  }
+
+  if (m.name) {
+    people[m.name] = m.from;
+  }
+  if (m.name && typing[m.name]) {
+    clearTimeout(typing[m.name]);
+    delete typing[m.name];
+    showTyping();
+  }
+
+  let item = document.createElement('div');
+  item.id = 'chat-' + m.id;
+  if (m.type === 'system') {
+    item.className = 'system';
+    item.innerText = formatTime(m.time) + ' - ' + m.text;
+  } else {
+    let to = m.to ? ' (private)' : m.group ? ' (to ' + m.group + ')' : '';
+    item.className = m.to || m.group ? 'private' : '';
+    item.innerText = formatTime(m.time) + ' - ' + m.name + to + ': ' + m.text;
+    item.ondblclick = () => sendChat({ type: 'reaction', target: m.id, text: '\u{1F44D}' });
+  }
+  let reactions = document.createElement('span');
+  reactions.className = 'reactions';
+  item.appendChild(reactions);
+  appendLog(item);
+}
+
 function connectChat() {
   chatWs = new WebSocket(ChatWebsocketAddr);
 
@@ -61,14 +167,13 @@ function connectChat() {
   };
 
   chatWs.onmessage = function (evt) {
-    var messages = evt.data.split('\n');
-    if (slideOpen == false) {
-      document.getElementById('chat-alert').style.display = 'block';
-    }
+    let messages = evt.data.split('\n');
     for (let i = 0; i < messages.length; ++i) {
-      let item = document.getElementById('div');
-      item.innerText = currentTime() + ' - ' + messages[i];
-      appendLog(item);
+      let m = JSON.parse(messages[i]);
+      if (slideOpen == false && m.type !== 'typing') {
+        document.getElementById('chat-alert').style.display = 'block';
+      }
+      showMessage(m);
     }
   };
 
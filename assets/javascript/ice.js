@@ -0,0 +1,11 @@
+// iceConfig fetches an RTCConfiguration with short-lived TURN credentials
+// from the server. It is fetched again on every reconnect because the
+// credentials expire. ICEServersAddr carries the join token of the page.
+function iceConfig() {
+  return fetch(ICEServersAddr)
+    .then((res) => res.json())
+    .catch((err) => {
+      console.log('failed to fetch ice servers: ', err);
+      return {};
+    });
+}
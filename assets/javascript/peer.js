@@ -30,23 +30,12 @@ document.addEventListener('DOMContentLoaded', () => {
   );
 });
 
-function connect(stream) {
+function connect(stream, config) {
   document.getElementById('peers').style.display = 'block';
   document.getElementById('chat').style.display = 'flex';
   document.getElementById('noperm').style.display = 'none';
 
-  let pc = new RTCPeerConnection({
-    iceServers: [
-      {
-        urls: 'stun:turn.videochat:3478',
-      },
-      {
-        urls: 'turn:turn.videochat:3478',
-        username: 'satya',
-        credential: 'satya',
-      },
-    ],
-  });
+  let pc = new RTCPeerConnection(config);
 
   pc.ontrack = function (event) {
     if (event.track.kind === 'audio') {
@@ -79,20 +68,33 @@ function connect(stream) {
       }
     };
   };
-  stream.getTracks().forEach((track) => pc.addTrack(track, stream));
+  stream.getAudioTracks().forEach((track) => pc.addTrack(track, stream));
+  // Video is published in three simulcast layers, the server forwards every
+  // peer the layer that fits its bandwidth.
+  stream.getVideoTracks().forEach((track) =>
+    pc.addTransceiver(track, {
+      direction: 'sendonly',
+      streams: [stream],
+      sendEncodings: [
+        { rid: 'q', scaleResolutionDownBy: 4.0, maxBitrate: 150000 },
+        { rid: 'h', scaleResolutionDownBy: 2.0, maxBitrate: 500000 },
+        { rid: 'f', maxBitrate: 1500000 },
+      ],
+    })
+  );
 
   let ws = new WebSocket(RoomWebsocketAddr);
+  let negotiation = perfectNegotiation(pc, ws);
+  ws.onopen = function () {
+    joinSignaling(ws);
+  };
+
   pc.onicecandidate = (e) => {
     if (!e.candidate) {
       return;
     }
 
-    ws.send(
-      JSON.stringify({
-        event: 'candidate',
-        data: JSON.stringify(e.candidate),
-      })
-    );
+    signal(ws, 'candidate', e.candidate.toJSON());
   };
 
   ws.addEventListener('error', function (event) {
@@ -110,7 +112,7 @@ function connect(stream) {
     document.getElementById('noone').style.display = 'none';
     document.getElementById('nocon').style.display = 'flex';
     setTimeout(function () {
-      connect(stream);
+      iceConfig().then((config) => connect(stream, config));
     }, 1000);
   };
 
@@ -120,31 +122,31 @@ function connect(stream) {
       return console.log('failed to parse msg');
     }
 
-    switch (msg.event) {
+    switch (msg.type) {
+      case 'join':
+        negotiation.joined();
+        return;
+
       case 'offer':
-        let offer = JSON.parse(msg.data);
-        if (!offer) {
-          return console.log('failed to parse answer');
-        }
-        pc.setRemoteDescription(offer);
-        pc.createAnswer().then((answer) => {
-          pc.setLocalDescription(answer);
-          ws.send(
-            JSON.stringify({
-              event: 'answer',
-              data: JSON.stringify(answer),
-            })
-          );
-        });
+      case 'answer':
+        negotiation.description(msg.type, msg.payload.sdp);
         return;
 
       case 'candidate':
-        let candidate = JSON.parse(msg.data);
-        if (!candidate) {
-          return console.log('failed to parse candidate');
-        }
+        pc.addIceCandidate(msg.payload);
+        return;
+
+      case 'mute':
+        console.log('track ' + msg.payload.trackId + ' muted: ' + msg.payload.muted);
+        return;
+
+      case 'quality':
+        showQuality(msg.payload);
+        return;
 
-        pc.addIceCandidate(candidate);
+      case 'error':
+        logSignalingError(msg.payload);
+        return;
     }
   };
 
@@ -173,6 +175,6 @@ navigator.mediaDevices
   })
   .then((stream) => {
     document.getElementById('localVideo').srcObject = stream;
-    connect(stream);
+    iceConfig().then((config) => connect(stream, config));
   })
   .catch((err) => console.log(err));
@@ -0,0 +1,102 @@
+// Signaling protocol spoken with the server, see pkg/protocol.
+const ProtocolVersions = [1];
+
+function signal(ws, type, payload) {
+  ws.send(
+    JSON.stringify({
+      v: ProtocolVersions[ProtocolVersions.length - 1],
+      type: type,
+      payload: payload || {},
+    })
+  );
+}
+
+// joinSignaling sends the join message the server expects first.
+function joinSignaling(ws) {
+  signal(ws, 'join', { versions: ProtocolVersions });
+}
+
+const QualityLabels = ['', 'bad', 'poor', 'fair', 'good', 'excellent'];
+
+// showQuality shows the connection quality the server measured, with the
+// measures of every track in the title.
+function showQuality(payload) {
+  let quality = document.getElementById('quality');
+  if (!quality) {
+    return;
+  }
+
+  quality.innerHTML = 'connection: ' + QualityLabels[payload.score];
+  quality.className = 'quality-' + payload.score;
+  quality.title = payload.tracks
+    .map(
+      (t) =>
+        t.kind +
+        ' ' +
+        t.direction +
+        ': ' +
+        Math.round(t.bitrate / 1000) +
+        ' kbps, ' +
+        (t.packetLoss * 100).toFixed(1) +
+        '% loss, ' +
+        Math.round(t.jitter) +
+        ' ms jitter, ' +
+        Math.round(t.rtt) +
+        ' ms rtt' +
+        (t.frameRate ? ', ' + Math.round(t.frameRate) + ' fps' : '')
+    )
+    .join('\n');
+}
+
+function logSignalingError(payload) {
+  console.log('signaling error: ' + payload.code + ': ' + payload.message);
+}
+
+// perfectNegotiation lets both the browser and the server start a
+// negotiation, following the perfect negotiation pattern. The browser is the
+// polite peer: when its offer collides with a server offer it is rolled back
+// by setRemoteDescription and the server offer is answered instead.
+function perfectNegotiation(pc, ws) {
+  let joined = false;
+  let needed = false;
+
+  async function offer() {
+    try {
+      await pc.setLocalDescription();
+      signal(ws, 'offer', { sdp: pc.localDescription.sdp });
+    } catch (err) {
+      console.log('failed to create offer: ', err);
+    }
+  }
+
+  pc.onnegotiationneeded = () => {
+    // No offer may be sent before the server acknowledged the join.
+    if (!joined) {
+      needed = true;
+      return;
+    }
+    offer();
+  };
+
+  return {
+    joined() {
+      joined = true;
+      if (needed) {
+        needed = false;
+        offer();
+      }
+    },
+
+    async description(type, sdp) {
+      try {
+        await pc.setRemoteDescription({ type: type, sdp: sdp });
+        if (type === 'offer') {
+          await pc.setLocalDescription();
+          signal(ws, 'answer', { sdp: pc.localDescription.sdp });
+        }
+      } catch (err) {
+        console.log('failed to apply ' + type + ': ', err);
+      }
+    },
+  };
+}
@@ -1,26 +1,7 @@
-function connectStream() {
+function connectStream(config) {
   document.getElementById('peers').style.display = 'block';
   document.getElementById('chat').style.display = 'flex';
-  let pc = new RTCPeerConnection({
-    iceServers: [
-      {
-        urls: 'stun:relay.metered.ca:80',
-      },
-      {
-        urls: 'turn:relay.metered.ca:80',
-        username: 'f656bb327ada11408d2cd592',
-        credential: 'D5FTwyiln3XE0vFq',
-      },
-      // {
-      //   urls: 'stun:turn.videochat:3478',
-      // },
-      // {
-      //   urls: 'turn:turn.videochat:3478',
-      //   username: 'satya',
-      //   credential: 'satya',
-      // },
-    ],
-  });
+  let pc = new RTCPeerConnection(config);
 
   pc.ontrack = function (event) {
     if (event.track.kind === 'audio') {
@@ -64,17 +45,17 @@ function connectStream() {
   };
 
   let ws = new WebSocket(StreamWebsocketAddr);
+  let negotiation = perfectNegotiation(pc, ws);
+  ws.onopen = function () {
+    joinSignaling(ws);
+  };
+
   pc.onicecandidate = (e) => {
     if (!e.candidate) {
       return;
     }
 
-    ws.send(
-      JSON.stringify({
-        event: 'candidate',
-        data: JSON.stringify(e.candidate),
-      })
-    );
+    signal(ws, 'candidate', e.candidate.toJSON());
   };
 
   ws.addEventListener('error', function (event) {
@@ -92,7 +73,7 @@ function connectStream() {
     document.getElementById('noonestream').style.display = 'none';
     document.getElementById('nocon').style.display = 'flex';
     setTimeout(function () {
-      connectStream();
+      iceConfig().then((config) => connectStream(config));
     }, 1000);
   };
 
@@ -102,31 +83,31 @@ function connectStream() {
       return console.log('failed to parse msg');
     }
 
-    switch (msg.event) {
+    switch (msg.type) {
+      case 'join':
+        negotiation.joined();
+        return;
+
       case 'offer':
-        let offer = JSON.parse(msg.data);
-        if (!offer) {
-          return console.log('failed to parse answer');
-        }
-        pc.setRemoteDescription(offer);
-        pc.createAnswer().then((answer) => {
-          pc.setLocalDescription(answer);
-          ws.send(
-            JSON.stringify({
-              event: 'answer',
-              data: JSON.stringify(answer),
-            })
-          );
-        });
+      case 'answer':
+        negotiation.description(msg.type, msg.payload.sdp);
         return;
 
       case 'candidate':
-        let candidate = JSON.parse(msg.data);
-        if (!candidate) {
-          return console.log('failed to parse candidate');
-        }
+        pc.addIceCandidate(msg.payload);
+        return;
+
+      case 'mute':
+        console.log('track ' + msg.payload.trackId + ' muted: ' + msg.payload.muted);
+        return;
 
-        pc.addIceCandidate(candidate);
+      case 'quality':
+        showQuality(msg.payload);
+        return;
+
+      case 'error':
+        logSignalingError(msg.payload);
+        return;
     }
   };
 
@@ -135,4 +116,4 @@ function connectStream() {
   };
 }
 
-connectStream();
+iceConfig().then((config) => connectStream(config));
@@ -5,17 +5,20 @@ function connectViewer() {
   viewerWs.onclose = function (evt) {
     console.log('websocket has closed');
     viewerCount.innerHTML = '0';
+    viewerCount.title = '';
     setTimeout(function () {
       connectViewer();
     }, 1000);
   };
 
   viewerWs.onmessage = function (evt) {
-    d = evt.data;
-    if (d === parseInt(d, 10)) {
+    let counts = JSON.parse(evt.data);
+    if (!counts) {
       return;
     }
-    viewerCount.innerHTML = d;
+    viewerCount.innerHTML = counts.publishers + counts.viewers;
+    viewerCount.title =
+      counts.publishers + ' publishing, ' + counts.viewers + ' watching';
   };
 
   viewerWs.onerror = function (evt) {
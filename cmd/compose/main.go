@@ -0,0 +1,109 @@
+// Command compose turns a room recording into a single timeline: a manifest
+// placing every participant in a grid from the moment they join until they
+// leave, and one Opus track mixing the audio of all participants.
+//
+//	compose [-ffmpeg ffmpeg] [-no-audio] recordings/<room>/<time>
+//
+// Mixing the audio needs ffmpeg built with libopus. The grid video is left to
+// a downstream renderer reading composition.json.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"quick-video/pkg/recorder"
+)
+
+const (
+	manifestFile = "composition.json"
+	audioFile    = "mixed.ogg"
+)
+
+func main() {
+	ffmpeg := flag.String("ffmpeg", "ffmpeg", "ffmpeg binary used to mix the audio")
+	noAudio := flag.Bool("no-audio", false, "only write the manifest")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		log.Fatalf("usage: compose [flags] <recording directory>")
+	}
+	dir := flag.Arg(0)
+
+	m, err := recorder.ReadMetadata(dir)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	c := recorder.Compose(m)
+	if !*noAudio {
+		if err := mixAudio(*ffmpeg, dir, c); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	raw, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, manifestFile), raw, 0o644); err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf("wrote %s, %d participants over %.1fs", filepath.Join(dir, manifestFile), len(c.Participants), c.Duration)
+}
+
+// mixAudio mixes every audio clip of c into one Opus file, each clip delayed
+// to its place on the timeline.
+func mixAudio(ffmpeg, dir string, c *recorder.Composition) error {
+	args := mixArgs(dir, c)
+	if args == nil {
+		return nil
+	}
+
+	cmd := exec.Command(ffmpeg, args...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("mixing audio with %s: %w", ffmpeg, err)
+	}
+
+	c.Audio = audioFile
+	return nil
+}
+
+// mixArgs returns the ffmpeg arguments of mixAudio, nil if c has no audio.
+func mixArgs(dir string, c *recorder.Composition) []string {
+	args := []string{"-y", "-hide_banner", "-loglevel", "error"}
+	var filters, labels []string
+	for _, p := range c.Participants {
+		for _, clip := range p.Audio {
+			i := len(labels)
+			args = append(args, "-i", filepath.Join(dir, clip.File))
+
+			filter := fmt.Sprintf("[%d:a]", i)
+			if clip.Rate > 0 && (clip.Rate < 0.999 || clip.Rate > 1.001) {
+				filter += fmt.Sprintf("atempo=%.6f,", clip.Rate)
+			}
+			filter += fmt.Sprintf("adelay=%d:all=1[a%d]", int(clip.Start*1000), i)
+
+			filters = append(filters, filter)
+			labels = append(labels, fmt.Sprintf("[a%d]", i))
+		}
+	}
+	if len(labels) == 0 {
+		return nil
+	}
+
+	filters = append(filters, fmt.Sprintf("%samix=inputs=%d:duration=longest:normalize=0[out]", strings.Join(labels, ""), len(labels)))
+	return append(args,
+		"-filter_complex", strings.Join(filters, ";"),
+		"-map", "[out]",
+		"-c:a", "libopus",
+		filepath.Join(dir, audioFile),
+	)
+}
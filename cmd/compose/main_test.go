@@ -0,0 +1,103 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"quick-video/pkg/recorder"
+)
+
+func TestMixArgs(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	// track is a track recorded from start+from to start+to, whose clock
+	// ran rate times as fast as the server's.
+	track := func(stream, kind, file string, from, to time.Duration, rate float64) recorder.TrackMetadata {
+		clockRate := uint32(90000)
+		if kind == "audio" {
+			clockRate = 48000
+		}
+		return recorder.TrackMetadata{
+			StreamID:  stream,
+			Kind:      kind,
+			ClockRate: clockRate,
+			File:      file,
+			StartedAt: start.Add(from),
+			EndedAt:   start.Add(to),
+			SyncPoints: []recorder.SyncPoint{
+				{Time: start.Add(from), Timestamp: 0},
+				{Time: start.Add(to), Timestamp: uint64((to - from).Seconds() * rate * float64(clockRate))},
+			},
+			Samples: 100,
+		}
+	}
+
+	tests := []struct {
+		name   string
+		tracks []recorder.TrackMetadata
+		want   []string
+	}{
+		{
+			name: "one track",
+			tracks: []recorder.TrackMetadata{
+				track("alice", "audio", "00-alice-mic.ogg", 0, 10*time.Second, 1),
+			},
+			want: []string{
+				"-y", "-hide_banner", "-loglevel", "error",
+				"-i", "rec/00-alice-mic.ogg",
+				"-filter_complex", "[0:a]adelay=0:all=1[a0];[a0]amix=inputs=1:duration=longest:normalize=0[out]",
+				"-map", "[out]", "-c:a", "libopus", "rec/mixed.ogg",
+			},
+		},
+		{
+			name: "multi track",
+			tracks: []recorder.TrackMetadata{
+				track("bob", "video", "02-bob-cam.ivf", 2500*time.Millisecond, 10*time.Second, 1),
+				track("bob", "audio", "03-bob-mic.ogg", 2500*time.Millisecond, 10*time.Second, 1.01),
+				track("alice", "video", "00-alice-cam.ivf", 0, 10*time.Second, 1),
+				track("alice", "audio", "01-alice-mic.ogg", 0, 10*time.Second, 1),
+			},
+			want: []string{
+				"-y", "-hide_banner", "-loglevel", "error",
+				"-i", "rec/01-alice-mic.ogg",
+				"-i", "rec/03-bob-mic.ogg",
+				"-filter_complex", "[0:a]adelay=0:all=1[a0];" +
+					"[1:a]atempo=1.010000,adelay=2500:all=1[a1];" +
+					"[a0][a1]amix=inputs=2:duration=longest:normalize=0[out]",
+				"-map", "[out]", "-c:a", "libopus", "rec/mixed.ogg",
+			},
+		},
+		{
+			name: "audio only",
+			tracks: []recorder.TrackMetadata{
+				track("alice", "audio", "00-alice-mic.ogg", time.Second, 4*time.Second, 1),
+				track("bob", "audio", "01-bob-mic.ogg", 3*time.Second, 6*time.Second, 0.998),
+				track("alice", "audio", "02-alice-mic.ogg", 5*time.Second, 7*time.Second, 1.0005),
+			},
+			want: []string{
+				"-y", "-hide_banner", "-loglevel", "error",
+				"-i", "rec/00-alice-mic.ogg",
+				"-i", "rec/02-alice-mic.ogg",
+				"-i", "rec/01-bob-mic.ogg",
+				"-filter_complex", "[0:a]adelay=1000:all=1[a0];" +
+					"[1:a]adelay=5000:all=1[a1];" +
+					"[2:a]atempo=0.998000,adelay=3000:all=1[a2];" +
+					"[a0][a1][a2]amix=inputs=3:duration=longest:normalize=0[out]",
+				"-map", "[out]", "-c:a", "libopus", "rec/mixed.ogg",
+			},
+		},
+		{
+			name: "video only",
+			tracks: []recorder.TrackMetadata{
+				track("alice", "video", "00-alice-cam.ivf", 0, 10*time.Second, 1),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		c := recorder.Compose(&recorder.Metadata{Room: "room", StartedAt: start, Tracks: tt.tracks})
+		if got := mixArgs("rec", c); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got\n%q\nwant\n%q", tt.name, got, tt.want)
+		}
+	}
+}
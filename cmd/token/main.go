@@ -0,0 +1,85 @@
+// Command token issues a join token, for development and for deployments
+// that have no other issuer.
+//
+//	token -room <room id> -sub <identity> [-role host|participant|viewer] [-ttl 1h] (-secret <secret> | -key <ed25519 PEM file>)
+//
+// The permissions of the role can be narrowed with -publish, -subscribe and
+// -chat, which are all set by default.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"quick-video/pkg/auth"
+)
+
+func main() {
+	room := flag.String("room", "", "ID of the room")
+	sub := flag.String("sub", "", "identity of the client")
+	name := flag.String("name", "", "display name of the client")
+	role := flag.String("role", string(auth.RoleParticipant), "host, participant or viewer")
+	ttl := flag.Duration("ttl", time.Hour, "how long the token is valid")
+	secret := flag.String("secret", os.Getenv("AUTH_SECRET"), "HS256 secret")
+	key := flag.String("key", "", "Ed25519 private key PEM file, to sign with EdDSA")
+	publish := flag.Bool("publish", true, "")
+	subscribe := flag.Bool("subscribe", true, "")
+	chat := flag.Bool("chat", true, "")
+	flag.Parse()
+
+	if *room == "" || *sub == "" {
+		log.Fatalln("usage: token -room <room id> -sub <identity> [flags]")
+	}
+
+	if auth.Role(*role).Permissions() == (auth.Permissions{}) {
+		log.Fatalf("unknown role %q", *role)
+	}
+
+	now := time.Now()
+	claims := &auth.Claims{
+		Room:      *room,
+		Subject:   *sub,
+		Name:      *name,
+		Role:      auth.Role(*role),
+		ExpiresAt: now.Add(*ttl).Unix(),
+		IssuedAt:  now.Unix(),
+	}
+
+	// Only narrowed permissions are written down, the role tells the rest.
+	allowed := claims.Role.Permissions()
+	if p := (auth.Permissions{
+		Publish:   allowed.Publish && *publish,
+		Subscribe: allowed.Subscribe && *subscribe,
+		Chat:      allowed.Chat && *chat,
+	}); p != allowed {
+		claims.Permissions = &p
+	}
+
+	var (
+		token string
+		err   error
+	)
+	switch {
+	case *key != "":
+		raw, readErr := os.ReadFile(*key)
+		if readErr != nil {
+			log.Fatalln(readErr)
+		}
+		private, parseErr := auth.ParsePrivateKey(string(raw))
+		if parseErr != nil {
+			log.Fatalln(parseErr)
+		}
+		token, err = auth.SignEdDSA(claims, private)
+	case *secret != "":
+		token, err = auth.SignHS256(claims, []byte(*secret))
+	default:
+		log.Fatalln("either -secret or -key is required")
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Println(token)
+}
@@ -0,0 +1,200 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"quick-video/pkg/auth"
+	w "quick-video/pkg/webrtc"
+
+	"github.com/pion/webrtc/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the server configuration that can be loaded from a YAML or JSON file.
+type Config struct {
+	ICE  ICE  `json:"ice" yaml:"ice"`
+	TURN TURN `json:"turn" yaml:"turn"`
+	Auth Auth `json:"auth" yaml:"auth"`
+}
+
+type ICE struct {
+	Servers []ICEServer `json:"servers" yaml:"servers"`
+	// TransportPolicy is either "all" or "relay".
+	TransportPolicy string   `json:"transport_policy" yaml:"transport_policy"`
+	NAT1To1IPs      []string `json:"nat_1to1_ips" yaml:"nat_1to1_ips"`
+}
+
+type ICEServer struct {
+	URLs       []string `json:"urls" yaml:"urls"`
+	Username   string   `json:"username,omitempty" yaml:"username,omitempty"`
+	Credential string   `json:"credential,omitempty" yaml:"credential,omitempty"`
+}
+
+// TURN configures the TURN servers that accept time-limited credentials
+// signed with Secret, e.g. tools/turn started with the same -auth-secret.
+type TURN struct {
+	URLs   []string `json:"urls" yaml:"urls"`
+	Secret string   `json:"secret" yaml:"secret"`
+	// CredentialTTL is a duration such as "12h", it defaults to DefaultCredentialTTL.
+	CredentialTTL string `json:"credential_ttl" yaml:"credential_ttl"`
+}
+
+const DefaultCredentialTTL = 12 * time.Hour
+
+// Auth configures the keys verifying the join tokens of the rooms. Rooms are
+// open to anyone when neither is set.
+type Auth struct {
+	// Secret verifies HS256 tokens.
+	Secret string `json:"secret" yaml:"secret"`
+	// PublicKey verifies EdDSA tokens. It is an Ed25519 public key, PEM or
+	// base64 encoded, or the path of a PEM file.
+	PublicKey string `json:"public_key" yaml:"public_key"`
+}
+
+// Load reads the configuration file at path. The format is picked from the
+// file extension: .yaml or .yml for YAML, anything else is parsed as JSON.
+func Load(path string) (*Config, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Config{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(raw, c)
+	default:
+		err = json.Unmarshal(raw, c)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// Override replaces the ICE settings loaded from the file with the ones given
+// by flags or environment variables. Empty values leave the file settings untouched.
+//
+// servers is a comma separated list of STUN/TURN URLs that share username and
+// credential, ips is a comma separated list of public IPs.
+func (c *Config) Override(servers, username, credential, policy, ips string) {
+	if servers != "" {
+		c.ICE.Servers = []ICEServer{{
+			URLs:       splitList(servers),
+			Username:   username,
+			Credential: credential,
+		}}
+	}
+	if policy != "" {
+		c.ICE.TransportPolicy = policy
+	}
+	if ips != "" {
+		c.ICE.NAT1To1IPs = splitList(ips)
+	}
+}
+
+// OverrideTURN replaces the TURN settings loaded from the file with the ones
+// given by flags or environment variables. urls is a comma separated list.
+func (c *Config) OverrideTURN(urls, secret, ttl string) {
+	if urls != "" {
+		c.TURN.URLs = splitList(urls)
+	}
+	if secret != "" {
+		c.TURN.Secret = secret
+	}
+	if ttl != "" {
+		c.TURN.CredentialTTL = ttl
+	}
+}
+
+// OverrideAuth replaces the join token keys loaded from the file with the
+// ones given by flags or environment variables.
+func (c *Config) OverrideAuth(secret, publicKey string) {
+	if secret != "" {
+		c.Auth.Secret = secret
+	}
+	if publicKey != "" {
+		c.Auth.PublicKey = publicKey
+	}
+}
+
+// Verifier returns the verifier of the join tokens.
+func (c *Config) Verifier() (*auth.Verifier, error) {
+	v := &auth.Verifier{Secret: []byte(c.Auth.Secret)}
+	if c.Auth.PublicKey == "" {
+		return v, nil
+	}
+
+	key := c.Auth.PublicKey
+	if !strings.Contains(key, "-----BEGIN") {
+		if raw, err := os.ReadFile(key); err == nil {
+			key = string(raw)
+		}
+	}
+
+	var err error
+	if v.PublicKey, err = auth.ParsePublicKey(key); err != nil {
+		return nil, fmt.Errorf("auth public_key: %w", err)
+	}
+	return v, nil
+}
+
+// Settings converts the ICE configuration into the settings PeerConnections are created with.
+func (c *Config) Settings() (*w.Settings, error) {
+	s := &w.Settings{
+		ICETransportPolicy: webrtc.ICETransportPolicyAll,
+		NAT1To1IPs:         c.ICE.NAT1To1IPs,
+	}
+
+	switch c.ICE.TransportPolicy {
+	case "", "all":
+	case "relay":
+		s.ICETransportPolicy = webrtc.ICETransportPolicyRelay
+	default:
+		return nil, fmt.Errorf("unknown ICE transport policy %q", c.ICE.TransportPolicy)
+	}
+
+	for _, server := range c.ICE.Servers {
+		if len(server.URLs) == 0 {
+			return nil, fmt.Errorf("ICE server without urls")
+		}
+
+		iceServer := webrtc.ICEServer{URLs: server.URLs}
+		if server.Username != "" {
+			iceServer.Username = server.Username
+			iceServer.Credential = server.Credential
+			iceServer.CredentialType = webrtc.ICECredentialTypePassword
+		}
+		s.ICEServers = append(s.ICEServers, iceServer)
+	}
+
+	s.TURNURLs = c.TURN.URLs
+	s.TURNSecret = c.TURN.Secret
+	s.TURNCredentialTTL = DefaultCredentialTTL
+	if c.TURN.CredentialTTL != "" {
+		ttl, err := time.ParseDuration(c.TURN.CredentialTTL)
+		if err != nil {
+			return nil, fmt.Errorf("turn credential_ttl: %w", err)
+		}
+		s.TURNCredentialTTL = ttl
+	}
+	if len(s.TURNURLs) > 0 && s.TURNSecret == "" {
+		return nil, fmt.Errorf("turn urls are set without a secret")
+	}
+	return s, nil
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
@@ -0,0 +1,339 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"quick-video/pkg/protocol"
+	"quick-video/pkg/recorder"
+	w "quick-video/pkg/webrtc"
+
+	"github.com/gofiber/fiber/v2"
+	guuid "github.com/google/uuid"
+)
+
+// The JSON documents of the admin API.
+type (
+	apiRoom struct {
+		ID         string    `json:"id"`
+		StreamID   string    `json:"streamId"`
+		CreatedAt  time.Time `json:"createdAt"`
+		LastUsed   time.Time `json:"lastUsed"`
+		Publishers int       `json:"publishers"`
+		Viewers    int       `json:"viewers"`
+		Recording  bool      `json:"recording"`
+	}
+
+	apiRoomDetails struct {
+		apiRoom
+		Participants []apiParticipant `json:"participants"`
+		Tracks       []apiTrack       `json:"tracks"`
+		ChatClients  int              `json:"chatClients"`
+	}
+
+	apiParticipant struct {
+		ID        string    `json:"id"`
+		Identity  string    `json:"identity,omitempty"`
+		Name      string    `json:"name,omitempty"`
+		Role      string    `json:"role"`
+		Transport string    `json:"transport"`
+		State     string    `json:"state"`
+		JoinedAt  time.Time `json:"joinedAt"`
+		Tracks    []string  `json:"tracks"`
+		// Quality is the last quality sample of the connection, the one
+		// the client was sent too.
+		Quality   *protocol.Quality `json:"quality,omitempty"`
+		QualityAt *time.Time        `json:"qualityAt,omitempty"`
+	}
+
+	apiTrack struct {
+		ID       string `json:"id"`
+		StreamID string `json:"streamId"`
+		Kind     string `json:"kind"`
+		MimeType string `json:"mimeType"`
+		// Publisher is the ID of the publishing participant, empty for
+		// tracks fed by the server, e.g. over RTMP.
+		Publisher   string   `json:"publisher,omitempty"`
+		Layers      []string `json:"layers"`
+		Subscribers int      `json:"subscribers"`
+		Muted       bool     `json:"muted"`
+	}
+
+	apiStream struct {
+		StreamID string `json:"streamId"`
+		RoomID   string `json:"roomId"`
+		Viewers  int    `json:"viewers"`
+		Tracks   int    `json:"tracks"`
+		RTMP     bool   `json:"rtmp"`
+	}
+)
+
+// AdminOnly lets through the requests carrying the admin token as a bearer
+// Authorization header. The admin API does not exist without a token.
+func (h *Handler) AdminOnly(c *fiber.Ctx) error {
+	if h.AdminToken == "" {
+		return fiber.ErrNotFound
+	}
+
+	token, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(h.AdminToken)) != 1 {
+		return fiber.ErrUnauthorized
+	}
+	return c.Next()
+}
+
+// ListRooms lists every open room.
+func (h *Handler) ListRooms(c *fiber.Ctx) error {
+	rooms := h.Rooms.List()
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].CreatedAt.Before(rooms[j].CreatedAt)
+	})
+
+	list := make([]apiRoom, 0, len(rooms))
+	for _, room := range rooms {
+		list = append(list, h.apiRoom(room))
+	}
+	return c.JSON(list)
+}
+
+// GetRoom shows a room with its participants and tracks.
+func (h *Handler) GetRoom(c *fiber.Ctx) error {
+	room, ok := h.Rooms.Get(c.Params("uuid"))
+	if !ok {
+		return fiber.ErrNotFound
+	}
+	return c.JSON(h.apiRoomDetails(room))
+}
+
+// roomID is the pattern of the IDs of the rooms created through the API,
+// which end up in URLs and in the paths of the recordings.
+var roomID = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+type roomOptions struct {
+	// ID defaults to a random UUID.
+	ID string `json:"id"`
+	// Record starts recording the room right away.
+	Record bool `json:"record"`
+}
+
+// PostRoom creates a room with the options in the body.
+func (h *Handler) PostRoom(c *fiber.Ctx) error {
+	opts := &roomOptions{}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(opts); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+	}
+	if opts.ID == "" {
+		opts.ID = guuid.New().String()
+	}
+	if !roomID.MatchString(opts.ID) {
+		return fiber.NewError(fiber.StatusBadRequest, "the room ID must be 1 to 64 letters, digits, '-' or '_'")
+	}
+
+	room, err := h.Rooms.CreateNew(opts.ID)
+	if errors.Is(err, w.ErrRoomExists) {
+		return fiber.NewError(fiber.StatusConflict, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+
+	if opts.Record {
+		if _, err := h.Recordings.Start(room); err != nil {
+			return err
+		}
+	}
+
+	c.Location("/api/v1/rooms/" + url.PathEscape(room.ID))
+	return c.Status(fiber.StatusCreated).JSON(h.apiRoomDetails(room))
+}
+
+// EndRoom closes a room, disconnecting everyone in it.
+func (h *Handler) EndRoom(c *fiber.Ctx) error {
+	room, ok := h.Rooms.Get(c.Params("uuid"))
+	if !ok {
+		return fiber.ErrNotFound
+	}
+
+	h.Rooms.Delete(room.ID)
+	if _, err := h.Recordings.Stop(room.ID); err != nil && !errors.Is(err, recorder.ErrNotRecording) {
+		return err
+	}
+	h.HLS.Stop(room.StreamID)
+	room.Close()
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// ListParticipants lists the connections of a room.
+func (h *Handler) ListParticipants(c *fiber.Ctx) error {
+	room, ok := h.Rooms.Get(c.Params("uuid"))
+	if !ok {
+		return fiber.ErrNotFound
+	}
+	return c.JSON(apiParticipants(room.Peers.Participants()))
+}
+
+// KickParticipant closes the PeerConnection and the signaling socket of a participant.
+func (h *Handler) KickParticipant(c *fiber.Ctx) error {
+	room, ok := h.Rooms.Get(c.Params("uuid"))
+	if !ok {
+		return fiber.ErrNotFound
+	}
+
+	err := room.Peers.Kick(c.Params("id"), "kicked")
+	if errors.Is(err, w.ErrUnknownParticipant) {
+		return fiber.NewError(fiber.StatusNotFound, err.Error())
+	} else if err != nil {
+		return err
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// MuteTrack stops forwarding a track, UnmuteTrack resumes it.
+func (h *Handler) MuteTrack(c *fiber.Ctx) error {
+	return h.muteTrack(c, true)
+}
+
+func (h *Handler) UnmuteTrack(c *fiber.Ctx) error {
+	return h.muteTrack(c, false)
+}
+
+func (h *Handler) muteTrack(c *fiber.Ctx, muted bool) error {
+	room, ok := h.Rooms.Get(c.Params("uuid"))
+	if !ok {
+		return fiber.ErrNotFound
+	}
+
+	// Track IDs are picked by the browsers and may need escaping.
+	trackID, err := url.PathUnescape(c.Params("track"))
+	if err != nil {
+		return fiber.ErrBadRequest
+	}
+
+	err = room.Peers.MuteTrack(trackID, muted)
+	if errors.Is(err, w.ErrUnknownTrack) {
+		return fiber.NewError(fiber.StatusNotFound, err.Error())
+	} else if err != nil {
+		return err
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// ListStreams lists the stream of every room with what it carries.
+func (h *Handler) ListStreams(c *fiber.Ctx) error {
+	streams := []apiStream{}
+	for _, room := range h.Rooms.List() {
+		_, viewers := room.Peers.Counts()
+
+		room.Peers.ListLock.RLock()
+		s := apiStream{
+			StreamID: room.StreamID,
+			RoomID:   room.ID,
+			Viewers:  viewers,
+			Tracks:   len(room.Peers.Tracks),
+		}
+		for _, t := range room.Peers.Tracks {
+			if t.Publisher() == nil {
+				s.RTMP = true
+			}
+		}
+		room.Peers.ListLock.RUnlock()
+
+		streams = append(streams, s)
+	}
+	sort.Slice(streams, func(i, j int) bool {
+		return streams[i].RoomID < streams[j].RoomID
+	})
+	return c.JSON(streams)
+}
+
+func (h *Handler) apiRoom(room *w.Room) apiRoom {
+	publishers, viewers := room.Peers.Counts()
+	_, recording := h.Recordings.Get(room.ID)
+
+	return apiRoom{
+		ID:         room.ID,
+		StreamID:   room.StreamID,
+		CreatedAt:  room.CreatedAt,
+		LastUsed:   room.LastUsed(),
+		Publishers: publishers,
+		Viewers:    viewers,
+		Recording:  recording,
+	}
+}
+
+func (h *Handler) apiRoomDetails(room *w.Room) apiRoomDetails {
+	r := apiRoomDetails{
+		apiRoom:      h.apiRoom(room),
+		Participants: apiParticipants(room.Peers.Participants()),
+	}
+
+	room.Peers.ListLock.RLock()
+	tracks := make([]*w.Track, 0, len(room.Peers.Tracks))
+	for _, t := range room.Peers.Tracks {
+		tracks = append(tracks, t)
+	}
+	room.Peers.ListLock.RUnlock()
+
+	r.Tracks = make([]apiTrack, 0, len(tracks))
+	for _, t := range tracks {
+		r.Tracks = append(r.Tracks, apiTrack{
+			ID:          t.ID(),
+			StreamID:    t.StreamID(),
+			Kind:        t.Kind().String(),
+			MimeType:    t.Codec().MimeType,
+			Publisher:   room.Peers.Publisher(t),
+			Layers:      t.Layers(),
+			Subscribers: t.Subscribers(),
+			Muted:       t.Muted(),
+		})
+	}
+	sort.Slice(r.Tracks, func(i, j int) bool {
+		return r.Tracks[i].ID < r.Tracks[j].ID
+	})
+
+	if room.Hub != nil {
+		r.ChatClients = room.Hub.Clients()
+	}
+	return r
+}
+
+func apiParticipants(participants []w.Participant) []apiParticipant {
+	list := make([]apiParticipant, 0, len(participants))
+	for _, p := range participants {
+		transport := "websocket"
+		if p.HTTP {
+			transport = "http"
+		}
+
+		tracks := p.Tracks
+		if tracks == nil {
+			tracks = []string{}
+		}
+		sort.Strings(tracks)
+
+		participant := apiParticipant{
+			ID:        p.ID,
+			Identity:  p.Identity,
+			Name:      p.Name,
+			Role:      p.Role.String(),
+			Transport: transport,
+			State:     p.State.String(),
+			JoinedAt:  p.JoinedAt,
+			Tracks:    tracks,
+			Quality:   p.Quality,
+		}
+		if p.Quality != nil {
+			at := p.QualityAt
+			participant.QualityAt = &at
+		}
+		list = append(list, participant)
+	}
+	return list
+}
@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"quick-video/pkg/auth"
+	w "quick-video/pkg/webrtc"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// claimsKey holds the claims of the join token of a request in its locals.
+const claimsKey = "claims"
+
+var errRoomNotFound = errors.New("room not found")
+
+// Requirements of Authorize on the claims of a join token.
+var (
+	AnyClaims    = func(*auth.Claims) bool { return true }
+	HostOnly     = func(c *auth.Claims) bool { return c.Role == auth.RoleHost }
+	CanPublish   = func(c *auth.Claims) bool { return c.Allowed().Publish }
+	CanSubscribe = func(c *auth.Claims) bool { return c.Allowed().Subscribe }
+	CanJoin      = func(c *auth.Claims) bool { return c.Allowed().Publish || c.Allowed().Subscribe }
+	CanChat      = func(c *auth.Claims) bool { return c.Allowed().Chat }
+)
+
+// Authorize lets a request to a room or stream through if it carries a join
+// token for that room meeting allowed, and keeps the token claims for the
+// handler. Every request is let through when rooms require no token.
+// Routes naming no room or stream, like /ice-servers, take a token for any
+// room.
+//
+// The token is read from the token query parameter, which is all browsers
+// can set on a WebSocket, or from a bearer Authorization header.
+func (h *Handler) Authorize(allowed func(*auth.Claims) bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !h.Auth.Enabled() {
+			return c.Next()
+		}
+
+		claims, err := h.Auth.Verify(requestToken(c))
+		if err != nil {
+			return fiber.NewError(fiber.StatusUnauthorized, err.Error())
+		}
+
+		if len(c.Route().Params) > 0 {
+			roomID := c.Params("uuid")
+			if suuid := c.Params("suuid"); suuid != "" {
+				stream, ok := h.Rooms.ByStreamID(suuid)
+				if !ok {
+					return fiber.ErrNotFound
+				}
+				roomID = stream.ID
+			}
+			if claims.Room != roomID {
+				return fiber.ErrForbidden
+			}
+		}
+		if !allowed(claims) {
+			return fiber.ErrForbidden
+		}
+
+		c.Locals(claimsKey, claims)
+		return c.Next()
+	}
+}
+
+func requestToken(c *fiber.Ctx) string {
+	if token := c.Query("token"); token != "" {
+		return token
+	}
+	token, _ := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	return token
+}
+
+// tokenQuery returns the query string passing the token of the request on
+// to the WebSockets of the page, if it has one.
+func tokenQuery(c *fiber.Ctx) string {
+	if token := requestToken(c); token != "" {
+		return "?token=" + url.QueryEscape(token)
+	}
+	return ""
+}
+
+// claimsOf returns the claims Authorize kept in locals, nil when rooms
+// require no token.
+func claimsOf(locals interface{}) *auth.Claims {
+	claims, _ := locals.(*auth.Claims)
+	return claims
+}
+
+// openRoom returns the room with the given ID, creating it on the way unless
+// claims are those of a participant or viewer: only hosts create rooms when
+// they require a token.
+func (h *Handler) openRoom(id string, claims *auth.Claims) (*w.Room, error) {
+	if claims == nil || claims.Role == auth.RoleHost {
+		return h.Rooms.Create(id)
+	}
+
+	room, ok := h.Rooms.Get(id)
+	if !ok {
+		return nil, errRoomNotFound
+	}
+	return room, nil
+}
+
+// sessionRole is the role of the session of a client allowed to do p.
+func sessionRole(claims *auth.Claims) (w.Role, error) {
+	if claims == nil {
+		return w.RoleBoth, nil
+	}
+
+	p := claims.Allowed()
+	switch {
+	case p.Publish && p.Subscribe:
+		return w.RoleBoth, nil
+	case p.Publish:
+		return w.RolePublisher, nil
+	case p.Subscribe:
+		return w.RoleSubscriber, nil
+	}
+	return 0, fmt.Errorf("%s may neither publish nor subscribe", claims.Subject)
+}
@@ -1,52 +1,111 @@
 package handlers
 
 import (
+	"bytes"
+
+	"quick-video/pkg/auth"
 	"quick-video/pkg/chat"
-	w "quick-video/pkg/webrtc"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/websocket/v2"
+	guuid "github.com/google/uuid"
 )
 
-func ChatRoom(c *fiber.Ctx) error {
+func (h *Handler) ChatRoom(c *fiber.Ctx) error {
 	return c.Render("chat", fiber.Map{}, "layouts/main")
 }
 
-func ChatRoomWS(c *websocket.Conn) {
+// ChatTranscript exports the chat history of a room as JSON, or as plain
+// text with format=text.
+func (h *Handler) ChatTranscript(c *fiber.Ctx) error {
+	room, ok := h.Rooms.Get(c.Params("uuid"))
+	if !ok || room.Hub == nil {
+		return fiber.ErrNotFound
+	}
+
+	messages, err := room.Hub.History(0)
+	if err != nil {
+		return err
+	}
+	if messages == nil {
+		messages = []*chat.Message{}
+	}
+
+	switch c.Query("format", "json") {
+	case "json":
+		return c.JSON(messages)
+	case "text":
+		b := &bytes.Buffer{}
+		if err := chat.WriteTranscript(b, messages); err != nil {
+			return err
+		}
+		c.Set(fiber.HeaderContentType, fiber.MIMETextPlainCharsetUTF8)
+		return c.Send(b.Bytes())
+	}
+	return fiber.NewError(fiber.StatusBadRequest, "format must be json or text")
+}
+
+func (h *Handler) ChatRoomWS(c *websocket.Conn) {
 	uuid := c.Params("uuid")
 	if uuid == "" {
 		return
 	}
 
-	w.RoomsLock.Lock()
-	room := w.Rooms[uuid]
-	w.RoomsLock.Unlock()
-	if room == nil {
+	room, ok := h.Rooms.Get(uuid)
+	if !ok {
 		return
 	}
 	if room.Hub == nil {
 		return
 	}
 
-	chat.PeerChatConn(c.Conn, room.Hub)
+	identity := chatIdentity(claimsOf(c.Locals(claimsKey)), auth.RoleParticipant)
+	room.Touch()
+	defer room.Touch()
+	chat.PeerChatConn(c.Conn, room.Hub, identity)
 }
 
-func ChatStreamWS(c *websocket.Conn) {
+func (h *Handler) ChatStreamWS(c *websocket.Conn) {
 	suuid := c.Params("suuid")
 	if suuid == "" {
 		return
 	}
 
-	w.RoomsLock.Lock()
-	if stream, ok := w.Streams[suuid]; ok {
-		w.RoomsLock.Unlock()
-		if stream.Hub == nil {
-			hub := chat.NewHub()
-			stream.Hub = hub
-			go hub.Run()
-		}
-		chat.PeerChatConn(c.Conn, stream.Hub)
+	stream, ok := h.Rooms.ByStreamID(suuid)
+	if !ok {
 		return
 	}
-	w.RoomsLock.Unlock()
+
+	identity := chatIdentity(claimsOf(c.Locals(claimsKey)), auth.RoleViewer)
+	stream.Touch()
+	defer stream.Touch()
+	chat.PeerChatConn(c.Conn, stream.Hub, identity)
+}
+
+// chatIdentity returns the identity of a chat client, that of its join
+// token or, without one, that of a guest with the given role. A client is in
+// the group of its role: hosts, participants or viewers. Hosts moderate the
+// chat; guests get a new ID on every socket and never do, so there is no
+// moderation when rooms require no token.
+func chatIdentity(claims *auth.Claims, guest auth.Role) chat.Identity {
+	if claims == nil {
+		id := guuid.New().String()
+		return chat.Identity{ID: id, Name: "guest-" + id[:4], Groups: []string{chatGroup(guest)}}
+	}
+
+	name := claims.Name
+	if name == "" {
+		name = claims.Subject
+	}
+	return chat.Identity{
+		ID:        claims.Subject,
+		Name:      name,
+		Groups:    []string{chatGroup(claims.Role)},
+		Moderator: claims.Role == auth.RoleHost,
+	}
+}
+
+// chatGroup is the chat group of the clients with the given role.
+func chatGroup(role auth.Role) string {
+	return string(role) + "s"
 }
@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"quick-video/pkg/auth"
+	"quick-video/pkg/hls"
+	"quick-video/pkg/recorder"
+	"quick-video/pkg/rtmp"
+	w "quick-video/pkg/webrtc"
+)
+
+// Handler serves the HTTP and WebSocket endpoints of a server on top of its room store.
+type Handler struct {
+	Rooms    w.RoomStore
+	Settings *w.Settings
+	// Auth verifies the join tokens, rooms are open to anyone without keys.
+	Auth       *auth.Verifier
+	Recordings *recorder.Manager
+	// HTTPSessions holds the WHIP and WHEP sessions.
+	HTTPSessions *w.HTTPSessions
+	// RTMP is nil unless RTMP publishes are accepted.
+	RTMP *rtmp.Server
+	HLS  *hls.Manager
+	// AdminToken is the bearer token of the admin API, disabled when empty.
+	AdminToken string
+}
+
+func New(rooms w.RoomStore, settings *w.Settings, verifier *auth.Verifier, recordings *recorder.Manager, ingest *rtmp.Server, egress *hls.Manager, adminToken string) *Handler {
+	return &Handler{
+		Rooms:        rooms,
+		Settings:     settings,
+		Auth:         verifier,
+		Recordings:   recordings,
+		HTTPSessions: w.NewHTTPSessions(),
+		RTMP:         ingest,
+		HLS:          egress,
+		AdminToken:   adminToken,
+	}
+}
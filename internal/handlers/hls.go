@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"errors"
+	"strconv"
+
+	"quick-video/pkg/hls"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// StreamHLS serves the HLS playlist of a stream and the files it lists.
+func (h *Handler) StreamHLS(c *fiber.Ctx) error {
+	stream, ok := h.Rooms.ByStreamID(c.Params("suuid"))
+	if !ok {
+		return fiber.ErrNotFound
+	}
+	stream.Touch()
+
+	egress := h.HLS.Get(stream)
+	name := c.Params("file")
+
+	if name == hls.PlaylistName {
+		msn, part := -1, -1
+		if v := c.Query("_HLS_msn"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return fiber.NewError(fiber.StatusBadRequest, "invalid _HLS_msn")
+			}
+			msn = n
+		}
+		if v := c.Query("_HLS_part"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 || msn < 0 {
+				return fiber.NewError(fiber.StatusBadRequest, "invalid _HLS_part")
+			}
+			part = n
+		}
+
+		playlist, err := egress.Playlist(msn, part, tokenQuery(c))
+		if err != nil {
+			return hlsError(err)
+		}
+
+		c.Set(fiber.HeaderContentType, "application/vnd.apple.mpegurl")
+		c.Set(fiber.HeaderCacheControl, "max-age=1")
+		return c.Send(playlist)
+	}
+
+	data, err := egress.File(name)
+	if err != nil {
+		return hlsError(err)
+	}
+
+	// File names are never reused, so they can be cached for good.
+	c.Set(fiber.HeaderContentType, "video/mp4")
+	c.Set(fiber.HeaderCacheControl, "public, max-age=86400, immutable")
+	return c.Send(data)
+}
+
+func hlsError(err error) error {
+	if errors.Is(err, hls.ErrNotFound) || errors.Is(err, hls.ErrStopped) {
+		return fiber.NewError(fiber.StatusNotFound, err.Error())
+	}
+	return err
+}
@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"github.com/gofiber/fiber/v2"
+	guuid "github.com/google/uuid"
+)
+
+type iceServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// ICEServers hands the browser an RTCConfiguration with short-lived TURN
+// credentials, so that no long-lived password ends up in the page source.
+// The credentials name the subject of the join token, if rooms require one.
+func (h *Handler) ICEServers(c *fiber.Ctx) error {
+	userID := guuid.New().String()
+	if claims := claimsOf(c.Locals(claimsKey)); claims != nil {
+		userID = claims.Subject
+	}
+
+	servers := []iceServer{}
+	for _, s := range h.Settings.ICEServersFor(userID) {
+		credential, _ := s.Credential.(string)
+		servers = append(servers, iceServer{
+			URLs:       s.URLs,
+			Username:   s.Username,
+			Credential: credential,
+		})
+	}
+
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.JSON(fiber.Map{
+		"iceServers":         servers,
+		"iceTransportPolicy": h.Settings.ICETransportPolicy.String(),
+	})
+}
@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"errors"
+
+	"quick-video/pkg/recorder"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// StartRecording starts recording every track published in the room.
+func (h *Handler) StartRecording(c *fiber.Ctx) error {
+	room, ok := h.Rooms.Get(c.Params("uuid"))
+	if !ok {
+		return fiber.ErrNotFound
+	}
+
+	r, err := h.Recordings.Start(room)
+	if errors.Is(err, recorder.ErrRecording) {
+		return fiber.NewError(fiber.StatusConflict, err.Error())
+	} else if err != nil {
+		return err
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(r.Metadata())
+}
+
+// StopRecording stops the recording of the room and returns its metadata.
+func (h *Handler) StopRecording(c *fiber.Ctx) error {
+	m, err := h.Recordings.Stop(c.Params("uuid"))
+	if errors.Is(err, recorder.ErrNotRecording) {
+		return fiber.NewError(fiber.StatusNotFound, err.Error())
+	} else if err != nil {
+		return err
+	}
+
+	return c.JSON(m)
+}
+
+// Recording returns the metadata of the recording in progress in the room.
+func (h *Handler) Recording(c *fiber.Ctx) error {
+	r, ok := h.Recordings.Get(c.Params("uuid"))
+	if !ok {
+		return fiber.NewError(fiber.StatusNotFound, recorder.ErrNotRecording.Error())
+	}
+
+	return c.JSON(r.Metadata())
+}
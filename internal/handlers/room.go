@@ -1,25 +1,35 @@
 package handlers
 
 import (
-	"crypto/sha256"
 	"fmt"
+	"log"
 	"os"
-	"time"
 
-	"quick-video/pkg/chat"
+	"quick-video/pkg/auth"
 	w "quick-video/pkg/webrtc"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/websocket/v2"
 	guuid "github.com/google/uuid"
-	"github.com/pion/webrtc/v3"
 )
 
-func CreateRoom(c *fiber.Ctx) error {
-	return c.Redirect(fmt.Sprintf("/room/%s", guuid.New().String()))
+func (h *Handler) CreateRoom(c *fiber.Ctx) error {
+	if !h.Auth.Enabled() {
+		return c.Redirect(fmt.Sprintf("/room/%s", guuid.New().String()))
+	}
+
+	// Rooms are created by their hosts, in the room their token is for.
+	claims, err := h.Auth.Verify(requestToken(c))
+	if err != nil {
+		return fiber.NewError(fiber.StatusUnauthorized, err.Error())
+	}
+	if claims.Role != auth.RoleHost {
+		return fiber.ErrForbidden
+	}
+	return c.Redirect(fmt.Sprintf("/room/%s%s", claims.Room, tokenQuery(c)))
 }
 
-func Room(c *fiber.Ctx) error {
+func (h *Handler) Room(c *fiber.Ctx) error {
 	uuid := c.Params("uuid")
 	if uuid == "" {
 		c.Status(400)
@@ -31,85 +41,61 @@ func Room(c *fiber.Ctx) error {
 		ws = "wss"
 	}
 
-	uuid, suuid, _ := createOrGetRoom(uuid)
+	room, err := h.openRoom(uuid, claimsOf(c.Locals(claimsKey)))
+	if err == errRoomNotFound {
+		return fiber.NewError(fiber.StatusNotFound, err.Error())
+	} else if err != nil {
+		return err
+	}
+	room.Touch()
+
+	token := tokenQuery(c)
 	return c.Render("peer", fiber.Map{
-		"RoomWebsocketAddr":   fmt.Sprintf("%s://%s/room/%s/ws", ws, c.Hostname(), uuid),
-		"RoomLink":            fmt.Sprintf("%s://%s/room/%s", c.Protocol(), c.Hostname(), uuid),
-		"ChatWebsocketAddr":   fmt.Sprintf("%s://%s/room/%s/chat/ws", ws, c.Hostname(), uuid),
-		"ViewerWebsocketAddr": fmt.Sprintf("%s://%s/room/%s/viewer/ws", ws, c.Hostname(), uuid),
-		"StreamLink":          fmt.Sprintf("%s://%s/stream/%s", c.Protocol(), c.Hostname(), suuid),
+		"RoomWebsocketAddr":   fmt.Sprintf("%s://%s/room/%s/ws%s", ws, c.Hostname(), room.ID, token),
+		"ICEServersAddr":      "/ice-servers" + token,
+		"RoomLink":            fmt.Sprintf("%s://%s/room/%s", c.Protocol(), c.Hostname(), room.ID),
+		"ChatWebsocketAddr":   fmt.Sprintf("%s://%s/room/%s/chat/ws%s", ws, c.Hostname(), room.ID, token),
+		"ViewerWebsocketAddr": fmt.Sprintf("%s://%s/room/%s/viewer/ws%s", ws, c.Hostname(), room.ID, token),
+		"StreamLink":          fmt.Sprintf("%s://%s/stream/%s", c.Protocol(), c.Hostname(), room.StreamID),
 		"Type":                "room",
 	}, "layouts/main")
 }
 
-func RoomWS(c *websocket.Conn) {
+func (h *Handler) RoomWS(c *websocket.Conn) {
 	uuid := c.Params("uuid")
 	if uuid == "" {
 		return
 	}
 
-	_, _, room := createOrGetRoom(uuid)
-	w.RoomConn(c, room.Peers)
-}
-
-func createOrGetRoom(uuid string) (string, string, *w.Room) {
-	w.RoomsLock.Lock()
-	defer w.RoomsLock.Unlock()
-
-	h := sha256.New()
-	h.Write([]byte(uuid))
-	suuid := fmt.Sprintf("%x", h.Sum(nil))
-
-	if room := w.Rooms[uuid]; room != nil {
-		if _, ok := w.Streams[uuid]; !ok {
-			w.Streams[uuid] = room
-		}
-		return uuid, suuid, room
+	claims := claimsOf(c.Locals(claimsKey))
+	role, err := sessionRole(claims)
+	if err != nil {
+		log.Println(err)
+		return
 	}
 
-	hub := chat.NewHub()
-	p := &w.Peers{}
-	p.TrackLocals = make(map[string]*webrtc.TrackLocalStaticRTP)
-	room := &w.Room{
-		Peers: p,
-		Hub:   hub,
+	room, err := h.openRoom(uuid, claims)
+	if err != nil {
+		log.Println(err)
+		return
 	}
 
-	w.Rooms[uuid] = room
-	w.Streams[suuid] = room
-
-	go hub.Run()
-	return uuid, suuid, room
+	room.Touch()
+	defer room.Touch()
+	session := w.NewSession(c, room.Peers, h.Settings, role)
+	if claims != nil {
+		session.Identity, session.Name = claims.Subject, claims.Name
+	}
+	session.Run()
 }
 
-func ViewRoomWS(c *websocket.Conn) {
+func (h *Handler) ViewRoomWS(c *websocket.Conn) {
 	uuid := c.Params("uuid")
 	if uuid == "" {
 		return
 	}
 
-	w.RoomsLock.Lock()
-	if peer, ok := w.Rooms[uuid]; ok {
-		w.RoomsLock.Unlock()
-		roomViewerConn(c, peer.Peers)
-		return
-	}
-	w.RoomsLock.Unlock()
-}
-
-func roomViewerConn(c *websocket.Conn, p *w.Peers) {
-	ticker := time.NewTicker(1 * time.Second)
-	defer ticker.Stop()
-	defer c.Close()
-
-	for {
-		select {
-		case <-ticker.C:
-			w, err := c.Conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
-			}
-			w.Write([]byte(fmt.Sprintf("%d", len(p.Connections))))
-		}
+	if room, ok := h.Rooms.Get(uuid); ok {
+		viewerConn(c, room)
 	}
 }
@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"fmt"
+	"net"
+
+	"quick-video/pkg/rtmp"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// RTMPPublish tells the members of a room where an encoder publishes into
+// the room's stream. Knowing the room ID is what entitles to the stream key.
+func (h *Handler) RTMPPublish(c *fiber.Ctx) error {
+	if h.RTMP == nil {
+		return fiber.NewError(fiber.StatusNotFound, "RTMP publishing is not enabled")
+	}
+
+	room, ok := h.Rooms.Get(c.Params("uuid"))
+	if !ok {
+		return fiber.ErrNotFound
+	}
+
+	_, port, err := net.SplitHostPort(h.RTMP.Addr)
+	if err != nil {
+		return err
+	}
+
+	host, _, err := net.SplitHostPort(c.Hostname())
+	if err != nil {
+		host = c.Hostname()
+	}
+
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.JSON(fiber.Map{
+		"url":       fmt.Sprintf("rtmp://%s/live", net.JoinHostPort(host, port)),
+		"streamKey": rtmp.PublishName(h.RTMP.Secret, room.StreamID),
+	})
+}
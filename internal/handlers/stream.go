@@ -11,7 +11,7 @@ import (
 	"github.com/gofiber/websocket/v2"
 )
 
-func Stream(c *fiber.Ctx) error {
+func (h *Handler) Stream(c *fiber.Ctx) error {
 	suuid := c.Params("suuid")
 	if suuid == "" {
 		c.Status(400)
@@ -23,56 +23,56 @@ func Stream(c *fiber.Ctx) error {
 		ws = "wss"
 	}
 
-	w.RoomsLock.Lock()
-	if _, ok := w.Streams[suuid]; ok {
-		w.RoomsLock.Unlock()
+	if _, ok := h.Rooms.ByStreamID(suuid); ok {
+		token := tokenQuery(c)
 		return c.Render("stream", fiber.Map{
-			"StreamWebsocketAddr": fmt.Sprintf("%s://%s/stream/%s/ws", ws, c.Hostname(), suuid),
-			"ChatWebsocketAddr":   fmt.Sprintf("%s://%s/stream/%s/chat/ws", ws, c.Hostname(), suuid),
-			"ViewerWebsocketAddr": fmt.Sprintf("%s://%s/stream/%s/viewer/ws", ws, c.Hostname(), suuid),
+			"StreamWebsocketAddr": fmt.Sprintf("%s://%s/stream/%s/ws%s", ws, c.Hostname(), suuid, token),
+			"ICEServersAddr":      "/ice-servers" + token,
+			"ChatWebsocketAddr":   fmt.Sprintf("%s://%s/stream/%s/chat/ws%s", ws, c.Hostname(), suuid, token),
+			"ViewerWebsocketAddr": fmt.Sprintf("%s://%s/stream/%s/viewer/ws%s", ws, c.Hostname(), suuid, token),
 			"Type":                "stream",
 		}, "layouts/main")
 	}
 
-	w.RoomsLock.Unlock()
-
 	return c.Render("stream", fiber.Map{
 		"Nostream": "true",
 		"Leave":    "true",
 	}, "layouts/main")
 }
 
-func StreamWS(c *websocket.Conn) {
+func (h *Handler) StreamWS(c *websocket.Conn) {
 	suuid := c.Params("suuid")
 	if suuid == "" {
 		return
 	}
 
-	w.RoomsLock.Lock()
-	if stream, ok := w.Streams[suuid]; ok {
-		w.RoomsLock.Unlock()
-		w.StreamConn(c, stream.Peers)
-		return
+	if stream, ok := h.Rooms.ByStreamID(suuid); ok {
+		stream.Touch()
+		defer stream.Touch()
+		session := w.NewSession(c, stream.Peers, h.Settings, w.RoleSubscriber)
+		if claims := claimsOf(c.Locals(claimsKey)); claims != nil {
+			session.Identity, session.Name = claims.Subject, claims.Name
+		}
+		session.Run()
 	}
-	w.RoomsLock.Unlock()
 }
 
-func StreamViewerWS(c *websocket.Conn) {
+func (h *Handler) StreamViewerWS(c *websocket.Conn) {
 	suuid := c.Params("suuid")
 	if suuid == "" {
 		return
 	}
 
-	w.RoomsLock.Lock()
-	if stream, ok := w.Streams[suuid]; ok {
-		w.RoomsLock.Unlock()
-		viewerConn(c, stream.Peers)
-		return
+	if stream, ok := h.Rooms.ByStreamID(suuid); ok {
+		viewerConn(c, stream)
 	}
-	w.RoomsLock.Unlock()
 }
 
-func viewerConn(c *websocket.Conn, p *w.Peers) {
+// viewerConn reports the publisher and viewer counts of room every second.
+func viewerConn(c *websocket.Conn, room *w.Room) {
+	leave := room.Watch()
+	defer leave()
+
 	ticker := time.NewTicker(1 * time.Second)
 	defer ticker.Stop()
 	defer c.Close()
@@ -80,11 +80,13 @@ func viewerConn(c *websocket.Conn, p *w.Peers) {
 	for {
 		select {
 		case <-ticker.C:
-			w, err := c.Conn.NextWriter(websocket.TextMessage)
-			if err != nil {
+			publishers, viewers := room.Peers.Counts()
+			if err := c.WriteJSON(fiber.Map{
+				"publishers": publishers,
+				"viewers":    viewers,
+			}); err != nil {
 				return
 			}
-			w.Write([]byte(fmt.Sprintf("%d", len(p.Connections))))
 		}
 	}
 }
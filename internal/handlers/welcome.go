@@ -4,6 +4,6 @@ import (
 	"github.com/gofiber/fiber/v2"
 )
 
-func Welcome(c *fiber.Ctx) error {
+func (h *Handler) Welcome(c *fiber.Ctx) error {
 	return c.Render("welcome", nil, "layouts/main")
 }
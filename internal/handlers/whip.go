@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	w "quick-video/pkg/webrtc"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	mimeTypeSDP         = "application/sdp"
+	mimeTypeTrickleFrag = "application/trickle-ice-sdpfrag"
+)
+
+// WHIP publishes into a stream with the WebRTC-HTTP Ingestion Protocol, so
+// that encoders like OBS or GStreamer can go live without the browser page.
+func (h *Handler) WHIP(c *fiber.Ctx) error {
+	return h.httpSession(c, "whip", w.RolePublisher)
+}
+
+// WHEP plays a stream with the WebRTC-HTTP Egress Protocol, so that players
+// and monitoring tools can pull it without the signaling socket.
+func (h *Handler) WHEP(c *fiber.Ctx) error {
+	return h.httpSession(c, "whep", w.RoleSubscriber)
+}
+
+// httpSession answers the SDP offer in the body of a WHIP or WHEP request
+// with a new session of the given role in the stream.
+func (h *Handler) httpSession(c *fiber.Ctx, protocol string, role w.Role) error {
+	suuid := c.Params("suuid")
+	stream, ok := h.Rooms.ByStreamID(suuid)
+	if !ok {
+		return fiber.ErrNotFound
+	}
+
+	if !strings.HasPrefix(c.Get(fiber.HeaderContentType), mimeTypeSDP) {
+		return fiber.ErrUnsupportedMediaType
+	}
+
+	session, answer, err := w.NewHTTPSession(stream.Peers, h.Settings, role, string(c.Body()))
+	if err != nil {
+		log.Println(err)
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	h.HTTPSessions.Add(session)
+
+	stream.Touch()
+	go func() {
+		<-session.Done()
+		stream.Touch()
+	}()
+
+	for _, link := range iceServerLinks(h.Settings, session.ID) {
+		c.Append(fiber.HeaderLink, link)
+	}
+	c.Set(fiber.HeaderLocation, fmt.Sprintf("/%s/%s/%s", protocol, suuid, session.ID))
+	c.Set(fiber.HeaderContentType, mimeTypeSDP)
+	return c.Status(fiber.StatusCreated).SendString(answer)
+}
+
+// PatchSession trickles the ICE candidates of a WHIP or WHEP client.
+func (h *Handler) PatchSession(c *fiber.Ctx) error {
+	session, err := h.session(c)
+	if err != nil {
+		return err
+	}
+
+	if !strings.HasPrefix(c.Get(fiber.HeaderContentType), mimeTypeTrickleFrag) {
+		return fiber.ErrUnsupportedMediaType
+	}
+
+	if err := session.AddICECandidates(string(c.Body())); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// DeleteSession ends a WHIP or WHEP session.
+func (h *Handler) DeleteSession(c *fiber.Ctx) error {
+	session, err := h.session(c)
+	if err != nil {
+		return err
+	}
+
+	if err := session.Close(); err != nil {
+		log.Println(err)
+	}
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// session returns the HTTP session of the request, which must belong to the stream of the request.
+func (h *Handler) session(c *fiber.Ctx) (*w.HTTPSession, error) {
+	stream, ok := h.Rooms.ByStreamID(c.Params("suuid"))
+	if !ok {
+		return nil, fiber.ErrNotFound
+	}
+
+	session, ok := h.HTTPSessions.Get(c.Params("id"))
+	if !ok || session.Peers != stream.Peers {
+		return nil, fiber.ErrNotFound
+	}
+	return session, nil
+}
+
+// iceServerLinks lists the ICE servers as Link headers, the way WHIP and
+// WHEP clients learn about them.
+func iceServerLinks(settings *w.Settings, userID string) []string {
+	var links []string
+	for _, s := range settings.ICEServersFor(userID) {
+		for _, url := range s.URLs {
+			link := fmt.Sprintf(`<%s>; rel="ice-server"`, url)
+			if credential, _ := s.Credential.(string); s.Username != "" {
+				link += fmt.Sprintf(`; username="%s"; credential="%s"; credential-type="password"`, s.Username, credential)
+			}
+			links = append(links, link)
+		}
+	}
+	return links
+}
@@ -0,0 +1,237 @@
+package server
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"quick-video/pkg/chat"
+	"quick-video/pkg/hls"
+	w "quick-video/pkg/webrtc"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// otherRooms is the room label of the rooms past the cardinality limit,
+// whose metrics are summed.
+const otherRooms = "_other"
+
+// Metrics serves the state of the rooms and what the SFU, the signaling and
+// the chat did in them, in the Prometheus text format.
+type Metrics struct {
+	Rooms w.RoomStore
+	HLS   *hls.Manager
+	// RoomLimit is how many open rooms get their own room label at most.
+	RoomLimit int
+
+	lock sync.Mutex
+	// labels pins the room label of every room on its first scrape, so that
+	// its counters never move from one series to another.
+	labels map[*w.Room]string
+	// folded are the counters of the rooms labelled otherRooms on the last
+	// scrape, and closed the sum of those of such rooms closed since, which
+	// keep the otherRooms counters from going down.
+	folded map[*w.Room][]uint64
+	closed []uint64
+}
+
+// roomCounter is a counter of the rooms.
+type roomCounter struct {
+	*metric
+	value func(room *w.Room) uint64
+}
+
+func hubCounter(value func(hub *chat.Hub) uint64) func(room *w.Room) uint64 {
+	return func(room *w.Room) uint64 {
+		if room.Hub == nil {
+			return 0
+		}
+		return value(room.Hub)
+	}
+}
+
+func (m *Metrics) Handler(c *fiber.Ctx) error {
+	rooms := m.Rooms.List()
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].CreatedAt.Before(rooms[j].CreatedAt)
+	})
+
+	var (
+		roomCount   = newMetric("quickvideo_rooms", "gauge", "Open rooms.")
+		streams     = newMetric("quickvideo_streams", "gauge", "Streams with at least one published track.")
+		egresses    = newMetric("quickvideo_hls_egresses", "gauge", "Streams muxed to HLS.")
+		folded      = newMetric("quickvideo_metrics_folded_rooms", "gauge", "Rooms past the cardinality limit, labelled "+otherRooms+".")
+		connections = newMetric("quickvideo_peer_connections", "gauge", "PeerConnections by state.")
+		tracks      = newMetric("quickvideo_tracks", "gauge", "Published tracks by kind and codec.")
+		chatClients = newMetric("quickvideo_chat_clients", "gauge", "Connected chat clients.")
+	)
+	counters := []roomCounter{
+		{newMetric("quickvideo_rtp_forwarded_packets_total", "counter", "RTP packets forwarded to subscribers and sinks."),
+			func(r *w.Room) uint64 { return r.Peers.Counters.ForwardedPackets.Load() }},
+		{newMetric("quickvideo_rtp_forwarded_bytes_total", "counter", "RTP bytes forwarded to subscribers and sinks."),
+			func(r *w.Room) uint64 { return r.Peers.Counters.ForwardedBytes.Load() }},
+		{newMetric("quickvideo_rtcp_pli_received_total", "counter", "Key frame requests (PLI, FIR) received from subscribers."),
+			func(r *w.Room) uint64 { return r.Peers.Counters.PLIsReceived.Load() }},
+		{newMetric("quickvideo_rtcp_pli_sent_total", "counter", "PLIs sent to publishers."),
+			func(r *w.Room) uint64 { return r.Peers.Counters.PLIsSent.Load() }},
+		{newMetric("quickvideo_rtcp_nack_received_total", "counter", "NACKs received from subscribers."),
+			func(r *w.Room) uint64 { return r.Peers.Counters.NACKsReceived.Load() }},
+		{newMetric("quickvideo_signaling_sync_attempts_total", "counter", "Passes over the connections to renegotiate them."),
+			func(r *w.Room) uint64 { return r.Peers.Counters.SyncAttempts.Load() }},
+		{newMetric("quickvideo_signaling_sync_give_ups_total", "counter", "Renegotiations given up after 25 passes and retried later."),
+			func(r *w.Room) uint64 { return r.Peers.Counters.SyncGiveUps.Load() }},
+		{newMetric("quickvideo_signaling_offers_total", "counter", "Renegotiation offers sent."),
+			func(r *w.Room) uint64 { return r.Peers.Counters.Offers.Load() }},
+		{newMetric("quickvideo_chat_messages_broadcast_total", "counter", "Chat messages broadcast."),
+			hubCounter((*chat.Hub).Broadcasts)},
+		{newMetric("quickvideo_chat_messages_dropped_total", "counter", "Chat messages dropped for clients too slow to take them."),
+			hubCounter((*chat.Hub).Dropped)},
+	}
+
+	roomCount.add(uint64(len(rooms)))
+	egresses.add(uint64(m.HLS.Len()))
+	folded.add(0)
+	streams.add(0)
+
+	m.lock.Lock()
+	labels := m.pinLabels(rooms)
+	foldedCounters := make(map[*w.Room][]uint64)
+	// The folded rooms closed since the last scrape are counted with their
+	// last counters.
+	if m.closed == nil {
+		m.closed = make([]uint64, len(counters))
+	}
+	for room, values := range m.folded {
+		if _, open := labels[room]; !open {
+			for i, v := range values {
+				m.closed[i] += v
+			}
+		}
+	}
+	for i, cnt := range counters {
+		cnt.add(m.closed[i], "room", otherRooms)
+	}
+
+	for _, room := range rooms {
+		label := labels[room]
+		if label == otherRooms {
+			folded.add(1)
+			values := make([]uint64, len(counters))
+			for i, cnt := range counters {
+				values[i] = cnt.value(room)
+			}
+			foldedCounters[room] = values
+		}
+
+		peers := room.Peers
+		peers.ListLock.RLock()
+		for _, conn := range peers.Connections {
+			connections.add(1, "room", label, "state", conn.PeerConnection.ConnectionState().String())
+		}
+		for _, t := range peers.Tracks {
+			codec := strings.ToLower(t.Codec().MimeType)
+			if _, name, ok := strings.Cut(codec, "/"); ok {
+				codec = name
+			}
+			tracks.add(1, "room", label, "kind", t.Kind().String(), "codec", codec)
+		}
+		if len(peers.Tracks) > 0 {
+			streams.add(1)
+		}
+		peers.ListLock.RUnlock()
+
+		for _, cnt := range counters {
+			cnt.add(cnt.value(room), "room", label)
+		}
+		if room.Hub != nil {
+			chatClients.add(uint64(room.Hub.Clients()), "room", label)
+		}
+	}
+	m.folded = foldedCounters
+	m.lock.Unlock()
+
+	b := &strings.Builder{}
+	for _, family := range []*metric{roomCount, streams, egresses, folded, connections, tracks, chatClients} {
+		family.writeTo(b)
+	}
+	for _, cnt := range counters {
+		cnt.writeTo(b)
+	}
+
+	c.Set(fiber.HeaderContentType, "text/plain; version=0.0.4; charset=utf-8")
+	return c.SendString(b.String())
+}
+
+// pinLabels returns the room label of every room, oldest first, giving the
+// rooms seen for the first time their own label while fewer than RoomLimit
+// open rooms have one. It forgets the closed rooms. m.lock must be held.
+func (m *Metrics) pinLabels(rooms []*w.Room) map[*w.Room]string {
+	labels := make(map[*w.Room]string, len(rooms))
+	own := 0
+	for _, room := range rooms {
+		if label, ok := m.labels[room]; ok {
+			labels[room] = label
+			if label != otherRooms {
+				own++
+			}
+		}
+	}
+
+	for _, room := range rooms {
+		if _, ok := labels[room]; ok {
+			continue
+		}
+		labels[room] = otherRooms
+		if own < m.RoomLimit {
+			labels[room] = room.ID
+			own++
+		}
+	}
+
+	m.labels = labels
+	return labels
+}
+
+// metric is a metric family, whose samples with the same labels are summed.
+type metric struct {
+	name, typ, help string
+	samples         map[string]uint64
+	order           []string
+}
+
+func newMetric(name, typ, help string) *metric {
+	return &metric{name: name, typ: typ, help: help, samples: make(map[string]uint64)}
+}
+
+// add adds v to the sample with the given label names and values, in pairs.
+func (m *metric) add(v uint64, labels ...string) {
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+`="`+escapeLabel(labels[i+1])+`"`)
+	}
+
+	key := strings.Join(pairs, ",")
+	if _, ok := m.samples[key]; !ok {
+		m.order = append(m.order, key)
+	}
+	m.samples[key] += v
+}
+
+func (m *metric) writeTo(b *strings.Builder) {
+	b.WriteString("# HELP " + m.name + " " + m.help + "\n")
+	b.WriteString("# TYPE " + m.name + " " + m.typ + "\n")
+	for _, key := range m.order {
+		b.WriteString(m.name)
+		if key != "" {
+			b.WriteString("{" + key + "}")
+		}
+		b.WriteString(" " + strconv.FormatUint(m.samples[key], 10) + "\n")
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"io"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"quick-video/pkg/chat"
+	"quick-video/pkg/hls"
+	w "quick-video/pkg/webrtc"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// scrape returns the samples of the counters served by m, by name and labels.
+func scrape(t *testing.T, m *Metrics) map[string]uint64 {
+	t.Helper()
+
+	app := fiber.New()
+	app.Get("/metrics", m.Handler)
+	resp, err := app.Test(httptest.NewRequest("GET", "/metrics", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	samples := make(map[string]uint64)
+	for _, line := range strings.Split(string(body), "\n") {
+		series, value, ok := strings.Cut(line, " ")
+		if !ok || strings.HasPrefix(line, "#") || !strings.Contains(series, "_total") {
+			continue
+		}
+		v, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		samples[series] = v
+	}
+	return samples
+}
+
+func TestMetricsCountersNeverGoDown(t *testing.T) {
+	rooms := w.NewMemoryRoomStore(chat.Options{})
+	m := &Metrics{Rooms: rooms, HLS: hls.NewManager(hls.Options{}), RoomLimit: 2}
+
+	open := func(id string) *w.Room {
+		room, err := rooms.Create(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(room.Hub.Stop)
+		// The rooms are labelled in the order they were created.
+		time.Sleep(time.Millisecond)
+		return room
+	}
+	forward := func(room *w.Room, packets uint64) {
+		room.Peers.Counters.ForwardedPackets.Add(packets)
+	}
+	const packets = `quickvideo_rtp_forwarded_packets_total{room="`
+
+	a, b, c, d := open("a"), open("b"), open("c"), open("d")
+	forward(a, 1)
+	forward(b, 2)
+	forward(c, 4)
+	forward(d, 8)
+
+	var last map[string]uint64
+	check := func(want map[string]uint64) {
+		t.Helper()
+
+		samples := scrape(t, m)
+		for series, v := range last {
+			if now, ok := samples[series]; ok && now < v {
+				t.Errorf("%s went down from %d to %d", series, v, now)
+			}
+		}
+		for room, v := range want {
+			if got := samples[packets+room+`"}`]; got != v {
+				t.Errorf("room %s forwarded %d packets, want %d", room, got, v)
+			}
+		}
+		last = samples
+	}
+
+	check(map[string]uint64{"a": 1, "b": 2, otherRooms: 12})
+
+	forward(c, 16)
+	check(map[string]uint64{"a": 1, "b": 2, otherRooms: 28})
+
+	// c is gone, what it counted stays in _other.
+	rooms.Delete("c")
+	check(map[string]uint64{"a": 1, "b": 2, otherRooms: 28})
+
+	// a is gone: e gets its own label, d keeps _other.
+	rooms.Delete("a")
+	e := open("e")
+	forward(e, 32)
+	forward(d, 64)
+	check(map[string]uint64{"b": 2, "e": 32, otherRooms: 92})
+
+	rooms.Delete("d")
+	forward(b, 1)
+	check(map[string]uint64{"b": 3, "e": 32, otherRooms: 92})
+
+	// A room created past the limit and closed before a scrape is not
+	// counted, but takes nothing away either.
+	f := open("f")
+	forward(f, 128)
+	rooms.Delete("f")
+	check(map[string]uint64{"b": 3, "e": 32, otherRooms: 92})
+}
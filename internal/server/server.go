@@ -1,11 +1,20 @@
 package server
 
 import (
+	"errors"
 	"flag"
+	"log"
 	"os"
+	"strings"
 	"time"
 
+	"quick-video/internal/config"
 	"quick-video/internal/handlers"
+	"quick-video/pkg/auth"
+	"quick-video/pkg/chat"
+	"quick-video/pkg/hls"
+	"quick-video/pkg/recorder"
+	"quick-video/pkg/rtmp"
 	w "quick-video/pkg/webrtc"
 
 	"github.com/gofiber/fiber/v2"
@@ -19,8 +28,53 @@ var (
 	addr = flag.String("addr", ":"+os.Getenv("PORT"), "")
 	cert = flag.String("cert", "", "")
 	key  = flag.String("key", "", "")
+
+	configFile         = flag.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML or JSON config file")
+	iceServers         = flag.String("ice-servers", os.Getenv("ICE_SERVERS"), "comma separated STUN/TURN URLs")
+	iceUsername        = flag.String("ice-username", os.Getenv("ICE_USERNAME"), "")
+	iceCredential      = flag.String("ice-credential", os.Getenv("ICE_CREDENTIAL"), "")
+	iceTransportPolicy = flag.String("ice-transport-policy", os.Getenv("ICE_TRANSPORT_POLICY"), "all or relay")
+	nat1To1IPs         = flag.String("nat-1to1-ips", os.Getenv("NAT_1TO1_IPS"), "comma separated public IPs of the server")
+	turnURLs           = flag.String("turn-urls", os.Getenv("TURN_URLS"), "comma separated TURN URLs using time-limited credentials")
+	turnSecret         = flag.String("turn-secret", os.Getenv("TURN_SECRET"), "secret shared with the TURN server")
+	turnCredentialTTL  = flag.String("turn-credential-ttl", os.Getenv("TURN_CREDENTIAL_TTL"), "")
+
+	authSecret    = flag.String("auth-secret", os.Getenv("AUTH_SECRET"), "secret verifying HS256 join tokens")
+	authPublicKey = flag.String("auth-public-key", os.Getenv("AUTH_PUBLIC_KEY"), "Ed25519 public key verifying EdDSA join tokens, or the path of its PEM file")
+
+	adminToken = flag.String("admin-token", os.Getenv("ADMIN_TOKEN"), "bearer token of the /api/v1 admin API, which is disabled without it")
+
+	metricsRoomLimit = flag.Int("metrics-room-limit", 100, "how many rooms get their own room label in the metrics, the others are summed")
+
+	roomTTL = flag.Duration("room-ttl", 5*time.Minute, "how long an empty room is kept before it is closed, 0 disables it")
+
+	rtmpAddr   = flag.String("rtmp-addr", os.Getenv("RTMP_ADDR"), "address to accept RTMP publishes on, e.g. :1935")
+	rtmpSecret = flag.String("rtmp-secret", os.Getenv("RTMP_SECRET"), "secret the RTMP stream keys are signed with")
+
+	hlsLowLatency = flag.Bool("hls-low-latency", os.Getenv("HLS_LOW_LATENCY") == "true", "list the parts of the HLS segments, as in LL-HLS")
+
+	chatHistoryFile = flag.String("chat-history-file", os.Getenv("CHAT_HISTORY_FILE"), "bbolt database keeping the chat history, which is kept in memory without it")
+	chatHistorySize = flag.Int("chat-history-size", 500, "how many messages of each room the chat history keeps in memory, 0 keeps none")
+	chatRate        = flag.Float64("chat-rate", 1, "how many messages a chat client may send per second on average, 0 disables the limit")
+	chatBurst       = flag.Int("chat-burst", 5, "how many messages a chat client may send in a row")
+	chatMaxLength   = flag.Int("chat-max-length", 500, "longest chat message, in characters")
+	chatBlockLinks  = flag.Bool("chat-block-links", os.Getenv("CHAT_BLOCK_LINKS") == "true", "reject the chat messages with a link")
+	chatWords       = flag.String("chat-blocked-words", os.Getenv("CHAT_BLOCKED_WORDS"), "comma separated words masked in the chat")
+	chatAuditFile   = flag.String("chat-audit-file", os.Getenv("CHAT_AUDIT_FILE"), "file the chat moderation actions are appended to as JSON lines, instead of the log")
+	chatRedisURL    = flag.String("chat-redis-url", os.Getenv("CHAT_REDIS_URL"), "Redis server relaying the chat between the nodes, e.g. redis://:password@localhost:6379")
+
+	recordingsDir = flag.String("recordings-dir", envOr("RECORDINGS_DIR", "recordings"), "directory room recordings are written to")
 )
 
+// hlsIdleTimeout is how long the HLS egress of a stream runs after the last request.
+const hlsIdleTimeout = time.Minute
+
+// chatHistoryRooms is how many rooms the chat history keeps in memory.
+const chatHistoryRooms = 1000
+
+// qualityInterval is how often the quality of every connection is sampled.
+const qualityInterval = 5 * time.Second
+
 func Run() error {
 	flag.Parse()
 
@@ -28,40 +82,118 @@ func Run() error {
 		*addr = ":8080"
 	}
 
-	engine := html.New("./views", ".html")
+	c, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	settings, err := c.Settings()
+	if err != nil {
+		return err
+	}
+	verifier, err := c.Verifier()
+	if err != nil {
+		return err
+	}
 
-	app := fiber.New(fiber.Config{Views: engine})
-	app.Use(logger.New())
-	app.Use(cors.New())
+	var history chat.HistoryStore
+	switch {
+	case *chatHistorySize < 0:
+		return errors.New("chat-history-size must be 0, which keeps no history, or more")
+	case *chatHistorySize > 0:
+		history = chat.NewMemoryHistory(*chatHistorySize, chatHistoryRooms)
+	}
+	if *chatHistoryFile != "" {
+		bolt, err := chat.OpenBoltHistory(*chatHistoryFile)
+		if err != nil {
+			return err
+		}
+		defer bolt.Close()
+		history = bolt
+	}
 
-	app.Get("/", handlers.Welcome)
-	app.Get("/room/create", handlers.CreateRoom)
-	app.Get("/room/:uuid", handlers.Room)
-	app.Get("/room/:uuid/ws", websocket.New(handlers.RoomWS, websocket.Config{
-		HandshakeTimeout: 10 * time.Second,
-	}))
-	app.Get("/room/:uuid/chat", handlers.ChatRoom)
-	app.Get("/room/:uuid/chat/ws", websocket.New(handlers.ChatRoomWS))
-	app.Get("/room/:uuid/viewer/ws", websocket.New(handlers.ViewRoomWS))
-	app.Get("/stream/:suuid", handlers.Stream)
-	app.Get("/stream/:suuid/ws", websocket.New(handlers.StreamWS, websocket.Config{
-		HandshakeTimeout: 10 * time.Second,
-	}))
-	app.Get("/stream/:suuid/chat/ws", websocket.New(handlers.ChatStreamWS))
-	app.Get("/stream/:suuid/viewer/ws", websocket.New(handlers.StreamViewerWS))
-	app.Static("/", "./assets")
+	moderation := chat.Moderation{
+		Rate:    *chatRate,
+		Burst:   *chatBurst,
+		Filters: []chat.Filter{chat.MaxLength(*chatMaxLength), chat.WordList(strings.Split(*chatWords, ","))},
+		Audit:   chat.AuditLog(log.Writer()),
+	}
+	if *chatBlockLinks {
+		moderation.Filters = append(moderation.Filters, chat.BlockLinks())
+	}
+	if *chatAuditFile != "" {
+		f, err := os.OpenFile(*chatAuditFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		moderation.Audit = chat.AuditLog(f)
+	}
+	chatOpts := chat.Options{History: history, Moderation: moderation}
+	if *chatRedisURL != "" {
+		backplane, err := chat.NewRedisBackplane(*chatRedisURL)
+		if err != nil {
+			return err
+		}
+		defer backplane.Close()
+		chatOpts.Backplane = backplane
+	}
+
+	rooms := w.NewMemoryRoomStore(chatOpts)
+	recordings := recorder.NewManager(*recordingsDir)
+
+	var ingest *rtmp.Server
+	if *rtmpAddr != "" {
+		if *rtmpSecret == "" {
+			return errors.New("rtmp-secret is required to accept RTMP publishes")
+		}
+
+		ingest = &rtmp.Server{Addr: *rtmpAddr, Rooms: rooms, Secret: *rtmpSecret}
+		go func() {
+			if err := ingest.ListenAndServe(); err != nil {
+				log.Println(err)
+			}
+		}()
+	}
+
+	egress := hls.NewManager(hls.Options{LowLatency: *hlsLowLatency})
+	go func() {
+		for range time.NewTicker(hlsIdleTimeout / 2).C {
+			egress.Reap(hlsIdleTimeout)
+		}
+	}()
 
-	w.Rooms = make(map[string]*w.Room)
-	w.Streams = make(map[string]*w.Room)
+	metrics := &Metrics{Rooms: rooms, HLS: egress, RoomLimit: *metricsRoomLimit}
+	app := NewApp(rooms, settings, verifier, recordings, ingest, egress, metrics, *adminToken)
 
 	go func() {
 		for range time.NewTicker(time.Second * 3).C {
-			for _, room := range w.Rooms {
+			for _, room := range rooms.List() {
 				room.Peers.DispatchKeyFrame()
 			}
 		}
 	}()
 
+	go func() {
+		for range time.NewTicker(qualityInterval).C {
+			for _, room := range rooms.List() {
+				room.Peers.SampleQuality()
+			}
+		}
+	}()
+
+	if *roomTTL > 0 {
+		go func() {
+			for range time.NewTicker(*roomTTL / 2).C {
+				for _, room := range w.ReapRooms(rooms, *roomTTL) {
+					if _, err := recordings.Stop(room.ID); err != nil && err != recorder.ErrNotRecording {
+						log.Println(err)
+					}
+					egress.Stop(room.StreamID)
+				}
+			}
+		}()
+	}
+
 	// check certificates
 	if *cert != "" {
 		return app.ListenTLS(*addr, *cert, *key)
@@ -69,3 +201,83 @@ func Run() error {
 	return app.Listen(*addr)
 
 }
+
+func loadConfig() (*config.Config, error) {
+	c := &config.Config{}
+	if *configFile != "" {
+		var err error
+		if c, err = config.Load(*configFile); err != nil {
+			return nil, err
+		}
+	}
+
+	c.Override(*iceServers, *iceUsername, *iceCredential, *iceTransportPolicy, *nat1To1IPs)
+	c.OverrideTURN(*turnURLs, *turnSecret, *turnCredentialTTL)
+	c.OverrideAuth(*authSecret, *authPublicKey)
+	return c, nil
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// NewApp builds the Fiber application serving the rooms kept in rooms.
+func NewApp(rooms w.RoomStore, settings *w.Settings, verifier *auth.Verifier, recordings *recorder.Manager, ingest *rtmp.Server, egress *hls.Manager, metrics *Metrics, adminToken string) *fiber.App {
+	h := handlers.New(rooms, settings, verifier, recordings, ingest, egress, adminToken)
+	engine := html.New("./views", ".html")
+
+	app := fiber.New(fiber.Config{Views: engine})
+	app.Use(logger.New())
+	app.Use(cors.New())
+
+	app.Get("/", h.Welcome)
+	app.Get("/ice-servers", h.Authorize(handlers.AnyClaims), h.ICEServers)
+	app.Get("/room/create", h.CreateRoom)
+	app.Get("/room/:uuid", h.Authorize(handlers.CanJoin), h.Room)
+	app.Get("/room/:uuid/ws", h.Authorize(handlers.CanJoin), websocket.New(h.RoomWS, websocket.Config{
+		HandshakeTimeout: 10 * time.Second,
+	}))
+	app.Get("/room/:uuid/chat", h.ChatRoom)
+	app.Get("/room/:uuid/chat/ws", h.Authorize(handlers.CanChat), websocket.New(h.ChatRoomWS))
+	app.Get("/room/:uuid/chat/transcript", h.Authorize(handlers.HostOnly), h.ChatTranscript)
+	app.Get("/room/:uuid/viewer/ws", h.Authorize(handlers.AnyClaims), websocket.New(h.ViewRoomWS))
+	app.Get("/room/:uuid/rtmp", h.Authorize(handlers.HostOnly), h.RTMPPublish)
+	app.Get("/room/:uuid/recording", h.Authorize(handlers.HostOnly), h.Recording)
+	app.Post("/room/:uuid/recording", h.Authorize(handlers.HostOnly), h.StartRecording)
+	app.Delete("/room/:uuid/recording", h.Authorize(handlers.HostOnly), h.StopRecording)
+	app.Get("/stream/:suuid", h.Authorize(handlers.CanSubscribe), h.Stream)
+	app.Get("/stream/:suuid/ws", h.Authorize(handlers.CanSubscribe), websocket.New(h.StreamWS, websocket.Config{
+		HandshakeTimeout: 10 * time.Second,
+	}))
+	app.Get("/stream/:suuid/chat/ws", h.Authorize(handlers.CanChat), websocket.New(h.ChatStreamWS))
+	app.Get("/stream/:suuid/viewer/ws", h.Authorize(handlers.AnyClaims), websocket.New(h.StreamViewerWS))
+	app.Get("/stream/:suuid/hls/:file", h.Authorize(handlers.CanSubscribe), h.StreamHLS)
+	app.Post("/whip/:suuid", h.Authorize(handlers.CanPublish), h.WHIP)
+	app.Patch("/whip/:suuid/:id", h.PatchSession)
+	app.Delete("/whip/:suuid/:id", h.DeleteSession)
+	app.Post("/whep/:suuid", h.Authorize(handlers.CanSubscribe), h.WHEP)
+	app.Patch("/whep/:suuid/:id", h.PatchSession)
+	app.Delete("/whep/:suuid/:id", h.DeleteSession)
+
+	// The metrics carry the room IDs, which let anyone in when rooms require
+	// no token: like the admin API, they do not exist without the admin token.
+	app.Get("/metrics", h.AdminOnly, metrics.Handler)
+
+	api := app.Group("/api/v1", h.AdminOnly)
+	api.Get("/rooms", h.ListRooms)
+	api.Post("/rooms", h.PostRoom)
+	api.Get("/rooms/:uuid", h.GetRoom)
+	api.Delete("/rooms/:uuid", h.EndRoom)
+	api.Get("/rooms/:uuid/participants", h.ListParticipants)
+	api.Delete("/rooms/:uuid/participants/:id", h.KickParticipant)
+	api.Post("/rooms/:uuid/tracks/:track/mute", h.MuteTrack)
+	api.Post("/rooms/:uuid/tracks/:track/unmute", h.UnmuteTrack)
+	api.Get("/streams", h.ListStreams)
+
+	app.Static("/", "./assets")
+
+	return app
+}
@@ -0,0 +1,212 @@
+// Package auth implements the join tokens that let a client into a room.
+//
+// A join token is a JWT signed with HS256 or EdDSA (Ed25519) whose claims
+// name the room, the identity of the client, its role in the room and what
+// it may do there. Tokens are issued by the application embedding the rooms;
+// the server only holds the keys to verify them.
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMalformed   = errors.New("auth: malformed token")
+	ErrSignature   = errors.New("auth: invalid token signature")
+	ErrAlgorithm   = errors.New("auth: unsupported token algorithm")
+	ErrExpired     = errors.New("auth: token expired")
+	ErrNotYetValid = errors.New("auth: token not valid yet")
+	ErrClaims      = errors.New("auth: invalid token claims")
+)
+
+const (
+	AlgHS256 = "HS256"
+	AlgEdDSA = "EdDSA"
+)
+
+// leeway is the clock skew tolerated between the issuer and the server.
+const leeway = 30 * time.Second
+
+type Role string
+
+const (
+	// RoleHost may create the room, and do everything in it.
+	RoleHost Role = "host"
+	// RoleParticipant publishes and subscribes in an existing room.
+	RoleParticipant Role = "participant"
+	// RoleViewer only watches the stream of a room.
+	RoleViewer Role = "viewer"
+)
+
+type Permissions struct {
+	Publish   bool `json:"publish"`
+	Subscribe bool `json:"subscribe"`
+	Chat      bool `json:"chat"`
+}
+
+// Permissions returns the permissions a role has unless a token says otherwise.
+func (r Role) Permissions() Permissions {
+	switch r {
+	case RoleHost, RoleParticipant:
+		return Permissions{Publish: true, Subscribe: true, Chat: true}
+	case RoleViewer:
+		return Permissions{Subscribe: true, Chat: true}
+	}
+	return Permissions{}
+}
+
+func (r Role) valid() bool {
+	return r == RoleHost || r == RoleParticipant || r == RoleViewer
+}
+
+// Claims are the claims of a join token.
+type Claims struct {
+	// Room is the ID of the room the token lets into.
+	Room string `json:"room"`
+	// Subject identifies the client.
+	Subject string `json:"sub"`
+	// Name is the display name of the client.
+	Name string `json:"name,omitempty"`
+	Role Role   `json:"role"`
+	// Permissions override the permissions of Role.
+	Permissions *Permissions `json:"permissions,omitempty"`
+
+	ExpiresAt int64 `json:"exp"`
+	NotBefore int64 `json:"nbf,omitempty"`
+	IssuedAt  int64 `json:"iat,omitempty"`
+}
+
+// Allowed returns what the holder of the token may do in the room.
+func (c *Claims) Allowed() Permissions {
+	if c.Permissions != nil {
+		return *c.Permissions
+	}
+	return c.Role.Permissions()
+}
+
+func (c *Claims) validate(now time.Time) error {
+	if c.Room == "" || c.Subject == "" || !c.Role.valid() || c.ExpiresAt == 0 {
+		return ErrClaims
+	}
+	if now.Add(-leeway).Unix() > c.ExpiresAt {
+		return ErrExpired
+	}
+	if c.NotBefore != 0 && now.Add(leeway).Unix() < c.NotBefore {
+		return ErrNotYetValid
+	}
+	return nil
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+}
+
+// Verifier checks join tokens. Tokens are accepted with any algorithm it has
+// a key for.
+type Verifier struct {
+	// Secret is the HS256 key.
+	Secret []byte
+	// PublicKey is the EdDSA key.
+	PublicKey ed25519.PublicKey
+}
+
+// Enabled reports whether v has any key, i.e. whether rooms require a token.
+func (v *Verifier) Enabled() bool {
+	return v != nil && (len(v.Secret) > 0 || len(v.PublicKey) > 0)
+}
+
+// Verify checks the signature and the validity period of token and returns its claims.
+func (v *Verifier) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+
+	h := &header{}
+	if err := decodePart(parts[0], h); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	switch {
+	case h.Alg == AlgHS256 && len(v.Secret) > 0:
+		if !hmac.Equal(signature, hs256(v.Secret, signed)) {
+			return nil, ErrSignature
+		}
+	case h.Alg == AlgEdDSA && len(v.PublicKey) == ed25519.PublicKeySize:
+		if !ed25519.Verify(v.PublicKey, signed, signature) {
+			return nil, ErrSignature
+		}
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrAlgorithm, h.Alg)
+	}
+
+	c := &Claims{}
+	if err := decodePart(parts[1], c); err != nil {
+		return nil, err
+	}
+	if err := c.validate(time.Now()); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// SignHS256 returns the token carrying c signed with secret.
+func SignHS256(c *Claims, secret []byte) (string, error) {
+	signed, err := encode(AlgHS256, c)
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(hs256(secret, []byte(signed))), nil
+}
+
+// SignEdDSA returns the token carrying c signed with key.
+func SignEdDSA(c *Claims, key ed25519.PrivateKey) (string, error) {
+	signed, err := encode(AlgEdDSA, c)
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(key, []byte(signed))), nil
+}
+
+func encode(alg string, c *Claims) (string, error) {
+	h, err := json.Marshal(&header{Alg: alg, Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(payload), nil
+}
+
+func decodePart(part string, v interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return ErrMalformed
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return ErrMalformed
+	}
+	return nil
+}
+
+func hs256(secret, data []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
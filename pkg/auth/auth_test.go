@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// token builds a token from raw JSON parts, signed by sign.
+func token(header, claims string, sign func(signed []byte) []byte) string {
+	signed := base64.RawURLEncoding.EncodeToString([]byte(header)) + "." + base64.RawURLEncoding.EncodeToString([]byte(claims))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+func TestVerify(t *testing.T) {
+	secret := []byte("s3cret")
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	valid := &Claims{Room: "room", Subject: "alice", Name: "Alice", Role: RoleHost, ExpiresAt: now + 60}
+	at := func(exp, nbf int64) *Claims {
+		c := *valid
+		c.ExpiresAt, c.NotBefore = exp, nbf
+		return &c
+	}
+	hs := func(c *Claims, secret []byte) string {
+		s, err := SignHS256(c, secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	ed := func(c *Claims, key ed25519.PrivateKey) string {
+		s, err := SignEdDSA(c, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	hsSign := func(signed []byte) []byte { return hs256(secret, signed) }
+	validHS := hs(valid, secret)
+
+	hsVerifier := &Verifier{Secret: secret}
+	edVerifier := &Verifier{PublicKey: public}
+	bothVerifier := &Verifier{Secret: secret, PublicKey: public}
+
+	tests := []struct {
+		name     string
+		verifier *Verifier
+		token    string
+		want     *Claims
+		wantErr  error
+	}{
+		{name: "HS256", verifier: hsVerifier, token: validHS, want: valid},
+		{name: "EdDSA", verifier: edVerifier, token: ed(valid, private), want: valid},
+		{name: "HS256 with both keys", verifier: bothVerifier, token: validHS, want: valid},
+		{name: "EdDSA with both keys", verifier: bothVerifier, token: ed(valid, private), want: valid},
+		{
+			name:     "permissions",
+			verifier: hsVerifier,
+			token:    token(`{"alg":"HS256"}`, `{"room":"room","sub":"bob","role":"viewer","permissions":{"chat":true},"exp":`+itoa(now+60)+`}`, hsSign),
+			want:     &Claims{Room: "room", Subject: "bob", Role: RoleViewer, Permissions: &Permissions{Chat: true}, ExpiresAt: now + 60},
+		},
+
+		{name: "expired", verifier: hsVerifier, token: hs(at(now-120, 0), secret), wantErr: ErrExpired},
+		{name: "expired within the leeway", verifier: hsVerifier, token: hs(at(now-10, 0), secret), want: at(now-10, 0)},
+		{name: "not valid yet", verifier: hsVerifier, token: hs(at(now+600, now+120), secret), wantErr: ErrNotYetValid},
+		{name: "not valid yet within the leeway", verifier: hsVerifier, token: hs(at(now+600, now+10), secret), want: at(now+600, now+10)},
+		{name: "expired EdDSA", verifier: edVerifier, token: ed(at(now-120, 0), private), wantErr: ErrExpired},
+
+		{
+			name:     "alg none",
+			verifier: bothVerifier,
+			token:    token(`{"alg":"none"}`, `{"room":"room","sub":"eve","role":"host","exp":`+itoa(now+60)+`}`, func([]byte) []byte { return nil }),
+			wantErr:  ErrAlgorithm,
+		},
+		{
+			name:     "alg case",
+			verifier: hsVerifier,
+			token:    token(`{"alg":"hs256"}`, `{"room":"room","sub":"eve","role":"host","exp":`+itoa(now+60)+`}`, hsSign),
+			wantErr:  ErrAlgorithm,
+		},
+		{
+			// The public key is no HMAC secret.
+			name:     "HS256 signed with the public key",
+			verifier: edVerifier,
+			token:    hs(valid, public),
+			wantErr:  ErrAlgorithm,
+		},
+		{name: "HS256 without a secret", verifier: edVerifier, token: validHS, wantErr: ErrAlgorithm},
+		{name: "EdDSA without a public key", verifier: hsVerifier, token: ed(valid, private), wantErr: ErrAlgorithm},
+		{name: "no key", verifier: &Verifier{}, token: validHS, wantErr: ErrAlgorithm},
+		{name: "short public key", verifier: &Verifier{PublicKey: public[:16]}, token: ed(valid, private), wantErr: ErrAlgorithm},
+
+		{name: "wrong secret", verifier: &Verifier{Secret: []byte("other")}, token: validHS, wantErr: ErrSignature},
+		{name: "wrong key", verifier: edVerifier, token: ed(valid, otherPrivate), wantErr: ErrSignature},
+		{
+			name:     "tampered claims",
+			verifier: hsVerifier,
+			token:    replacePart(validHS, 1, `{"room":"room","sub":"eve","role":"host","exp":`+itoa(now+60)+`}`),
+			wantErr:  ErrSignature,
+		},
+		{name: "truncated signature", verifier: hsVerifier, token: validHS[:len(validHS)-4], wantErr: ErrSignature},
+		{name: "empty signature", verifier: hsVerifier, token: validHS[:strings.LastIndex(validHS, ".")+1], wantErr: ErrSignature},
+
+		{name: "empty", verifier: hsVerifier, token: "", wantErr: ErrMalformed},
+		{name: "two segments", verifier: hsVerifier, token: validHS[:strings.LastIndex(validHS, ".")], wantErr: ErrMalformed},
+		{name: "four segments", verifier: hsVerifier, token: validHS + ".x", wantErr: ErrMalformed},
+		{name: "header not base64", verifier: hsVerifier, token: "*" + validHS, wantErr: ErrMalformed},
+		{name: "header not JSON", verifier: hsVerifier, token: token(`HS256`, `{}`, hsSign), wantErr: ErrMalformed},
+		{name: "padded signature", verifier: hsVerifier, token: validHS + "=", wantErr: ErrMalformed},
+		{name: "claims not JSON", verifier: hsVerifier, token: token(`{"alg":"HS256"}`, `{"room":`, hsSign), wantErr: ErrMalformed},
+		{name: "claims of the wrong type", verifier: hsVerifier, token: token(`{"alg":"HS256"}`, `{"exp":"tomorrow"}`, hsSign), wantErr: ErrMalformed},
+
+		{name: "no room", verifier: hsVerifier, token: token(`{"alg":"HS256"}`, `{"sub":"a","role":"host","exp":`+itoa(now+60)+`}`, hsSign), wantErr: ErrClaims},
+		{name: "no subject", verifier: hsVerifier, token: token(`{"alg":"HS256"}`, `{"room":"r","role":"host","exp":`+itoa(now+60)+`}`, hsSign), wantErr: ErrClaims},
+		{name: "unknown role", verifier: hsVerifier, token: token(`{"alg":"HS256"}`, `{"room":"r","sub":"a","role":"admin","exp":`+itoa(now+60)+`}`, hsSign), wantErr: ErrClaims},
+		{name: "no expiry", verifier: hsVerifier, token: token(`{"alg":"HS256"}`, `{"room":"r","sub":"a","role":"host"}`, hsSign), wantErr: ErrClaims},
+	}
+
+	for _, tt := range tests {
+		got, err := tt.verifier.Verify(tt.token)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: Verify error %v, want %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Verify = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func itoa(n int64) string {
+	return strconv.FormatInt(n, 10)
+}
+
+// replacePart replaces segment i of token by the encoding of raw.
+func replacePart(token string, i int, raw string) string {
+	parts := strings.Split(token, ".")
+	parts[i] = base64.RawURLEncoding.EncodeToString([]byte(raw))
+	return strings.Join(parts, ".")
+}
+
+func TestVerifierEnabled(t *testing.T) {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		verifier *Verifier
+		want     bool
+	}{
+		{verifier: nil, want: false},
+		{verifier: &Verifier{}, want: false},
+		{verifier: &Verifier{Secret: []byte("s")}, want: true},
+		{verifier: &Verifier{PublicKey: public}, want: true},
+	}
+	for _, tt := range tests {
+		if got := tt.verifier.Enabled(); got != tt.want {
+			t.Errorf("%+v: Enabled() = %t, want %t", tt.verifier, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"strings"
+)
+
+var ErrKey = errors.New("auth: not an Ed25519 key")
+
+// ParsePublicKey parses an Ed25519 public key, either PEM encoded
+// ("PUBLIC KEY", as written by openssl) or the base64 of the raw 32 bytes.
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	if block, _ := pem.Decode([]byte(s)); block != nil {
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if key, ok := key.(ed25519.PublicKey); ok {
+			return key, nil
+		}
+		return nil, ErrKey
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(raw) != ed25519.PublicKeySize {
+		return nil, ErrKey
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// ParsePrivateKey parses an Ed25519 private key, either PEM encoded
+// ("PRIVATE KEY", PKCS #8) or the base64 of the raw 32 byte seed.
+func ParsePrivateKey(s string) (ed25519.PrivateKey, error) {
+	if block, _ := pem.Decode([]byte(s)); block != nil {
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if key, ok := key.(ed25519.PrivateKey); ok {
+			return key, nil
+		}
+		return nil, ErrKey
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(raw) != ed25519.SeedSize {
+		return nil, ErrKey
+	}
+	return ed25519.NewKeyFromSeed(raw), nil
+}
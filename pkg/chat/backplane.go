@@ -0,0 +1,86 @@
+package chat
+
+import (
+	"log"
+	"sync"
+)
+
+// Backplane carries the messages of the chat of a room between the hubs of
+// that room on every node, so that clients connected to different nodes
+// chat together.
+type Backplane interface {
+	// Publish sends payload to the hubs of room subscribed on every node,
+	// this one included. It must not block on the network.
+	Publish(room string, payload []byte) error
+	// Subscribe calls handle with every payload published for room, in
+	// order, until unsubscribe is called.
+	Subscribe(room string, handle func(payload []byte)) (unsubscribe func(), err error)
+}
+
+// envelope is a message on the backplane, node being the hub it comes from.
+type envelope struct {
+	Node    string   `json:"node"`
+	Message *Message `json:"message"`
+}
+
+// MemoryBackplane is a Backplane between the hubs of a single process,
+// which stand for the nodes of a cluster in tests.
+type MemoryBackplane struct {
+	lock        sync.RWMutex
+	subscribers map[string]map[*subscriber]bool
+}
+
+// subscriber queues the payloads of a subscription, so that a hub never
+// waits on another one to publish.
+type subscriber struct {
+	payloads chan []byte
+	once     sync.Once
+}
+
+func NewMemoryBackplane() *MemoryBackplane {
+	return &MemoryBackplane{subscribers: make(map[string]map[*subscriber]bool)}
+}
+
+func (b *MemoryBackplane) Publish(room string, payload []byte) error {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	for s := range b.subscribers[room] {
+		select {
+		case s.payloads <- payload:
+		default:
+			log.Printf("chat backplane: dropping a message of room %s for a slow subscriber", room)
+		}
+	}
+	return nil
+}
+
+func (b *MemoryBackplane) Subscribe(room string, handle func(payload []byte)) (func(), error) {
+	s := &subscriber{payloads: make(chan []byte, 256)}
+	go func() {
+		for payload := range s.payloads {
+			handle(payload)
+		}
+	}()
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.subscribers[room] == nil {
+		b.subscribers[room] = make(map[*subscriber]bool)
+	}
+	b.subscribers[room][s] = true
+
+	return func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+
+		s.once.Do(func() {
+			delete(b.subscribers[room], s)
+			if len(b.subscribers[room]) == 0 {
+				delete(b.subscribers, room)
+			}
+			close(s.payloads)
+		})
+	}, nil
+}
@@ -1,7 +1,6 @@
 package chat
 
 import (
-	"bytes"
 	"log"
 	"time"
 
@@ -15,10 +14,8 @@ const (
 	maxMessageSize = 512
 )
 
-var (
-	newline = []byte(`\n`)
-	space   = []byte(` `)
-)
+// newline separates the messages written in a single frame.
+var newline = []byte{'\n'}
 
 var upgrader = websocket.FastHTTPUpgrader{
 	ReadBufferSize:  1024,
@@ -29,11 +26,36 @@ type Client struct {
 	Hub  *Hub
 	Conn *websocket.Conn
 	Send chan []byte
+	Identity
+}
+
+// Identity identifies a client in the messages it sends, and tells which
+// messages it receives.
+type Identity struct {
+	// ID is shared by the sockets of the same user.
+	ID   string
+	Name string
+	// Groups are the groups the client gets the messages of, e.g. hosts.
+	Groups []string
+	// Moderator may mute and kick the other clients.
+	Moderator bool
+}
+
+func (i *Identity) inGroup(group string) bool {
+	for _, g := range i.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
 }
 
 func (c *Client) readPump() {
 	defer func() {
-		c.Hub.unregister <- c
+		select {
+		case c.Hub.unregister <- c:
+		case <-c.Hub.done:
+		}
 		c.Conn.Close()
 	}()
 
@@ -52,8 +74,15 @@ func (c *Client) readPump() {
 			}
 			break
 		}
-		message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
-		c.Hub.broadcast <- message
+		m, err := parseMessage(message)
+		if err != nil {
+			continue
+		}
+		select {
+		case c.Hub.broadcast <- &incoming{from: c, message: m}:
+		case <-c.Hub.done:
+			return
+		}
 	}
 }
 
@@ -98,13 +127,21 @@ func (c *Client) writePump() {
 	}
 }
 
-func PeerChatConn(c *websocket.Conn, hub *Hub) {
+// PeerChatConn serves the chat of hub on c to the client with the given
+// identity, until the connection is closed.
+func PeerChatConn(c *websocket.Conn, hub *Hub, identity Identity) {
 	client := &Client{
-		Hub:  hub,
-		Conn: c,
-		Send: make(chan []byte, 256),
+		Hub:      hub,
+		Conn:     c,
+		Send:     make(chan []byte, 256),
+		Identity: identity,
+	}
+	select {
+	case client.Hub.register <- client:
+	case <-client.Hub.done:
+		c.Close()
+		return
 	}
-	client.Hub.register <- client
 
 	go client.writePump()
 	client.readPump()
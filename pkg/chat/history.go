@@ -0,0 +1,193 @@
+package chat
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// replayLength is how many messages of the history a client gets when it joins.
+const replayLength = 50
+
+// HistoryStore keeps the chat messages of every room.
+type HistoryStore interface {
+	// Append adds m to the history of room.
+	Append(room string, m *Message) error
+	// Last returns the last n messages of room, oldest first, or every
+	// message kept if n is 0.
+	Last(room string, n int) ([]*Message, error)
+}
+
+// MemoryHistory keeps the last messages of the rooms that chatted last in
+// process memory.
+type MemoryHistory struct {
+	size, maxRooms int
+
+	lock  sync.Mutex
+	rooms map[string]*ring
+}
+
+// ring holds the last messages of a room, next being the index of the
+// oldest one once it is full.
+type ring struct {
+	messages   []*Message
+	next       int
+	lastAppend time.Time
+}
+
+// NewMemoryHistory keeps up to size messages for each of up to maxRooms
+// rooms. It keeps nothing if either is below 1.
+func NewMemoryHistory(size, maxRooms int) *MemoryHistory {
+	return &MemoryHistory{
+		size:     size,
+		maxRooms: maxRooms,
+		rooms:    make(map[string]*ring),
+	}
+}
+
+func (h *MemoryHistory) Append(room string, m *Message) error {
+	if h.size < 1 || h.maxRooms < 1 {
+		return nil
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	r, ok := h.rooms[room]
+	if !ok {
+		if len(h.rooms) >= h.maxRooms {
+			h.evict()
+		}
+		r = &ring{messages: make([]*Message, 0, h.size)}
+		h.rooms[room] = r
+	}
+
+	r.lastAppend = time.Now()
+	if len(r.messages) < h.size {
+		r.messages = append(r.messages, m)
+		return nil
+	}
+	r.messages[r.next] = m
+	r.next = (r.next + 1) % h.size
+	return nil
+}
+
+func (h *MemoryHistory) Last(room string, n int) ([]*Message, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	r, ok := h.rooms[room]
+	if !ok {
+		return nil, nil
+	}
+
+	ordered := append(append([]*Message{}, r.messages[r.next:]...), r.messages[:r.next]...)
+	if n > 0 && n < len(ordered) {
+		ordered = ordered[len(ordered)-n:]
+	}
+	return ordered, nil
+}
+
+// evict drops the history of the room that chatted the least recently.
+func (h *MemoryHistory) evict() {
+	var (
+		oldest string
+		at     time.Time
+	)
+	for room, r := range h.rooms {
+		if at.IsZero() || r.lastAppend.Before(at) {
+			oldest, at = room, r.lastAppend
+		}
+	}
+	delete(h.rooms, oldest)
+}
+
+// BoltHistory keeps every message in a bbolt database file, in one bucket
+// per room, so that the history outlives the rooms and the server.
+type BoltHistory struct {
+	db *bolt.DB
+}
+
+func OpenBoltHistory(path string) (*BoltHistory, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltHistory{db: db}, nil
+}
+
+func (h *BoltHistory) Append(room string, m *Message) error {
+	value, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	return h.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(room))
+		if err != nil {
+			return err
+		}
+
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		return b.Put(key, value)
+	})
+}
+
+func (h *BoltHistory) Last(room string, n int) ([]*Message, error) {
+	var messages []*Message
+	err := h.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(room))
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil && (n <= 0 || len(messages) < n); k, v = c.Prev() {
+			m := &Message{}
+			if err := json.Unmarshal(v, m); err != nil {
+				return err
+			}
+			messages = append(messages, m)
+		}
+		return nil
+	})
+
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, err
+}
+
+func (h *BoltHistory) Close() error {
+	return h.db.Close()
+}
+
+// WriteTranscript writes messages as plain text, one line per message.
+func WriteTranscript(w io.Writer, messages []*Message) error {
+	for _, m := range messages {
+		var err error
+		at := m.Time.Format(time.RFC3339)
+		switch m.Type {
+		case TypeSystem:
+			_, err = fmt.Fprintf(w, "%s * %s\n", at, m.Text)
+		case TypeReaction:
+			_, err = fmt.Fprintf(w, "%s %s reacted %s to %s\n", at, m.Name, m.Text, m.Target)
+		default:
+			_, err = fmt.Fprintf(w, "%s %s: %s\n", at, m.Name, m.Text)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
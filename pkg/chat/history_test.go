@@ -0,0 +1,94 @@
+package chat
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func texts(t *testing.T, h HistoryStore, room string, n int) []string {
+	t.Helper()
+
+	messages, err := h.Last(room, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var texts []string
+	for _, m := range messages {
+		texts = append(texts, m.Text)
+	}
+	return texts
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMemoryHistoryWraps(t *testing.T) {
+	tests := []struct {
+		appended int
+		n        int
+		want     []string
+	}{
+		{appended: 0, n: 0, want: nil},
+		{appended: 2, n: 0, want: []string{"0", "1"}},
+		{appended: 3, n: 0, want: []string{"0", "1", "2"}},
+		{appended: 4, n: 0, want: []string{"1", "2", "3"}},
+		{appended: 7, n: 0, want: []string{"4", "5", "6"}},
+		{appended: 7, n: 2, want: []string{"5", "6"}},
+		{appended: 7, n: 5, want: []string{"4", "5", "6"}},
+	}
+
+	for _, tt := range tests {
+		h := NewMemoryHistory(3, 10)
+		for i := 0; i < tt.appended; i++ {
+			if err := h.Append("room", &Message{Text: strconv.Itoa(i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if got := texts(t, h, "room", tt.n); !equal(got, tt.want) {
+			t.Errorf("%d appended, Last(%d) = %v, want %v", tt.appended, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestMemoryHistoryEvictsLeastRecentRoom(t *testing.T) {
+	h := NewMemoryHistory(3, 2)
+	h.Append("a", &Message{Text: "a"})
+	h.Append("b", &Message{Text: "b"})
+	// a chatted last, so b goes when c comes.
+	h.rooms["b"].lastAppend = time.Now().Add(-time.Minute)
+	h.Append("a", &Message{Text: "a2"})
+	h.Append("c", &Message{Text: "c"})
+
+	if got := texts(t, h, "b", 0); got != nil {
+		t.Errorf("evicted room b still has %v", got)
+	}
+	if got, want := texts(t, h, "a", 0), []string{"a", "a2"}; !equal(got, want) {
+		t.Errorf("room a has %v, want %v", got, want)
+	}
+	if got, want := texts(t, h, "c", 0), []string{"c"}; !equal(got, want) {
+		t.Errorf("room c has %v, want %v", got, want)
+	}
+}
+
+func TestMemoryHistoryWithoutSize(t *testing.T) {
+	for _, size := range []int{0, -1} {
+		h := NewMemoryHistory(size, 10)
+		if err := h.Append("room", &Message{Text: "hi"}); err != nil {
+			t.Fatal(err)
+		}
+		if got := texts(t, h, "room", 0); got != nil {
+			t.Errorf("size %d keeps %v", size, got)
+		}
+	}
+}
@@ -1,40 +1,345 @@
 package chat
 
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	guuid "github.com/google/uuid"
+)
+
+// Options are the options of the hubs.
+type Options struct {
+	// History keeps the messages to everyone, unless it is nil.
+	History    HistoryStore
+	Moderation Moderation
+	// Backplane, if not nil, connects the hubs of the same room on every node.
+	Backplane Backplane
+}
+
 type Hub struct {
-	clients    map[*Client]bool
-	broadcast  chan []byte
+	// room is the ID of the room the chat belongs to in history.
+	room       string
+	history    HistoryStore
+	moderation Moderation
+	backplane  Backplane
+	// node tells the messages of the hub from those of the other nodes on
+	// the backplane.
+	node string
+
+	clients map[*Client]bool
+	// muted and banned are the IDs of the clients muted and kicked by a host.
+	muted  map[string]bool
+	banned map[string]bool
+	// buckets rate limit the clients by ID, so that the sockets of a client
+	// share one and a new socket does not get a full one.
+	buckets    map[string]*clientBuckets
+	broadcast  chan *incoming
 	register   chan *Client
 	unregister chan *Client
+
+	done     chan struct{}
+	stopOnce sync.Once
+	size     atomic.Int32
+
+	broadcasts atomic.Uint64
+	dropped    atomic.Uint64
 }
 
-func NewHub() *Hub {
+// NewHub creates the hub of the chat of room.
+func NewHub(room string, opts Options) *Hub {
 	return &Hub{
-		broadcast:  make(chan []byte),
+		room:       room,
+		history:    opts.History,
+		moderation: opts.Moderation,
+		backplane:  opts.Backplane,
+		node:       guuid.New().String(),
+		broadcast:  make(chan *incoming),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
 		clients:    make(map[*Client]bool),
+		muted:      make(map[string]bool),
+		banned:     make(map[string]bool),
+		buckets:    make(map[string]*clientBuckets),
+		done:       make(chan struct{}),
+	}
+}
+
+// Clients returns the number of clients currently registered in the hub.
+func (h *Hub) Clients() int {
+	return int(h.size.Load())
+}
+
+// Broadcasts returns the number of messages broadcast by the hub.
+func (h *Hub) Broadcasts() uint64 {
+	return h.broadcasts.Load()
+}
+
+// Dropped returns the number of messages dropped for clients too slow to
+// take them, which are disconnected.
+func (h *Hub) Dropped() uint64 {
+	return h.dropped.Load()
+}
+
+// History returns the last n messages of the chat, or all the messages kept
+// if n is 0.
+func (h *Hub) History(n int) ([]*Message, error) {
+	if h.history == nil {
+		return nil, nil
+	}
+	return h.history.Last(h.room, n)
+}
+
+// incoming is a message on its way to the hub, from a client or, if from
+// is nil, from the server or, if remote, from the hub of another node.
+type incoming struct {
+	from    *Client
+	message *Message
+	remote  bool
+}
+
+// System broadcasts a system message with the given text.
+func (h *Hub) System(text string) {
+	select {
+	case h.broadcast <- &incoming{message: &Message{Type: TypeSystem, Text: text}}:
+	case <-h.done:
+	}
+}
+
+// stamp sets the fields of m only the hub may set: its ID, time and sender.
+func stamp(m *Message, from *Client) {
+	m.ID = guuid.New().String()
+	m.Time = time.Now().UTC()
+	m.From, m.Name = "", ""
+	if from != nil {
+		m.From, m.Name = from.ID, from.Name
 	}
 }
 
+// Stop makes Run return and disconnects every registered client.
+// It is safe to call Stop more than once.
+func (h *Hub) Stop() {
+	h.stopOnce.Do(func() {
+		close(h.done)
+	})
+}
+
 func (h *Hub) Run() {
+	if h.backplane != nil {
+		unsubscribe, err := h.backplane.Subscribe(h.room, h.receive)
+		if err != nil {
+			log.Println(err)
+		} else {
+			defer unsubscribe()
+		}
+	}
+
 	for {
 		select {
 		case client := <-h.register:
+			if h.banned[client.ID] && !client.Moderator {
+				client.Send <- h.system("you were kicked from the chat")
+				close(client.Send)
+				continue
+			}
 			h.clients[client] = true
+			h.size.Store(int32(len(h.clients)))
+			h.replay(client)
 		case client := <-h.unregister:
 			if _, ok := h.clients[client]; ok {
 				delete(h.clients, client)
 				close(client.Send)
+				h.pruneBuckets(time.Now())
 			}
-		case message := <-h.broadcast:
+			h.size.Store(int32(len(h.clients)))
+		case in := <-h.broadcast:
+			h.route(in)
+			h.size.Store(int32(len(h.clients)))
+		case <-h.done:
 			for client := range h.clients {
-				select {
-				case client.Send <- message:
-				default:
-					close(client.Send)
-					delete(h.clients, client)
-				}
+				close(client.Send)
+				delete(h.clients, client)
 			}
+			h.size.Store(0)
+			return
+		}
+	}
+}
+
+// route stamps the message in and delivers it to its recipients: the
+// client it is addressed to, the members of the group it is addressed to,
+// or everyone. Only the messages to everyone are kept in the history.
+// The messages of this node are published on the backplane, for the
+// recipients connected to the other nodes.
+func (h *Hub) route(in *incoming) {
+	m := in.message
+	if in.remote {
+		// The hub of the other node stamped and moderated m already.
+		if m.Type == TypeMute || m.Type == TypeUnmute || m.Type == TypeKick {
+			h.apply(m)
+			return
+		}
+	} else {
+		if in.from != nil {
+			// The client may have been kicked or dropped since it sent m.
+			if _, ok := h.clients[in.from]; !ok || !h.moderate(in.from, m) {
+				return
+			}
+		}
+		stamp(m, in.from)
+	}
+
+	var recipients []*Client
+	for client := range h.clients {
+		if canSee(client, m) {
+			recipients = append(recipients, client)
+		}
+	}
+
+	// Without a backplane, every client the message may be for is here.
+	if h.backplane == nil && m.To != "" && !containsOther(recipients, in.from) {
+		if m.Type != TypeTyping {
+			h.sendSystem(in.from, "nobody with the ID "+m.To+" is in the chat")
+		}
+		return
+	}
+
+	message, err := json.Marshal(m)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if h.history != nil && m.Type != TypeTyping && m.To == "" && m.Group == "" {
+		if err := h.history.Append(h.room, m); err != nil {
+			log.Println(err)
+		}
+	}
+
+	h.broadcasts.Add(1)
+	for _, client := range recipients {
+		// Nobody needs to be told they are typing.
+		if client.ID == m.From && m.Type == TypeTyping {
+			continue
+		}
+		h.deliver(client, message)
+	}
+
+	if !in.remote {
+		h.publish(m)
+	}
+}
+
+// publish sends m to the hubs of the room on the other nodes.
+func (h *Hub) publish(m *Message) {
+	if h.backplane == nil {
+		return
+	}
+
+	payload, err := json.Marshal(envelope{Node: h.node, Message: m})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if err := h.backplane.Publish(h.room, payload); err != nil {
+		log.Println(err)
+	}
+}
+
+// receive takes a message from the backplane to the hub, unless the hub
+// published it.
+func (h *Hub) receive(payload []byte) {
+	e := &envelope{}
+	if err := json.Unmarshal(payload, e); err != nil {
+		log.Println(err)
+		return
+	}
+	if e.Node == h.node || e.Message == nil {
+		return
+	}
+
+	select {
+	case h.broadcast <- &incoming{message: e.Message, remote: true}:
+	case <-h.done:
+	}
+}
+
+// canSee reports whether client may receive m. The sender of a message
+// always gets it back, on every socket it has open.
+func canSee(client *Client, m *Message) bool {
+	switch {
+	case m.From != "" && client.ID == m.From:
+		return true
+	case m.To != "":
+		return client.ID == m.To
+	case m.Group != "":
+		return client.inGroup(m.Group)
+	}
+	return true
+}
+
+// containsOther reports whether clients has a client other than the sockets of from.
+func containsOther(clients []*Client, from *Client) bool {
+	for _, c := range clients {
+		if from == nil || c.ID != from.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// sendSystem sends a system message to client only.
+func (h *Hub) sendSystem(client *Client, text string) {
+	if client == nil {
+		return
+	}
+	if _, ok := h.clients[client]; ok {
+		h.deliver(client, h.system(text))
+	}
+}
+
+// system returns a system message with the given text, encoded.
+func (h *Hub) system(text string) []byte {
+	m := &Message{Type: TypeSystem, Text: text}
+	stamp(m, nil)
+	raw, err := json.Marshal(m)
+	if err != nil {
+		log.Println(err)
+	}
+	return raw
+}
+
+// deliver queues message for client, disconnecting the client if it is too
+// slow to take it.
+func (h *Hub) deliver(client *Client, message []byte) {
+	select {
+	case client.Send <- message:
+	default:
+		h.dropped.Add(1)
+		close(client.Send)
+		delete(h.clients, client)
+	}
+}
+
+// replay sends a client that just registered the last messages of the chat.
+func (h *Hub) replay(client *Client) {
+	messages, err := h.History(replayLength)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for _, m := range messages {
+		raw, err := json.Marshal(m)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		select {
+		case client.Send <- raw:
+		default:
+			return
 		}
 	}
 }
@@ -0,0 +1,236 @@
+package chat
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// startHub runs the hub of room on backplane until the test ends.
+func startHub(t *testing.T, room string, backplane Backplane) *Hub {
+	t.Helper()
+
+	h := NewHub(room, Options{Backplane: backplane})
+	go h.Run()
+	t.Cleanup(h.Stop)
+	return h
+}
+
+// join registers a client without a connection, whose messages are read
+// from its Send channel.
+func join(h *Hub, identity Identity) *Client {
+	c := &Client{Hub: h, Send: make(chan []byte, 256), Identity: identity}
+	h.register <- c
+	return c
+}
+
+func send(c *Client, m *Message) {
+	c.Hub.broadcast <- &incoming{from: c, message: m}
+}
+
+// receive returns the next message c gets, nil if it is disconnected.
+func receive(t *testing.T, c *Client) *Message {
+	t.Helper()
+
+	select {
+	case raw, ok := <-c.Send:
+		if !ok {
+			return nil
+		}
+		m := &Message{}
+		if err := json.Unmarshal(raw, m); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	case <-time.After(time.Second):
+		t.Fatalf("%s got no message", c.ID)
+		return nil
+	}
+}
+
+func receiveText(t *testing.T, c *Client, want string) {
+	t.Helper()
+
+	m := receive(t, c)
+	if m == nil {
+		t.Fatalf("%s was disconnected, want %q", c.ID, want)
+	}
+	if m.Text != want {
+		t.Fatalf("%s got %q, want %q", c.ID, m.Text, want)
+	}
+}
+
+func receiveNothing(t *testing.T, c *Client) {
+	t.Helper()
+
+	select {
+	case raw := <-c.Send:
+		t.Fatalf("%s got %s", c.ID, raw)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestBackplaneFansOut(t *testing.T) {
+	backplane := NewMemoryBackplane()
+	a := startHub(t, "room", backplane)
+	b := startHub(t, "room", backplane)
+	other := startHub(t, "other", backplane)
+
+	alice := join(a, Identity{ID: "alice", Name: "Alice"})
+	bob := join(b, Identity{ID: "bob", Name: "Bob"})
+	carol := join(b, Identity{ID: "carol", Name: "Carol"})
+	dave := join(other, Identity{ID: "dave", Name: "Dave"})
+
+	send(alice, &Message{Type: TypeText, Text: "hi"})
+	for _, c := range []*Client{alice, bob, carol} {
+		m := receive(t, c)
+		if m == nil || m.Text != "hi" || m.From != "alice" || m.Name != "Alice" {
+			t.Fatalf("%s got %+v", c.ID, m)
+		}
+	}
+	receiveNothing(t, dave)
+
+	send(bob, &Message{Type: TypeText, Text: "hello"})
+	receiveText(t, alice, "hello")
+	receiveText(t, bob, "hello")
+	receiveText(t, carol, "hello")
+}
+
+func TestBackplaneRoutesPrivateMessages(t *testing.T) {
+	backplane := NewMemoryBackplane()
+	a := startHub(t, "room", backplane)
+	b := startHub(t, "room", backplane)
+
+	alice := join(a, Identity{ID: "alice", Groups: []string{"participants"}})
+	bob := join(b, Identity{ID: "bob", Groups: []string{"participants"}})
+	host := join(b, Identity{ID: "host", Groups: []string{"hosts"}})
+
+	send(alice, &Message{Type: TypeText, Text: "psst", To: "bob"})
+	receiveText(t, alice, "psst")
+	receiveText(t, bob, "psst")
+	receiveNothing(t, host)
+
+	send(alice, &Message{Type: TypeText, Text: "hosts only", Group: "hosts"})
+	receiveText(t, alice, "hosts only")
+	receiveText(t, host, "hosts only")
+	receiveNothing(t, bob)
+}
+
+func TestBackplaneAppliesModeration(t *testing.T) {
+	backplane := NewMemoryBackplane()
+	a := startHub(t, "room", backplane)
+	b := startHub(t, "room", backplane)
+
+	host := join(a, Identity{ID: "host", Name: "Host", Moderator: true})
+	alice := join(a, Identity{ID: "alice", Name: "Alice"})
+	eve := join(b, Identity{ID: "eve", Name: "Eve"})
+
+	send(host, &Message{Type: TypeMute, Target: "eve"})
+	receiveText(t, host, "eve was muted by Host")
+	receiveText(t, alice, "eve was muted by Host")
+	receiveText(t, eve, "eve was muted by Host")
+
+	send(eve, &Message{Type: TypeText, Text: "spam"})
+	receiveText(t, eve, "you are muted")
+	receiveNothing(t, alice)
+
+	send(host, &Message{Type: TypeUnmute, Target: "eve"})
+	for _, c := range []*Client{host, alice, eve} {
+		receiveText(t, c, "eve was unmuted by Host")
+	}
+	send(eve, &Message{Type: TypeText, Text: "sorry"})
+	receiveText(t, eve, "sorry")
+	receiveText(t, alice, "sorry")
+	receiveText(t, host, "sorry")
+
+	send(host, &Message{Type: TypeKick, Target: "eve", Text: "bye"})
+	receiveText(t, eve, "you were kicked from the chat")
+	if m := receive(t, eve); m != nil {
+		t.Fatalf("kicked client got %+v", m)
+	}
+	receiveText(t, alice, "eve was kicked by Host: bye")
+
+	again := join(b, Identity{ID: "eve", Name: "Eve"})
+	receiveText(t, again, "you were kicked from the chat")
+	if m := receive(t, again); m != nil {
+		t.Fatalf("kicked client got back in, with %+v", m)
+	}
+}
+
+func TestRateLimitIsByClientID(t *testing.T) {
+	h := NewHub("room", Options{Moderation: Moderation{Rate: 0.01, Burst: 2}})
+	go h.Run()
+	defer h.Stop()
+
+	first := join(h, Identity{ID: "alice"})
+	second := join(h, Identity{ID: "alice"})
+	bob := join(h, Identity{ID: "bob"})
+
+	send(first, &Message{Type: TypeText, Text: "1"})
+	send(second, &Message{Type: TypeText, Text: "2"})
+	for _, text := range []string{"1", "2"} {
+		receiveText(t, first, text)
+		receiveText(t, second, text)
+		receiveText(t, bob, text)
+	}
+
+	// Both sockets of alice took from the same bucket.
+	send(second, &Message{Type: TypeText, Text: "3"})
+	receiveText(t, second, "you are sending messages too fast, slow down")
+	receiveNothing(t, bob)
+
+	// Neither does a new socket get a full one. alice was told to slow
+	// down already.
+	h.unregister <- first
+	h.unregister <- second
+	again := join(h, Identity{ID: "alice"})
+	send(again, &Message{Type: TypeText, Text: "4"})
+	receiveNothing(t, again)
+	receiveNothing(t, bob)
+
+	send(bob, &Message{Type: TypeText, Text: "hi"})
+	receiveText(t, bob, "hi")
+	receiveText(t, again, "hi")
+}
+
+func TestTypingDoesNotBlockText(t *testing.T) {
+	h := NewHub("room", Options{Moderation: Moderation{Rate: 0.01, Burst: 2}})
+	go h.Run()
+	defer h.Stop()
+
+	alice := join(h, Identity{ID: "alice"})
+	bob := join(h, Identity{ID: "bob"})
+
+	// The typing events past the limit are dropped without a notice.
+	for i := 0; i < 5; i++ {
+		send(alice, &Message{Type: TypeTyping})
+	}
+	for i := 0; i < 2; i++ {
+		if m := receive(t, bob); m == nil || m.Type != TypeTyping {
+			t.Fatalf("bob got %v, want a typing event", m)
+		}
+	}
+	receiveNothing(t, bob)
+	receiveNothing(t, alice)
+
+	for _, text := range []string{"1", "2"} {
+		send(alice, &Message{Type: TypeText, Text: text})
+		receiveText(t, alice, text)
+		receiveText(t, bob, text)
+	}
+	send(alice, &Message{Type: TypeText, Text: "3"})
+	receiveText(t, alice, "you are sending messages too fast, slow down")
+	receiveNothing(t, bob)
+}
+
+func TestOnlyModeratorsRunCommands(t *testing.T) {
+	h := startHub(t, "room", nil)
+	guest := join(h, Identity{ID: "guest"})
+	eve := join(h, Identity{ID: "eve"})
+
+	for _, typ := range []Type{TypeMute, TypeKick} {
+		send(guest, &Message{Type: typ, Target: "eve"})
+		receiveText(t, guest, "only hosts can "+string(typ)+" someone")
+		receiveNothing(t, eve)
+	}
+}
@@ -0,0 +1,89 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var ErrInvalidMessage = errors.New("chat: invalid message")
+
+type Type string
+
+const (
+	TypeText Type = "text"
+	// TypeSystem messages come from the server only.
+	TypeSystem Type = "system"
+	// TypeReaction reacts to the message Target with an emoji in Text.
+	TypeReaction Type = "reaction"
+	// TypeTyping tells that the sender is typing. It is not kept.
+	TypeTyping Type = "typing"
+	// TypeMute, TypeUnmute and TypeKick are the commands of the hosts on the
+	// client Target, with an optional reason in Text. They are not routed.
+	TypeMute   Type = "mute"
+	TypeUnmute Type = "unmute"
+	TypeKick   Type = "kick"
+)
+
+// maxReactionLength is the longest reaction, in bytes, enough for an emoji
+// with modifiers.
+const maxReactionLength = 32
+
+// Message is the envelope of every chat message. ID, From, Name and Time
+// are set by the hub, whatever the client sent in them.
+type Message struct {
+	ID   string `json:"id"`
+	Type Type   `json:"type"`
+	// From and Name are the ID and the display name of the sender, empty
+	// for system messages.
+	From string    `json:"from,omitempty"`
+	Name string    `json:"name,omitempty"`
+	Time time.Time `json:"time"`
+	Text string    `json:"text,omitempty"`
+	// Target is the ID of the message a reaction is for, or of the client
+	// a command is for.
+	Target string `json:"target,omitempty"`
+	// To is the ID of the only client the message is for, Group the group
+	// of clients it is for. A message without either is for everyone.
+	To    string `json:"to,omitempty"`
+	Group string `json:"group,omitempty"`
+}
+
+// parseMessage decodes a message sent by a client. A frame that is not a
+// JSON object is taken as the text of a text message, as sent by the
+// clients predating the envelope.
+func parseMessage(raw []byte) (*Message, error) {
+	m := &Message{}
+	if err := json.Unmarshal(raw, m); err != nil {
+		m = &Message{Type: TypeText, Text: string(raw)}
+	}
+
+	m.Text = strings.TrimSpace(m.Text)
+	if !utf8.ValidString(m.Text) || (m.To != "" && m.Group != "") {
+		return nil, ErrInvalidMessage
+	}
+
+	switch m.Type {
+	case TypeText:
+		if m.Text == "" {
+			return nil, ErrInvalidMessage
+		}
+		m.Target = ""
+	case TypeReaction:
+		if m.Target == "" || m.Text == "" || len(m.Text) > maxReactionLength {
+			return nil, ErrInvalidMessage
+		}
+	case TypeTyping:
+		m.Text, m.Target = "", ""
+	case TypeMute, TypeUnmute, TypeKick:
+		if m.Target == "" {
+			return nil, ErrInvalidMessage
+		}
+		m.To, m.Group = "", ""
+	default:
+		return nil, ErrInvalidMessage
+	}
+	return m, nil
+}
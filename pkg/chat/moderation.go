@@ -0,0 +1,320 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Moderation is how a hub keeps its chat in order. The zero value lets
+// everything through.
+type Moderation struct {
+	// Rate is how many messages a client may send per second on average,
+	// and Burst how many in a row. Clients are not limited if Rate is 0.
+	Rate  float64
+	Burst int
+	// Filters check every text message, in order.
+	Filters []Filter
+	// Audit, if not nil, gets every moderation action. It is called from
+	// the goroutines of every hub.
+	Audit func(AuditEvent)
+}
+
+// A Filter rejects a text message with an error telling its sender why, or
+// lets it through, possibly after changing its text.
+type Filter func(m *Message) error
+
+// MaxLength rejects the messages longer than n characters.
+func MaxLength(n int) Filter {
+	return func(m *Message) error {
+		if utf8.RuneCountInString(m.Text) > n {
+			return fmt.Errorf("messages are limited to %d characters", n)
+		}
+		return nil
+	}
+}
+
+var linkPattern = regexp.MustCompile(`(?i)\b(https?://|www\.)\S`)
+
+// BlockLinks rejects the messages with a link.
+func BlockLinks() Filter {
+	return func(m *Message) error {
+		if linkPattern.MatchString(m.Text) {
+			return errors.New("links are not allowed")
+		}
+		return nil
+	}
+}
+
+// WordList masks the given words, whatever their case, with asterisks.
+func WordList(words []string) Filter {
+	quoted := make([]string, 0, len(words))
+	for _, word := range words {
+		if word = strings.TrimSpace(word); word != "" {
+			quoted = append(quoted, regexp.QuoteMeta(word))
+		}
+	}
+	if len(quoted) == 0 {
+		return func(*Message) error { return nil }
+	}
+
+	pattern := regexp.MustCompile(`(?i)\b(` + strings.Join(quoted, "|") + `)\b`)
+	return func(m *Message) error {
+		m.Text = pattern.ReplaceAllStringFunc(m.Text, func(word string) string {
+			return strings.Repeat("*", utf8.RuneCountInString(word))
+		})
+		return nil
+	}
+}
+
+type AuditAction string
+
+const (
+	AuditMute   AuditAction = "mute"
+	AuditUnmute AuditAction = "unmute"
+	AuditKick   AuditAction = "kick"
+	// AuditRateLimit and AuditFilter are taken by the server on its own.
+	AuditRateLimit AuditAction = "rate_limit"
+	AuditFilter    AuditAction = "filter"
+)
+
+// AuditEvent records a moderation action in the chat of a room.
+type AuditEvent struct {
+	Time   time.Time   `json:"time"`
+	Room   string      `json:"room"`
+	Action AuditAction `json:"action"`
+	// Actor is the ID of the client who took the action, empty for the
+	// actions of the server. Target is the ID of the client it was taken on.
+	Actor  string `json:"actor,omitempty"`
+	Target string `json:"target"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// AuditLog returns an Audit function writing the events to w as JSON, one
+// per line.
+func AuditLog(w io.Writer) func(AuditEvent) {
+	var lock sync.Mutex
+	return func(e AuditEvent) {
+		line, err := json.Marshal(e)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		if _, err := w.Write(append(line, '\n')); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// tokenBucket limits the rate of the messages of a client.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	// limited is set once a message is refused, until one is let through.
+	limited bool
+}
+
+// take takes a token from the bucket, which gets rate tokens a second up to
+// burst, and reports whether there was one.
+func (b *tokenBucket) take(rate float64, burst int, now time.Time) bool {
+	if rate <= 0 {
+		return true
+	}
+
+	size := math.Max(float64(burst), 1)
+	if b.last.IsZero() {
+		b.tokens = size
+	} else {
+		b.tokens = math.Min(size, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// full reports whether the bucket has refilled by now, i.e. whether it is
+// as good as a new one.
+func (b *tokenBucket) full(rate float64, burst int, now time.Time) bool {
+	size := math.Max(float64(burst), 1)
+	return rate <= 0 || b.tokens+now.Sub(b.last).Seconds()*rate >= size
+}
+
+// clientBuckets are the buckets of a client. Typing events have their own,
+// so that they never hold back a message.
+type clientBuckets struct {
+	messages, typing tokenBucket
+}
+
+// pruneBuckets forgets the buckets of the clients gone once they refilled.
+func (h *Hub) pruneBuckets(now time.Time) {
+	rate, burst := h.moderation.Rate, h.moderation.Burst
+	for id, buckets := range h.buckets {
+		if buckets.messages.full(rate, burst, now) && buckets.typing.full(rate, burst, now) && h.find(id) == nil {
+			delete(h.buckets, id)
+		}
+	}
+}
+
+// moderate applies the moderation of the hub to a message from a client,
+// and reports whether it may be routed.
+func (h *Hub) moderate(c *Client, m *Message) bool {
+	mod := h.moderation
+
+	buckets := h.buckets[c.ID]
+	if buckets == nil {
+		buckets = &clientBuckets{}
+		h.buckets[c.ID] = buckets
+	}
+	now := time.Now()
+	switch {
+	case m.Type == TypeTyping:
+		// Typing events past the limit are dropped silently.
+		if !buckets.typing.take(mod.Rate, mod.Burst, now) {
+			return false
+		}
+	case !buckets.messages.take(mod.Rate, mod.Burst, now):
+		if !buckets.messages.limited {
+			buckets.messages.limited = true
+			h.sendSystem(c, "you are sending messages too fast, slow down")
+			h.audit(AuditRateLimit, "", c.ID, "")
+		}
+		return false
+	default:
+		buckets.messages.limited = false
+	}
+
+	switch m.Type {
+	case TypeMute, TypeUnmute, TypeKick:
+		h.command(c, m)
+		return false
+	}
+
+	if h.muted[c.ID] && !c.Moderator {
+		if m.Type != TypeTyping {
+			h.sendSystem(c, "you are muted")
+		}
+		return false
+	}
+
+	if m.Type == TypeText {
+		for _, filter := range mod.Filters {
+			if err := filter(m); err != nil {
+				h.sendSystem(c, "your message was not sent: "+err.Error())
+				h.audit(AuditFilter, "", c.ID, err.Error())
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// commandDone is what the commands make of their target, in the notices.
+var commandDone = map[Type]string{TypeMute: "muted", TypeUnmute: "unmuted", TypeKick: "kicked"}
+
+// command runs a moderation command of a client on the client m.Target.
+func (h *Hub) command(c *Client, m *Message) {
+	if !c.Moderator {
+		h.sendSystem(c, "only hosts can "+string(m.Type)+" someone")
+		return
+	}
+
+	// The target may be connected to another node only, whose hub applies
+	// the command too.
+	name := m.Target
+	target := h.find(m.Target)
+	switch {
+	case target != nil && target.Moderator:
+		h.sendSystem(c, "hosts cannot be muted or kicked")
+		return
+	case target != nil:
+		name = target.Name
+	case h.backplane == nil && m.Type != TypeUnmute:
+		h.sendSystem(c, "nobody with the ID "+m.Target+" is in the chat")
+		return
+	}
+	if m.Type == TypeUnmute && !h.muted[m.Target] {
+		h.sendSystem(c, "nobody with the ID "+m.Target+" is muted")
+		return
+	}
+
+	stamp(m, c)
+	h.apply(m)
+	h.publish(m)
+
+	notice := name + " was " + commandDone[m.Type] + " by " + c.Name
+	if m.Text != "" {
+		notice += ": " + m.Text
+	}
+	h.audit(AuditAction(m.Type), c.ID, m.Target, m.Text)
+	h.announce(notice)
+}
+
+// apply changes the state of the hub after the command m, taken on this
+// node or on another one.
+func (h *Hub) apply(m *Message) {
+	switch m.Type {
+	case TypeMute:
+		h.muted[m.Target] = true
+	case TypeUnmute:
+		delete(h.muted, m.Target)
+	case TypeKick:
+		// The kicked client may not come back to this chat under the same ID.
+		h.banned[m.Target] = true
+		for client := range h.clients {
+			if client.ID != m.Target || client.Moderator {
+				continue
+			}
+			select {
+			case client.Send <- h.system("you were kicked from the chat"):
+			default:
+			}
+			close(client.Send)
+			delete(h.clients, client)
+		}
+	}
+}
+
+// find returns a client with the given ID, nil if there is none.
+func (h *Hub) find(id string) *Client {
+	for client := range h.clients {
+		if client.ID == id {
+			return client
+		}
+	}
+	return nil
+}
+
+// announce routes a system message to everyone.
+func (h *Hub) announce(text string) {
+	h.route(&incoming{message: &Message{Type: TypeSystem, Text: text}})
+}
+
+func (h *Hub) audit(action AuditAction, actor, target, reason string) {
+	if h.moderation.Audit == nil {
+		return
+	}
+
+	h.moderation.Audit(AuditEvent{
+		Time:   time.Now().UTC(),
+		Room:   h.room,
+		Action: action,
+		Actor:  actor,
+		Target: target,
+		Reason: reason,
+	})
+}
@@ -0,0 +1,366 @@
+package chat
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// redisChannelPrefix prefixes the room IDs in the names of the channels.
+	redisChannelPrefix = "quickvideo:chat:"
+	redisTimeout       = 5 * time.Second
+	// redisRetry is how long the backplane waits to connect again to Redis.
+	redisRetry = time.Second
+)
+
+var errBackplaneClosed = errors.New("chat: backplane closed")
+
+// RedisBackplane is a Backplane over Redis Pub/Sub, with one connection
+// subscribed to the channels of the rooms of this node and one to publish.
+// Both connect again when they fail, the messages published meanwhile
+// being lost.
+type RedisBackplane struct {
+	addr, username, password string
+
+	lock sync.Mutex
+	// subscriptions are by channel. sub is nil while disconnected.
+	subscriptions map[string]map[*redisSubscription]bool
+	sub           net.Conn
+
+	publishes chan redisPublish
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type redisSubscription struct {
+	handle func(payload []byte)
+}
+
+type redisPublish struct {
+	channel string
+	payload []byte
+}
+
+// NewRedisBackplane connects to the Redis server of rawURL, e.g.
+// redis://:password@localhost:6379.
+func NewRedisBackplane(rawURL string) (*RedisBackplane, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" || u.Hostname() == "" {
+		return nil, fmt.Errorf("chat: invalid Redis URL %q", rawURL)
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	password, _ := u.User.Password()
+
+	b := &RedisBackplane{
+		addr:          addr,
+		username:      u.User.Username(),
+		password:      password,
+		subscriptions: make(map[string]map[*redisSubscription]bool),
+		publishes:     make(chan redisPublish, 1024),
+		done:          make(chan struct{}),
+	}
+	go b.subscribeLoop()
+	go b.publishLoop()
+	return b, nil
+}
+
+func (b *RedisBackplane) Publish(room string, payload []byte) error {
+	select {
+	case b.publishes <- redisPublish{channel: redisChannelPrefix + room, payload: payload}:
+		return nil
+	case <-b.done:
+		return errBackplaneClosed
+	default:
+		return errors.New("chat: Redis is too slow, dropping a message of room " + room)
+	}
+}
+
+func (b *RedisBackplane) Subscribe(room string, handle func(payload []byte)) (func(), error) {
+	channel := redisChannelPrefix + room
+	s := &redisSubscription{handle: handle}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.subscriptions[channel] == nil {
+		b.subscriptions[channel] = make(map[*redisSubscription]bool)
+		b.command("SUBSCRIBE", channel)
+	}
+	b.subscriptions[channel][s] = true
+
+	return func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+
+		if !b.subscriptions[channel][s] {
+			return
+		}
+		delete(b.subscriptions[channel], s)
+		if len(b.subscriptions[channel]) == 0 {
+			delete(b.subscriptions, channel)
+			b.command("UNSUBSCRIBE", channel)
+		}
+	}, nil
+}
+
+// Close disconnects from Redis. The subscriptions get no more messages.
+func (b *RedisBackplane) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.done)
+
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		if b.sub != nil {
+			b.sub.Close()
+		}
+	})
+	return nil
+}
+
+// command sends a command on the subscribed connection, if it is up. It is
+// called with the lock held.
+func (b *RedisBackplane) command(args ...string) {
+	if b.sub == nil {
+		// The connection subscribes to every channel when it is back.
+		return
+	}
+
+	b.sub.SetWriteDeadline(time.Now().Add(redisTimeout))
+	if err := writeCommand(b.sub, args...); err != nil {
+		log.Println(err)
+		// Make subscribeLoop connect again.
+		b.sub.Close()
+	}
+}
+
+func (b *RedisBackplane) subscribeLoop() {
+	for {
+		err := b.subscribe()
+
+		select {
+		case <-b.done:
+			return
+		default:
+		}
+		log.Printf("chat backplane: %v, connecting to Redis again", err)
+
+		select {
+		case <-time.After(redisRetry):
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// subscribe connects to Redis, subscribes to the channels of the rooms and
+// hands the messages to their subscriptions until the connection fails.
+func (b *RedisBackplane) subscribe() error {
+	conn, r, err := b.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	b.lock.Lock()
+	select {
+	case <-b.done:
+		b.lock.Unlock()
+		return errBackplaneClosed
+	default:
+	}
+	b.sub = conn
+	if len(b.subscriptions) > 0 {
+		args := []string{"SUBSCRIBE"}
+		for channel := range b.subscriptions {
+			args = append(args, channel)
+		}
+		b.command(args...)
+	}
+	b.lock.Unlock()
+
+	defer func() {
+		b.lock.Lock()
+		b.sub = nil
+		b.lock.Unlock()
+	}()
+
+	for {
+		reply, err := readReply(r)
+		if err != nil {
+			return err
+		}
+
+		// Pushed messages are ["message", channel, payload], the replies
+		// to SUBSCRIBE and UNSUBSCRIBE are skipped.
+		push, ok := reply.([]interface{})
+		if !ok || len(push) != 3 {
+			continue
+		}
+		kind, _ := push[0].([]byte)
+		channel, _ := push[1].([]byte)
+		payload, _ := push[2].([]byte)
+		if string(kind) != "message" {
+			continue
+		}
+
+		b.lock.Lock()
+		var handlers []func([]byte)
+		for s := range b.subscriptions[string(channel)] {
+			handlers = append(handlers, s.handle)
+		}
+		b.lock.Unlock()
+
+		for _, handle := range handlers {
+			handle(payload)
+		}
+	}
+}
+
+func (b *RedisBackplane) publishLoop() {
+	var (
+		conn net.Conn
+		r    *bufio.Reader
+	)
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	for {
+		select {
+		case p := <-b.publishes:
+			// A connection broken while idle only fails on the next
+			// message, which is sent again on a new one.
+			var err error
+			for attempt := 0; attempt < 2; attempt++ {
+				if conn == nil {
+					if conn, r, err = b.dial(); err != nil {
+						break
+					}
+				}
+
+				conn.SetDeadline(time.Now().Add(redisTimeout))
+				err = writeCommand(conn, "PUBLISH", p.channel, string(p.payload))
+				if err == nil {
+					_, err = readReply(r)
+				}
+				if err == nil {
+					break
+				}
+				conn.Close()
+				conn = nil
+			}
+			if err != nil {
+				log.Printf("chat backplane: %v, dropping a message", err)
+			}
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// dial connects to Redis and authenticates.
+func (b *RedisBackplane) dial() (net.Conn, *bufio.Reader, error) {
+	conn, err := net.DialTimeout("tcp", b.addr, redisTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	r := bufio.NewReader(conn)
+	if b.password == "" {
+		return conn, r, nil
+	}
+
+	args := []string{"AUTH", b.password}
+	if b.username != "" {
+		args = []string{"AUTH", b.username, b.password}
+	}
+	conn.SetDeadline(time.Now().Add(redisTimeout))
+	err = writeCommand(conn, args...)
+	if err == nil {
+		_, err = readReply(r)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, r, nil
+}
+
+// writeCommand writes a command as an array of bulk strings, in RESP.
+func writeCommand(w io.Writer, args ...string) error {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, "\r\n"...)
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, "\r\n"...)
+		buf = append(buf, arg...)
+		buf = append(buf, "\r\n"...)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// readReply reads a RESP value: a string, an int64, a []byte, nil or a
+// []interface{} of them. Error replies are returned as errors.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("chat: invalid Redis reply %q", line)
+	}
+	kind, value := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return value, nil
+	case '-':
+		return nil, errors.New("redis: " + value)
+	case ':':
+		return strconv.ParseInt(value, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		bulk := make([]byte, n+2)
+		if _, err := io.ReadFull(r, bulk); err != nil {
+			return nil, err
+		}
+		return bulk[:n], nil
+	case '*':
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		array := make([]interface{}, n)
+		for i := range array {
+			if array[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return array, nil
+	}
+	return nil, fmt.Errorf("chat: invalid Redis reply %q", line)
+}
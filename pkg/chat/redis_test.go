@@ -0,0 +1,255 @@
+package chat
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWriteCommand(t *testing.T) {
+	b := &bytes.Buffer{}
+	if err := writeCommand(b, "PUBLISH", "chan", "h\r\ni", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "*4\r\n$7\r\nPUBLISH\r\n$4\r\nchan\r\n$4\r\nh\r\ni\r\n$0\r\n\r\n"
+	if got := b.String(); got != want {
+		t.Errorf("writeCommand wrote %q, want %q", got, want)
+	}
+}
+
+func TestReadReply(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    interface{}
+		wantErr bool
+	}{
+		{in: "+OK\r\n", want: "OK"},
+		{in: "-ERR unknown command\r\n", wantErr: true},
+		{in: ":42\r\n", want: int64(42)},
+		{in: ":-1\r\n", want: int64(-1)},
+		{in: "$5\r\nhello\r\n", want: []byte("hello")},
+		{in: "$4\r\na\r\nb\r\n", want: []byte("a\r\nb")},
+		{in: "$0\r\n\r\n", want: []byte{}},
+		{in: "$-1\r\n", want: nil},
+		{in: "*0\r\n", want: []interface{}{}},
+		{
+			in:   "*3\r\n$7\r\nmessage\r\n$4\r\nchan\r\n$2\r\nhi\r\n",
+			want: []interface{}{[]byte("message"), []byte("chan"), []byte("hi")},
+		},
+		{
+			in:   "*2\r\n*1\r\n:1\r\n+OK\r\n",
+			want: []interface{}{[]interface{}{int64(1)}, "OK"},
+		},
+		{in: "", wantErr: true},
+		{in: "+OK\n", wantErr: true},
+		{in: "?what\r\n", wantErr: true},
+		{in: ":one\r\n", wantErr: true},
+		{in: "$5\r\nhi\r\n", wantErr: true},
+		{in: "*2\r\n:1\r\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := readReply(bufio.NewReader(strings.NewReader(tt.in)))
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("readReply(%q) = %v, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("readReply(%q): %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("readReply(%q) = %#v, want %#v", tt.in, got, tt.want)
+		}
+	}
+}
+
+// fakeRedis serves the Pub/Sub commands of Redis the backplane uses.
+type fakeRedis struct {
+	t        *testing.T
+	listener net.Listener
+	password string
+
+	lock  sync.Mutex
+	conns map[net.Conn]bool
+	subs  map[string]map[net.Conn]bool
+	// subscribed gets the channels as they are subscribed to.
+	subscribed chan string
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeRedis{
+		t:          t,
+		listener:   l,
+		password:   password,
+		conns:      make(map[net.Conn]bool),
+		subs:       make(map[string]map[net.Conn]bool),
+		subscribed: make(chan string, 16),
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			f.lock.Lock()
+			f.conns[conn] = true
+			f.lock.Unlock()
+			go f.serve(conn)
+		}
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		f.disconnect()
+	})
+	return f
+}
+
+func (f *fakeRedis) url() string {
+	return "redis://:" + f.password + "@" + f.listener.Addr().String()
+}
+
+// disconnect closes every connection, as a restart of Redis does.
+func (f *fakeRedis) disconnect() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for conn := range f.conns {
+		conn.Close()
+	}
+	f.conns = make(map[net.Conn]bool)
+	f.subs = make(map[string]map[net.Conn]bool)
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	authenticated := false
+	for {
+		reply, err := readReply(r)
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, arg := range reply.([]interface{}) {
+			args = append(args, string(arg.([]byte)))
+		}
+
+		f.lock.Lock()
+		switch {
+		case args[0] == "AUTH":
+			authenticated = args[len(args)-1] == f.password
+			if authenticated {
+				conn.Write([]byte("+OK\r\n"))
+			} else {
+				conn.Write([]byte("-WRONGPASS invalid password\r\n"))
+			}
+		case !authenticated:
+			conn.Write([]byte("-NOAUTH Authentication required.\r\n"))
+		case args[0] == "SUBSCRIBE":
+			for _, channel := range args[1:] {
+				if f.subs[channel] == nil {
+					f.subs[channel] = make(map[net.Conn]bool)
+				}
+				f.subs[channel][conn] = true
+				writeCommand(conn, "subscribe", channel)
+				f.subscribed <- channel
+			}
+		case args[0] == "UNSUBSCRIBE":
+			for _, channel := range args[1:] {
+				delete(f.subs[channel], conn)
+				writeCommand(conn, "unsubscribe", channel)
+			}
+		case args[0] == "PUBLISH":
+			for sub := range f.subs[args[1]] {
+				writeCommand(sub, "message", args[1], args[2])
+			}
+			conn.Write([]byte(":" + strconv.Itoa(len(f.subs[args[1]])) + "\r\n"))
+		default:
+			conn.Write([]byte("-ERR unknown command\r\n"))
+		}
+		f.lock.Unlock()
+	}
+}
+
+func (f *fakeRedis) waitSubscribed(channel string) {
+	f.t.Helper()
+
+	for {
+		select {
+		case c := <-f.subscribed:
+			if c == channel {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			f.t.Fatalf("%s was not subscribed to", channel)
+		}
+	}
+}
+
+func TestRedisBackplaneReconnects(t *testing.T) {
+	redis := newFakeRedis(t, "secret")
+	b, err := NewRedisBackplane(redis.url())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	payloads := make(chan string, 16)
+	unsubscribe, err := b.Subscribe("room", func(payload []byte) {
+		payloads <- string(payload)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unsubscribe()
+
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case got := <-payloads:
+			if got != want {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q was not received", want)
+		}
+	}
+
+	redis.waitSubscribed(redisChannelPrefix + "room")
+	if err := b.Publish("room", []byte("before")); err != nil {
+		t.Fatal(err)
+	}
+	expect("before")
+
+	// Both connections are broken: the subscriber connects and subscribes
+	// again, and the publisher sends the next message on a new connection.
+	redis.disconnect()
+	redis.waitSubscribed(redisChannelPrefix + "room")
+	if err := b.Publish("room", []byte("after")); err != nil {
+		t.Fatal(err)
+	}
+	expect("after")
+}
+
+func TestNewRedisBackplaneRejectsInvalidURLs(t *testing.T) {
+	for _, rawURL := range []string{"localhost:6379", "http://localhost", "redis://", "redis://%zz"} {
+		if b, err := NewRedisBackplane(rawURL); err == nil {
+			b.Close()
+			t.Errorf("NewRedisBackplane(%q) succeeded", rawURL)
+		}
+	}
+}
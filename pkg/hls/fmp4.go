@@ -0,0 +1,300 @@
+package hls
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+const (
+	videoTrackID = 1
+	audioTrackID = 2
+
+	videoTimescale = 90000
+	audioTimescale = 48000
+
+	// Sample flags of the trun box: key frames depend on no other sample,
+	// the other video frames are not sync samples.
+	syncSampleFlags    = 0x02000000
+	nonSyncSampleFlags = 0x01010000
+)
+
+// boxWriter writes ISO BMFF boxes.
+type boxWriter struct {
+	bytes.Buffer
+}
+
+func (b *boxWriter) u8(v uint8) { b.WriteByte(v) }
+
+func (b *boxWriter) u16(v uint16) { b.Write(binary.BigEndian.AppendUint16(nil, v)) }
+
+func (b *boxWriter) u32(v uint32) { b.Write(binary.BigEndian.AppendUint32(nil, v)) }
+
+func (b *boxWriter) u64(v uint64) { b.Write(binary.BigEndian.AppendUint64(nil, v)) }
+
+func (b *boxWriter) zeros(n int) { b.Write(make([]byte, n)) }
+
+// box writes a box of type typ whose content is written by content.
+func (b *boxWriter) box(typ string, content func()) {
+	start := b.Len()
+	b.u32(0)
+	b.WriteString(typ)
+	content()
+	binary.BigEndian.PutUint32(b.Bytes()[start:], uint32(b.Len()-start))
+}
+
+func (b *boxWriter) fullBox(typ string, version uint8, flags uint32, content func()) {
+	b.box(typ, func() {
+		b.u32(uint32(version)<<24 | flags)
+		content()
+	})
+}
+
+func (b *boxWriter) matrix() {
+	for _, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		b.u32(v)
+	}
+}
+
+// videoConfig describes the H.264 stream of a period.
+type videoConfig struct {
+	sps, pps      []byte
+	width, height int
+}
+
+// initSegment returns the ftyp and moov boxes describing the tracks of a
+// period. video or hasAudio may be left out, not both.
+func initSegment(video *videoConfig, hasAudio bool) []byte {
+	b := &boxWriter{}
+
+	b.box("ftyp", func() {
+		b.WriteString("iso6")
+		b.u32(0)
+		b.WriteString("iso6mp41")
+	})
+
+	b.box("moov", func() {
+		b.fullBox("mvhd", 0, 0, func() {
+			b.zeros(8) // creation and modification time
+			b.u32(1000)
+			b.u32(0) // duration
+			b.u32(0x00010000)
+			b.u16(0x0100)
+			b.zeros(10)
+			b.matrix()
+			b.zeros(24)
+			b.u32(audioTrackID + 1)
+		})
+
+		if video != nil {
+			b.trak(videoTrackID, videoTimescale, "vide", func() {
+				b.avc1(video)
+			}, video.width, video.height)
+		}
+		if hasAudio {
+			b.trak(audioTrackID, audioTimescale, "soun", b.opus, 0, 0)
+		}
+
+		b.box("mvex", func() {
+			if video != nil {
+				b.trex(videoTrackID)
+			}
+			if hasAudio {
+				b.trex(audioTrackID)
+			}
+		})
+	})
+
+	return b.Bytes()
+}
+
+func (b *boxWriter) trak(id, timescale uint32, handler string, sampleEntry func(), width, height int) {
+	b.box("trak", func() {
+		b.fullBox("tkhd", 0, 3, func() {
+			b.zeros(8)
+			b.u32(id)
+			b.zeros(4)
+			b.u32(0) // duration
+			b.zeros(8)
+			b.u16(0) // layer
+			b.u16(0) // alternate group
+			if handler == "soun" {
+				b.u16(0x0100)
+			} else {
+				b.u16(0)
+			}
+			b.zeros(2)
+			b.matrix()
+			b.u32(uint32(width) << 16)
+			b.u32(uint32(height) << 16)
+		})
+
+		b.box("mdia", func() {
+			b.fullBox("mdhd", 0, 0, func() {
+				b.zeros(8)
+				b.u32(timescale)
+				b.u32(0)
+				b.u16(0x55c4) // und
+				b.u16(0)
+			})
+			b.fullBox("hdlr", 0, 0, func() {
+				b.u32(0)
+				b.WriteString(handler)
+				b.zeros(12)
+				b.WriteString("quick-video\x00")
+			})
+			b.box("minf", func() {
+				if handler == "soun" {
+					b.fullBox("smhd", 0, 0, func() { b.zeros(4) })
+				} else {
+					b.fullBox("vmhd", 0, 1, func() { b.zeros(8) })
+				}
+				b.box("dinf", func() {
+					b.fullBox("dref", 0, 0, func() {
+						b.u32(1)
+						b.fullBox("url ", 0, 1, func() {})
+					})
+				})
+				b.box("stbl", func() {
+					b.fullBox("stsd", 0, 0, func() {
+						b.u32(1)
+						sampleEntry()
+					})
+					b.fullBox("stts", 0, 0, func() { b.u32(0) })
+					b.fullBox("stsc", 0, 0, func() { b.u32(0) })
+					b.fullBox("stsz", 0, 0, func() { b.zeros(8) })
+					b.fullBox("stco", 0, 0, func() { b.u32(0) })
+				})
+			})
+		})
+	})
+}
+
+func (b *boxWriter) avc1(v *videoConfig) {
+	b.box("avc1", func() {
+		b.zeros(6)
+		b.u16(1) // data reference index
+		b.zeros(16)
+		b.u16(uint16(v.width))
+		b.u16(uint16(v.height))
+		b.u32(0x00480000)
+		b.u32(0x00480000)
+		b.zeros(4)
+		b.u16(1) // frame count
+		b.zeros(32)
+		b.u16(0x0018)
+		b.u16(0xffff)
+
+		b.box("avcC", func() {
+			b.u8(1)
+			b.u8(v.sps[1])
+			b.u8(v.sps[2])
+			b.u8(v.sps[3])
+			b.u8(0xff) // 4 byte NAL unit lengths
+			b.u8(0xe1) // one SPS
+			b.u16(uint16(len(v.sps)))
+			b.Write(v.sps)
+			b.u8(1)
+			b.u16(uint16(len(v.pps)))
+			b.Write(v.pps)
+		})
+	})
+}
+
+func (b *boxWriter) opus() {
+	b.box("Opus", func() {
+		b.zeros(6)
+		b.u16(1)
+		b.zeros(8)
+		b.u16(2)  // channels
+		b.u16(16) // sample size
+		b.zeros(4)
+		b.u32(audioTimescale << 16)
+
+		b.box("dOps", func() {
+			b.u8(0)
+			b.u8(2)
+			b.u16(0) // pre-skip
+			b.u32(audioTimescale)
+			b.u16(0) // output gain
+			b.u8(0)  // channel mapping family
+		})
+	})
+}
+
+func (b *boxWriter) trex(id uint32) {
+	b.fullBox("trex", 0, 0, func() {
+		b.u32(id)
+		b.u32(1)
+		b.zeros(12)
+	})
+}
+
+type sample struct {
+	dts      uint64
+	duration uint32
+	key      bool
+	data     []byte
+}
+
+// fragment returns a moof and mdat pair carrying the samples of both
+// tracks. Either list may be empty.
+func fragment(sequence uint32, video, audio []*sample) []byte {
+	b := &boxWriter{}
+
+	var offsets []int
+	b.box("moof", func() {
+		b.fullBox("mfhd", 0, 0, func() { b.u32(sequence) })
+
+		for _, t := range []struct {
+			id      uint32
+			samples []*sample
+		}{{videoTrackID, video}, {audioTrackID, audio}} {
+			if len(t.samples) == 0 {
+				continue
+			}
+
+			samples := t.samples
+			b.box("traf", func() {
+				b.fullBox("tfhd", 0, 0x020000, func() { b.u32(t.id) })
+				b.fullBox("tfdt", 1, 0, func() { b.u64(samples[0].dts) })
+				b.fullBox("trun", 0, 0x000701, func() {
+					b.u32(uint32(len(samples)))
+					offsets = append(offsets, b.Len())
+					b.u32(0) // data offset, patched below
+					for _, s := range samples {
+						b.u32(s.duration)
+						b.u32(uint32(len(s.data)))
+						if s.key {
+							b.u32(syncSampleFlags)
+						} else {
+							b.u32(nonSyncSampleFlags)
+						}
+					}
+				})
+			})
+		}
+	})
+
+	// The data of each track follows the mdat header, in the order of the trafs.
+	offset := b.Len() + 8
+	i := 0
+	for _, samples := range [][]*sample{video, audio} {
+		if len(samples) == 0 {
+			continue
+		}
+		binary.BigEndian.PutUint32(b.Bytes()[offsets[i]:], uint32(offset))
+		for _, s := range samples {
+			offset += len(s.data)
+		}
+		i++
+	}
+
+	b.box("mdat", func() {
+		for _, samples := range [][]*sample{video, audio} {
+			for _, s := range samples {
+				b.Write(s.data)
+			}
+		}
+	})
+	return b.Bytes()
+}
@@ -0,0 +1,277 @@
+package hls
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	naluIDR = 5
+	naluSPS = 7
+	naluPPS = 8
+	naluAUD = 9
+)
+
+var errBadSPS = errors.New("invalid H.264 sequence parameter set")
+
+// accessUnit is an H.264 frame split out of the length prefixed NAL units
+// the depacketizer outputs. The parameter sets and delimiters are taken out
+// of data, the parameter sets go to the init segment instead.
+type accessUnit struct {
+	sps, pps []byte
+	key      bool
+	data     []byte
+}
+
+func parseAccessUnit(avc []byte) *accessUnit {
+	au := &accessUnit{}
+	for len(avc) >= 4 {
+		size := int(binary.BigEndian.Uint32(avc))
+		if size == 0 || 4+size > len(avc) {
+			break
+		}
+		nalu := avc[4 : 4+size]
+
+		switch nalu[0] & 0x1F {
+		case naluSPS:
+			au.sps = nalu
+		case naluPPS:
+			au.pps = nalu
+		case naluAUD:
+		case naluIDR:
+			au.key = true
+			fallthrough
+		default:
+			au.data = append(au.data, avc[:4+size]...)
+		}
+		avc = avc[4+size:]
+	}
+	return au
+}
+
+// bitReader reads the Exp-Golomb coded fields of an SPS.
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *bitReader) bit() (uint, error) {
+	if r.pos >= len(r.data)*8 {
+		return 0, errBadSPS
+	}
+	b := uint(r.data[r.pos/8]>>(7-r.pos%8)) & 1
+	r.pos++
+	return b, nil
+}
+
+func (r *bitReader) bits(n int) (uint, error) {
+	var v uint
+	for i := 0; i < n; i++ {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | b
+	}
+	return v, nil
+}
+
+func (r *bitReader) ue() (uint, error) {
+	zeros := 0
+	for {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		if b == 1 {
+			break
+		}
+		if zeros++; zeros > 31 {
+			return 0, errBadSPS
+		}
+	}
+	v, err := r.bits(zeros)
+	return 1<<zeros - 1 + v, err
+}
+
+func (r *bitReader) se() (int, error) {
+	v, err := r.ue()
+	if v%2 == 0 {
+		return -int(v / 2), err
+	}
+	return int(v/2) + 1, err
+}
+
+// skip reads the given Exp-Golomb fields, u for unsigned, s for signed, or
+// a number of bits.
+func (r *bitReader) skip(fields ...interface{}) error {
+	for _, f := range fields {
+		var err error
+		switch f := f.(type) {
+		case int:
+			_, err = r.bits(f)
+		case string:
+			if f == "s" {
+				_, err = r.se()
+			} else {
+				_, err = r.ue()
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// spsResolution returns the size of the pictures of an SPS, as in 7.3.2.1.1
+// of ITU-T H.264.
+func spsResolution(sps []byte) (width, height int, err error) {
+	if len(sps) < 4 {
+		return 0, 0, errBadSPS
+	}
+
+	// Drop the emulation prevention bytes.
+	rbsp := make([]byte, 0, len(sps))
+	for i := 1; i < len(sps); i++ {
+		if i >= 3 && sps[i] == 3 && sps[i-1] == 0 && sps[i-2] == 0 {
+			continue
+		}
+		rbsp = append(rbsp, sps[i])
+	}
+
+	r := &bitReader{data: rbsp}
+	profile, _ := r.bits(8)
+	if err := r.skip(16, "u"); err != nil {
+		return 0, 0, err
+	}
+
+	chromaFormat := uint(1)
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		if chromaFormat, err = r.ue(); err != nil {
+			return 0, 0, err
+		}
+		if chromaFormat == 3 {
+			if err := r.skip(1); err != nil {
+				return 0, 0, err
+			}
+		}
+		if err := r.skip("u", "u", 1); err != nil {
+			return 0, 0, err
+		}
+
+		scaling, err := r.bit()
+		if err != nil {
+			return 0, 0, err
+		}
+		if scaling == 1 {
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				present, err := r.bit()
+				if err != nil {
+					return 0, 0, err
+				}
+				if present == 0 {
+					continue
+				}
+
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := 8, 8
+				for j := 0; j < size && next != 0; j++ {
+					delta, err := r.se()
+					if err != nil {
+						return 0, 0, err
+					}
+					next = (last + delta + 256) % 256
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+
+	if err := r.skip("u"); err != nil { // log2_max_frame_num_minus4
+		return 0, 0, err
+	}
+	pocType, err := r.ue()
+	if err != nil {
+		return 0, 0, err
+	}
+	switch pocType {
+	case 0:
+		err = r.skip("u")
+	case 1:
+		if err = r.skip(1, "s", "s"); err != nil {
+			return 0, 0, err
+		}
+		var cycle uint
+		if cycle, err = r.ue(); err != nil {
+			return 0, 0, err
+		}
+		for i := uint(0); i < cycle && err == nil; i++ {
+			err = r.skip("s")
+		}
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if err := r.skip("u", 1); err != nil {
+		return 0, 0, err
+	}
+	widthMbs, err := r.ue()
+	if err != nil {
+		return 0, 0, err
+	}
+	heightUnits, err := r.ue()
+	if err != nil {
+		return 0, 0, err
+	}
+	frameMbsOnly, err := r.bit()
+	if err != nil {
+		return 0, 0, err
+	}
+	if frameMbsOnly == 0 {
+		if err := r.skip(1); err != nil {
+			return 0, 0, err
+		}
+	}
+	if err := r.skip(1); err != nil {
+		return 0, 0, err
+	}
+
+	width = int(widthMbs+1) * 16
+	height = int(2-frameMbsOnly) * int(heightUnits+1) * 16
+
+	cropping, err := r.bit()
+	if err != nil {
+		return 0, 0, err
+	}
+	if cropping == 1 {
+		var crop [4]uint
+		for i := range crop {
+			if crop[i], err = r.ue(); err != nil {
+				return 0, 0, err
+			}
+		}
+
+		cropX, cropY := 1, int(2-frameMbsOnly)
+		if chromaFormat == 1 || chromaFormat == 2 {
+			cropX = 2
+		}
+		if chromaFormat == 1 {
+			cropY *= 2
+		}
+		width -= cropX * int(crop[0]+crop[1])
+		height -= cropY * int(crop[2]+crop[3])
+	}
+	return width, height, nil
+}
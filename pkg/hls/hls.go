@@ -0,0 +1,453 @@
+// Package hls serves the stream of a room over HLS, for audiences too large
+// to each get a PeerConnection.
+//
+// An Egress subscribes to a room like any other sink and muxes one H.264
+// video track and one Opus audio track into fragmented MP4. Segments start
+// on key frames and are made of parts, which are listed in the playlist as
+// low-latency HLS partial segments when enabled. Everything is kept in
+// memory, only the last few segments of the stream are available.
+package hls
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	w "quick-video/pkg/webrtc"
+
+	guuid "github.com/google/uuid"
+	"github.com/pion/webrtc/v3"
+)
+
+var (
+	ErrNotFound = errors.New("no such playlist or segment")
+	ErrStopped  = errors.New("egress is stopped")
+)
+
+type Options struct {
+	// LowLatency lists the parts of the recent segments in the playlist and
+	// lets players block until the next part is ready, as in LL-HLS.
+	LowLatency bool
+	// SegmentDuration is the shortest duration of a segment, which ends on
+	// the first key frame after it, rounded to the second.
+	SegmentDuration time.Duration
+	// PartDuration is the longest duration of a part.
+	PartDuration time.Duration
+	// Segments is how many segments the playlist lists.
+	Segments int
+}
+
+func (o Options) withDefaults() Options {
+	if o.SegmentDuration <= 0 {
+		o.SegmentDuration = 2 * time.Second
+	}
+	if o.PartDuration <= 0 {
+		o.PartDuration = 500 * time.Millisecond
+	}
+	if o.Segments <= 0 {
+		o.Segments = 6
+	}
+	return o
+}
+
+// period is a run of segments sharing an init segment. A new period starts,
+// after a discontinuity, whenever the muxed tracks or their codec
+// parameters change.
+type period struct {
+	id    int
+	init  []byte
+	video *videoConfig
+	audio bool
+	// source is the video track muxed in the period.
+	source *trackWriter
+}
+
+type part struct {
+	data        []byte
+	duration    float64
+	independent bool
+}
+
+type segment struct {
+	msn           uint64
+	period        *period
+	discontinuity bool
+	startedAt     time.Time
+	parts         []*part
+	duration      float64
+	done          bool
+	data          []byte
+}
+
+// Egress muxes the tracks of a room into HLS. It is a webrtc.Sink.
+type Egress struct {
+	// ID tells apart the files of the successive egresses of a stream, so
+	// that a cache never serves the files of an earlier one.
+	ID   string
+	Room *w.Room
+	Options
+
+	lastAccess atomic.Int64
+
+	lock    sync.Mutex
+	stopped bool
+	// changed is closed, and replaced, whenever a part is added.
+	changed chan struct{}
+
+	tracks       []*trackWriter
+	video, audio *trackWriter
+	restart      bool
+	config       *videoConfig
+
+	epoch           time.Time
+	period          *period
+	periods         int
+	sequence        uint32
+	segments        []*segment
+	nextMSN         uint64
+	discontinuities int
+
+	heldVideo, heldAudio *sample
+	partVideo, partAudio []*sample
+}
+
+func New(room *w.Room, opts Options) *Egress {
+	e := &Egress{
+		ID:      strings.ReplaceAll(guuid.New().String(), "-", "")[:12],
+		Room:    room,
+		Options: opts.withDefaults(),
+		changed: make(chan struct{}),
+	}
+	e.touch()
+	return e
+}
+
+// Start subscribes the egress to the tracks of the room.
+func (e *Egress) Start() {
+	e.Room.Peers.Attach(e)
+}
+
+// Stop unsubscribes the egress and ends the last segment.
+func (e *Egress) Stop() {
+	e.Room.Peers.Detach(e)
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.endPeriod()
+	e.stopped = true
+	e.notify()
+}
+
+// LastAccess is the last time the playlist or a file was requested.
+func (e *Egress) LastAccess() time.Time {
+	return time.Unix(0, e.lastAccess.Load())
+}
+
+func (e *Egress) touch() {
+	e.lastAccess.Store(time.Now().UnixNano())
+}
+
+// AddTrack muxes H.264 video and Opus audio. Only the first track of each
+// kind is muxed, the next one takes over when it is unpublished.
+func (e *Egress) AddTrack(t *w.Track) webrtc.TrackLocalWriter {
+	mimeType := t.Codec().MimeType
+	if !strings.EqualFold(mimeType, webrtc.MimeTypeH264) && !strings.EqualFold(mimeType, webrtc.MimeTypeOpus) {
+		return nil
+	}
+
+	tw := newTrackWriter(e, t)
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.tracks = append(e.tracks, tw)
+	e.selectTracks()
+	return tw
+}
+
+func (e *Egress) RemoveTrack(t *w.Track) {
+	e.lock.Lock()
+	var tw *trackWriter
+	for i := range e.tracks {
+		if e.tracks[i].track == t {
+			tw = e.tracks[i]
+			e.tracks = append(e.tracks[:i], e.tracks[i+1:]...)
+			break
+		}
+	}
+	e.lock.Unlock()
+
+	if tw == nil {
+		return
+	}
+	tw.Close()
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.selectTracks()
+}
+
+// selectTracks picks the tracks to mux, the oldest ones of each kind.
+// e.lock must be held.
+func (e *Egress) selectTracks() {
+	var video, audio *trackWriter
+	for _, tw := range e.tracks {
+		if tw.video && video == nil {
+			video = tw
+		} else if !tw.video && audio == nil {
+			audio = tw
+		}
+	}
+
+	if video == e.video && audio == e.audio {
+		return
+	}
+	if video != e.video {
+		e.config = nil
+		e.heldVideo = nil
+	}
+	e.video, e.audio = video, audio
+
+	// Without video, the audio can only start a new period if the period
+	// of the video track is over.
+	if video == nil {
+		e.endPeriod()
+	}
+	e.restart = true
+}
+
+// since returns the time elapsed between the first sample of the egress and
+// at, in units of clockRate.
+func (e *Egress) since(at time.Time, clockRate uint32) uint64 {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.epoch.IsZero() {
+		e.epoch = at
+	}
+	if at.Before(e.epoch) {
+		return 0
+	}
+	return uint64(at.Sub(e.epoch).Seconds() * float64(clockRate))
+}
+
+func (e *Egress) writeVideo(tw *trackWriter, dts uint64, data []byte) {
+	au := parseAccessUnit(data)
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if tw != e.video || e.stopped {
+		return
+	}
+
+	if au.sps != nil && au.pps != nil && (e.config == nil || !bytes.Equal(au.sps, e.config.sps) || !bytes.Equal(au.pps, e.config.pps)) {
+		width, height, err := spsResolution(au.sps)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		e.config = &videoConfig{
+			sps:    append([]byte(nil), au.sps...),
+			pps:    append([]byte(nil), au.pps...),
+			width:  width,
+			height: height,
+		}
+		e.restart = true
+	}
+
+	if au.key && e.config != nil && (e.period == nil || e.restart) {
+		e.startPeriod()
+	}
+	if e.period == nil || e.period.source != tw || len(au.data) == 0 {
+		return
+	}
+
+	e.heldVideo = e.push(e.heldVideo, &sample{dts: dts, key: au.key, data: au.data}, &e.partVideo, videoTimescale)
+}
+
+func (e *Egress) writeAudio(tw *trackWriter, dts uint64, data []byte) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if tw != e.audio || e.stopped {
+		return
+	}
+
+	if e.video == nil && (e.period == nil || e.restart) {
+		e.startPeriod()
+	}
+	if e.period == nil || !e.period.audio {
+		return
+	}
+
+	s := &sample{dts: dts, key: true, data: append([]byte(nil), data...)}
+	if e.period.video != nil {
+		if e.heldAudio != nil && s.dts > e.heldAudio.dts {
+			e.heldAudio.duration = uint32(s.dts - e.heldAudio.dts)
+			e.partAudio = append(e.partAudio, e.heldAudio)
+		}
+		e.heldAudio = s
+		return
+	}
+	e.heldAudio = e.push(e.heldAudio, s, &e.partAudio, audioTimescale)
+}
+
+// push adds held, the previous sample of the track driving the segmentation,
+// to the current part now that s tells its duration, and cuts the part and
+// the segment as needed. It returns the sample to hold next.
+func (e *Egress) push(held, s *sample, samples *[]*sample, timescale uint32) *sample {
+	if held == nil {
+		return s
+	}
+	if s.dts <= held.dts {
+		return held
+	}
+	held.duration = uint32(s.dts - held.dts)
+
+	pending := e.pendingDuration()
+	d := float64(held.duration) / float64(timescale)
+	if pending > 0 && pending+d > e.PartDuration.Seconds() {
+		e.flushPart()
+	}
+	*samples = append(*samples, held)
+
+	// s starts the next segment if it can. Segments are long enough once
+	// they round to SegmentDuration, as their duration in the playlist does.
+	if current := e.current(); s.key && math.Round(current.duration+e.pendingDuration()) >= math.Round(e.SegmentDuration.Seconds()) {
+		e.flushPart()
+		e.finishSegment()
+		e.newSegment(false)
+	}
+	return s
+}
+
+// pendingDuration is the duration of the samples waiting for the next part,
+// in seconds.
+func (e *Egress) pendingDuration() float64 {
+	samples, timescale := e.partVideo, float64(videoTimescale)
+	if e.period != nil && e.period.video == nil {
+		samples, timescale = e.partAudio, audioTimescale
+	}
+
+	var d uint64
+	for _, s := range samples {
+		d += uint64(s.duration)
+	}
+	return float64(d) / timescale
+}
+
+func (e *Egress) current() *segment {
+	return e.segments[len(e.segments)-1]
+}
+
+// startPeriod ends the current period and starts a new one muxing the
+// selected tracks.
+func (e *Egress) startPeriod() {
+	e.endPeriod()
+
+	e.periods++
+	e.period = &period{
+		id:    e.periods,
+		audio: e.audio != nil,
+	}
+	if e.video != nil {
+		e.period.video = e.config
+		e.period.source = e.video
+	}
+	e.period.init = initSegment(e.period.video, e.period.audio)
+	e.restart = false
+
+	e.newSegment(e.periods > 1)
+}
+
+// endPeriod flushes the samples of the current period and ends its last segment.
+func (e *Egress) endPeriod() {
+	if e.period == nil {
+		return
+	}
+
+	// The held samples last as long as the sample before them.
+	for _, held := range []struct {
+		s       *sample
+		samples *[]*sample
+	}{{e.heldVideo, &e.partVideo}, {e.heldAudio, &e.partAudio}} {
+		if held.s == nil {
+			continue
+		}
+		if n := len(*held.samples); n > 0 {
+			held.s.duration = (*held.samples)[n-1].duration
+		}
+		if held.s.duration > 0 {
+			*held.samples = append(*held.samples, held.s)
+		}
+	}
+	e.heldVideo, e.heldAudio = nil, nil
+
+	e.flushPart()
+	if current := e.current(); len(current.parts) == 0 {
+		e.segments = e.segments[:len(e.segments)-1]
+		e.nextMSN--
+	} else {
+		e.finishSegment()
+	}
+	e.period = nil
+}
+
+func (e *Egress) newSegment(discontinuity bool) {
+	e.segments = append(e.segments, &segment{
+		msn:           e.nextMSN,
+		period:        e.period,
+		discontinuity: discontinuity,
+		startedAt:     time.Now(),
+	})
+	e.nextMSN++
+
+	// Keep the listed segments, and the one in progress.
+	for len(e.segments) > e.Segments+1 {
+		if e.segments[0].discontinuity {
+			e.discontinuities++
+		}
+		e.segments = e.segments[1:]
+	}
+}
+
+func (e *Egress) flushPart() {
+	if len(e.partVideo) == 0 && len(e.partAudio) == 0 {
+		return
+	}
+
+	p := &part{
+		duration:    e.pendingDuration(),
+		independent: len(e.partVideo) == 0 || e.partVideo[0].key,
+	}
+	e.sequence++
+	p.data = fragment(e.sequence, e.partVideo, e.partAudio)
+	e.partVideo, e.partAudio = nil, nil
+
+	current := e.current()
+	current.parts = append(current.parts, p)
+	current.duration += p.duration
+	e.notify()
+}
+
+func (e *Egress) finishSegment() {
+	current := e.current()
+	current.done = true
+	for _, p := range current.parts {
+		current.data = append(current.data, p.data...)
+	}
+	e.notify()
+}
+
+// notify wakes up the requests blocked until the next part. e.lock must be held.
+func (e *Egress) notify() {
+	close(e.changed)
+	e.changed = make(chan struct{})
+}
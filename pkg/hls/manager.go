@@ -0,0 +1,78 @@
+package hls
+
+import (
+	"sync"
+	"time"
+
+	w "quick-video/pkg/webrtc"
+)
+
+// Manager runs the egress of every stream watched over HLS. An egress is
+// started by the first request for its playlist, and stopped once nobody
+// asked for it for a while.
+type Manager struct {
+	Options Options
+
+	lock     sync.Mutex
+	egresses map[string]*Egress
+}
+
+func NewManager(opts Options) *Manager {
+	return &Manager{
+		Options:  opts,
+		egresses: make(map[string]*Egress),
+	}
+}
+
+// Get returns the egress of room, starting it if needed.
+func (m *Manager) Get(room *w.Room) *Egress {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if e, ok := m.egresses[room.StreamID]; ok && e.Room == room {
+		return e
+	} else if ok {
+		go e.Stop()
+	}
+
+	e := New(room, m.Options)
+	e.Start()
+	m.egresses[room.StreamID] = e
+	return e
+}
+
+// Stop stops the egress of the stream with the given ID, if any.
+func (m *Manager) Stop(streamID string) {
+	m.lock.Lock()
+	e, ok := m.egresses[streamID]
+	delete(m.egresses, streamID)
+	m.lock.Unlock()
+
+	if ok {
+		e.Stop()
+	}
+}
+
+// Reap stops the egresses nobody requested anything from for longer than idle.
+func (m *Manager) Reap(idle time.Duration) {
+	m.lock.Lock()
+	var idles []*Egress
+	for id, e := range m.egresses {
+		if time.Since(e.LastAccess()) >= idle {
+			delete(m.egresses, id)
+			idles = append(idles, e)
+		}
+	}
+	m.lock.Unlock()
+
+	for _, e := range idles {
+		e.Stop()
+	}
+}
+
+// Len returns the number of running egresses.
+func (m *Manager) Len() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.egresses)
+}
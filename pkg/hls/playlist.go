@@ -0,0 +1,260 @@
+package hls
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// PlaylistName is the name of the media playlist of a stream.
+	PlaylistName = "index.m3u8"
+
+	// startTimeout is how long the first request waits for the first segment.
+	startTimeout = 10 * time.Second
+	// partsListed is how many finished segments have their parts listed.
+	partsListed = 3
+)
+
+// Playlist returns the media playlist. With low latency, msn and part ask to
+// block until the given segment or part is listed, as the _HLS_msn and
+// _HLS_part query parameters do; they are negative otherwise. query, e.g.
+// ?token=..., is appended to every URI listed.
+func (e *Egress) Playlist(msn, part int, query string) ([]byte, error) {
+	e.touch()
+
+	if msn >= 0 && !e.LowLatency {
+		msn, part = -1, -1
+	}
+	timeout := startTimeout
+	if msn >= 0 {
+		timeout = 3 * e.targetDuration()
+	}
+
+	var playlist []byte
+	err := e.wait(timeout, func() bool {
+		if !e.listed(msn, part) {
+			return false
+		}
+		playlist = e.render(query)
+		return true
+	})
+	return playlist, err
+}
+
+// File returns the init segment, segment or part called name.
+func (e *Egress) File(name string) ([]byte, error) {
+	e.touch()
+
+	name, ok := strings.CutPrefix(name, e.ID+"-")
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	if id, ok := strings.CutPrefix(name, "init"); ok {
+		id, _ = strings.CutSuffix(id, ".mp4")
+		return e.init(id)
+	}
+
+	name, ok = strings.CutSuffix(name, ".m4s")
+	if !ok {
+		return nil, ErrNotFound
+	}
+	msnPart := strings.SplitN(name, ".", 2)
+	msn, err := strconv.ParseUint(msnPart[0], 10, 64)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	part := -1
+	if len(msnPart) == 2 {
+		if part, err = strconv.Atoi(msnPart[1]); err != nil || part < 0 {
+			return nil, ErrNotFound
+		}
+	}
+
+	// Parts may be asked for as soon as they are hinted, before they are
+	// ready: the request blocks until they are.
+	var data []byte
+	err = e.wait(3*e.targetDuration(), func() bool {
+		s := e.segment(msn)
+		if s == nil {
+			return msn < e.nextMSN
+		}
+		if part < 0 {
+			data = s.data
+			return s.done
+		}
+		if part < len(s.parts) {
+			data = s.parts[part].data
+			return true
+		}
+		return s.done
+	})
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, ErrNotFound
+	}
+	return data, nil
+}
+
+// wait calls ready with e.lock held, every time a part is added, until it
+// returns true or timeout elapses.
+func (e *Egress) wait(timeout time.Duration, ready func() bool) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		e.lock.Lock()
+		if ready() {
+			e.lock.Unlock()
+			return nil
+		}
+		if e.stopped {
+			e.lock.Unlock()
+			return ErrStopped
+		}
+		changed := e.changed
+		e.lock.Unlock()
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return ErrNotFound
+		}
+	}
+}
+
+func (e *Egress) init(id string) ([]byte, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	for _, s := range e.segments {
+		if strconv.Itoa(s.period.id) == id {
+			return s.period.init, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (e *Egress) segment(msn uint64) *segment {
+	for _, s := range e.segments {
+		if s.msn == msn {
+			return s
+		}
+	}
+	return nil
+}
+
+// listed reports whether the playlist lists segment msn, or its part part,
+// or anything at all if msn is negative. e.lock must be held.
+func (e *Egress) listed(msn, part int) bool {
+	segments := e.listedSegments()
+	if len(segments) == 0 {
+		return false
+	}
+	if msn < 0 {
+		return true
+	}
+
+	last := segments[len(segments)-1]
+	if uint64(msn) < last.msn {
+		return true
+	}
+	if uint64(msn) > last.msn {
+		return false
+	}
+	if part < 0 {
+		return last.done
+	}
+	return part < len(last.parts) || last.done
+}
+
+// listedSegments returns the segments the playlist lists: the finished ones
+// and, with low latency, the parts of the segment in progress. e.lock must
+// be held.
+func (e *Egress) listedSegments() []*segment {
+	segments := e.segments
+	if n := len(segments); n > 0 && !segments[n-1].done && (!e.LowLatency || len(segments[n-1].parts) == 0) {
+		segments = segments[:n-1]
+	}
+	return segments
+}
+
+// targetDuration is the duration every segment stays under, rounded.
+func (e *Egress) targetDuration() time.Duration {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return time.Duration(e.targetSeconds()) * time.Second
+}
+
+func (e *Egress) targetSeconds() int {
+	target := int(math.Ceil(e.SegmentDuration.Seconds()))
+	for _, s := range e.segments {
+		if d := int(math.Round(s.duration)); d > target {
+			target = d
+		}
+	}
+	return target
+}
+
+// render writes the playlist, with query appended to its URIs. e.lock must
+// be held.
+func (e *Egress) render(query string) []byte {
+	segments := e.listedSegments()
+
+	b := &strings.Builder{}
+	b.WriteString("#EXTM3U\n")
+	if e.LowLatency {
+		b.WriteString("#EXT-X-VERSION:9\n")
+	} else {
+		b.WriteString("#EXT-X-VERSION:7\n")
+	}
+	fmt.Fprintf(b, "#EXT-X-TARGETDURATION:%d\n", e.targetSeconds())
+	if e.LowLatency {
+		partTarget := e.PartDuration.Seconds()
+		fmt.Fprintf(b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", 3*partTarget)
+		fmt.Fprintf(b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", partTarget)
+	}
+	fmt.Fprintf(b, "#EXT-X-MEDIA-SEQUENCE:%d\n", segments[0].msn)
+	fmt.Fprintf(b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", e.discontinuities)
+
+	var current *period
+	for i, s := range segments {
+		if s.discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if s.period != current {
+			current = s.period
+			fmt.Fprintf(b, "#EXT-X-MAP:URI=\"%s-init%d.mp4%s\"\n", e.ID, s.period.id, query)
+		}
+		fmt.Fprintf(b, "#EXT-X-PROGRAM-DATE-TIME:%s\n", s.startedAt.UTC().Format("2006-01-02T15:04:05.000Z07:00"))
+
+		if e.LowLatency && i >= len(segments)-partsListed-1 {
+			for j, p := range s.parts {
+				fmt.Fprintf(b, "#EXT-X-PART:DURATION=%.3f,URI=\"%s-%d.%d.m4s%s\"", p.duration, e.ID, s.msn, j, query)
+				if p.independent {
+					b.WriteString(",INDEPENDENT=YES")
+				}
+				b.WriteString("\n")
+			}
+		}
+
+		if !s.done {
+			fmt.Fprintf(b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%s-%d.%d.m4s%s\"\n", e.ID, s.msn, len(s.parts), query)
+			continue
+		}
+		fmt.Fprintf(b, "#EXTINF:%.3f,\n", s.duration)
+		fmt.Fprintf(b, "%s-%d.m4s%s\n", e.ID, s.msn, query)
+	}
+
+	if e.stopped {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	} else if n := len(e.segments); e.LowLatency && segments[len(segments)-1].done && n > 0 && !e.segments[n-1].done {
+		fmt.Fprintf(b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%s-%d.0.m4s%s\"\n", e.ID, e.segments[n-1].msn, query)
+	}
+	return []byte(b.String())
+}
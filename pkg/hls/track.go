@@ -0,0 +1,146 @@
+package hls
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	w "quick-video/pkg/webrtc"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/samplebuilder"
+)
+
+const (
+	// maxLateVideo and maxLateAudio are how many packets are buffered to put
+	// reordered packets back in order and wait for late ones.
+	maxLateVideo = 256
+	maxLateAudio = 32
+	// maxDelay is how long a packet is waited for before the sample it
+	// belongs to is given up.
+	maxDelay = 500 * time.Millisecond
+	// queueSize is how many packets may wait to be muxed.
+	queueSize = 1024
+)
+
+type packet struct {
+	pkt *rtp.Packet
+	at  time.Time
+}
+
+// trackWriter is the webrtc.TrackLocalWriter of one track of an Egress. It
+// puts the packets back together into samples on a goroutine of its own
+// and hands them to the egress with a decode time on the egress timeline.
+type trackWriter struct {
+	egress *Egress
+	track  *w.Track
+	video  bool
+
+	lock    sync.Mutex
+	closed  bool
+	packets chan packet
+	done    chan struct{}
+
+	builder *samplebuilder.SampleBuilder
+
+	started bool
+	lastTS  uint32
+	dts     uint64
+}
+
+func newTrackWriter(e *Egress, t *w.Track) *trackWriter {
+	video := t.Kind() == webrtc.RTPCodecTypeVideo
+
+	var builder *samplebuilder.SampleBuilder
+	if video {
+		builder = samplebuilder.New(maxLateVideo, &codecs.H264Packet{IsAVC: true}, t.Codec().ClockRate, samplebuilder.WithMaxTimeDelay(maxDelay))
+	} else {
+		builder = samplebuilder.New(maxLateAudio, &codecs.OpusPacket{}, t.Codec().ClockRate, samplebuilder.WithMaxTimeDelay(maxDelay))
+	}
+
+	tw := &trackWriter{
+		egress:  e,
+		track:   t,
+		video:   video,
+		packets: make(chan packet, queueSize),
+		done:    make(chan struct{}),
+		builder: builder,
+	}
+	go tw.run()
+	return tw
+}
+
+func (t *trackWriter) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	pkt := &rtp.Packet{
+		Header:  header.Clone(),
+		Payload: append([]byte(nil), payload...),
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.closed {
+		return 0, os.ErrClosed
+	}
+
+	select {
+	case t.packets <- packet{pkt: pkt, at: time.Now()}:
+	default:
+	}
+	return len(payload), nil
+}
+
+func (t *trackWriter) Write(b []byte) (int, error) {
+	pkt := &rtp.Packet{}
+	if err := pkt.Unmarshal(b); err != nil {
+		return 0, err
+	}
+	return t.WriteRTP(&pkt.Header, pkt.Payload)
+}
+
+// Close stops the writer once the queued packets are muxed.
+func (t *trackWriter) Close() {
+	t.lock.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.packets)
+	}
+	t.lock.Unlock()
+
+	<-t.done
+}
+
+func (t *trackWriter) run() {
+	defer close(t.done)
+
+	for p := range t.packets {
+		t.builder.Push(p.pkt)
+		for {
+			sample, ts := t.builder.PopWithTimestamp()
+			if sample == nil {
+				break
+			}
+
+			// The first sample is placed on the egress timeline by its
+			// arrival, the next ones by their timestamps.
+			if !t.started {
+				t.started = true
+				t.dts = t.egress.since(p.at, t.track.Codec().ClockRate)
+			} else {
+				if int32(ts-t.lastTS) <= 0 {
+					continue
+				}
+				t.dts += uint64(ts - t.lastTS)
+			}
+			t.lastTS = ts
+
+			if t.video {
+				t.egress.writeVideo(t, t.dts, sample.Data)
+			} else {
+				t.egress.writeAudio(t, t.dts, sample.Data)
+			}
+		}
+	}
+}
@@ -0,0 +1,225 @@
+// Package protocol defines the messages exchanged over the signaling socket
+// between the browser and the SFU.
+//
+// Every message is a JSON envelope {"v": 1, "type": "offer", "payload": {...}}.
+// The first message a client sends must be a join listing the protocol
+// versions it speaks; the server answers with a join carrying the version
+// used for the rest of the session, or with an error if there is none in common.
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// Version is the newest protocol version spoken by this package.
+const Version = 1
+
+// SupportedVersions lists every protocol version the server accepts.
+var SupportedVersions = []int{1}
+
+type Type string
+
+const (
+	// TypeJoin opens the session and negotiates the protocol version.
+	TypeJoin Type = "join"
+	// TypeOffer and TypeAnswer carry session descriptions in both directions.
+	TypeOffer  Type = "offer"
+	TypeAnswer Type = "answer"
+	// TypeCandidate carries a trickled ICE candidate in both directions.
+	TypeCandidate Type = "candidate"
+	// TypeLeave ends the session.
+	TypeLeave Type = "leave"
+	// TypeError reports a message that could not be handled.
+	TypeError Type = "error"
+	// TypeRenegotiate asks the server to send a new offer.
+	TypeRenegotiate Type = "renegotiate"
+	// TypeMute announces that a published track was muted or unmuted.
+	TypeMute Type = "mute"
+	// TypeTrackInfo describes the tracks a subscriber is receiving.
+	TypeTrackInfo Type = "track-info"
+	// TypeLayer asks for a simulcast layer of a track.
+	TypeLayer Type = "layer"
+	// TypeQuality reports the quality of the connection measured by the server.
+	TypeQuality Type = "quality"
+)
+
+// Message is the envelope of every signaling message.
+type Message struct {
+	Version int    `json:"v"`
+	Type    Type   `json:"type"`
+	ID      string `json:"id,omitempty"`
+	// Payload is one of the payload types below, matching Type.
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type Join struct {
+	// Versions is sent by the client, listing the versions it speaks.
+	Versions []int `json:"versions,omitempty"`
+	// Version is sent by the server, the version picked for the session.
+	Version int `json:"version,omitempty"`
+}
+
+type SessionDescription struct {
+	SDP string `json:"sdp"`
+}
+
+type Candidate struct {
+	Candidate        string  `json:"candidate"`
+	SDPMid           *string `json:"sdpMid,omitempty"`
+	SDPMLineIndex    *uint16 `json:"sdpMLineIndex,omitempty"`
+	UsernameFragment *string `json:"usernameFragment,omitempty"`
+}
+
+type Leave struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+type Renegotiate struct{}
+
+type Mute struct {
+	TrackID string `json:"trackId"`
+	Muted   bool   `json:"muted"`
+}
+
+type Layer struct {
+	TrackID string `json:"trackId"`
+	// RID is the simulcast layer to receive, empty to let the server pick
+	// the layer from the estimated bandwidth.
+	RID string `json:"rid"`
+}
+
+type TrackInfo struct {
+	Tracks []Track `json:"tracks"`
+}
+
+type Track struct {
+	ID       string `json:"id"`
+	StreamID string `json:"streamId"`
+	Kind     string `json:"kind"`
+	Muted    bool   `json:"muted,omitempty"`
+}
+
+type Quality struct {
+	// Score goes from 1 (unusable) to 5 (excellent), the score of the worst track.
+	Score int `json:"score"`
+	// RTT is the round-trip time of the connection, in milliseconds.
+	RTT    float64        `json:"rtt"`
+	Tracks []TrackQuality `json:"tracks"`
+}
+
+type TrackQuality struct {
+	TrackID string `json:"trackId"`
+	RID     string `json:"rid,omitempty"`
+	Kind    string `json:"kind"`
+	// Direction is inbound for the tracks the client publishes, outbound
+	// for the tracks it receives.
+	Direction string `json:"direction"`
+	Score     int    `json:"score"`
+	// RTT and Jitter are in milliseconds, PacketLoss is the fraction of
+	// the packets lost and Bitrate is in bits per second.
+	RTT        float64 `json:"rtt"`
+	Jitter     float64 `json:"jitter"`
+	PacketLoss float64 `json:"packetLoss"`
+	Bitrate    int     `json:"bitrate"`
+	FrameRate  float64 `json:"frameRate,omitempty"`
+}
+
+// New wraps payload in a message of type t for the current protocol version.
+func New(t Type, payload interface{}) (*Message, error) {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{
+		Version: Version,
+		Type:    t,
+		Payload: raw,
+	}, nil
+}
+
+// Decode parses and validates a raw message against the schema of its
+// envelope and of its payload. The returned error is always an *Error that
+// can be sent back to the peer.
+func Decode(raw []byte) (*Message, error) {
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(raw))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return nil, Errorf(CodeBadMessage, "invalid JSON: %s", err)
+	}
+	if err := schemas["envelope"].validate("message", v); err != nil {
+		return nil, Errorf(CodeBadMessage, "%s", err)
+	}
+
+	m := &Message{}
+	if err := json.Unmarshal(raw, m); err != nil {
+		return nil, Errorf(CodeBadMessage, "%s", err)
+	}
+
+	payload := v.(map[string]interface{})["payload"]
+	if payload == nil {
+		payload = map[string]interface{}{}
+	}
+	if err := schemas[string(m.Type)].validate("payload", payload); err != nil {
+		return m, Errorf(CodeInvalidPayload, "%s", err)
+	}
+	return m, nil
+}
+
+// Unmarshal decodes the payload of m into v.
+func (m *Message) Unmarshal(v interface{}) error {
+	if len(m.Payload) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(m.Payload, v); err != nil {
+		return Errorf(CodeInvalidPayload, "%s", err)
+	}
+	return nil
+}
+
+// Negotiate picks the newest version both the client and the server speak.
+func Negotiate(client []int) (int, error) {
+	best := 0
+	for _, v := range client {
+		for _, s := range SupportedVersions {
+			if v == s && v > best {
+				best = v
+			}
+		}
+	}
+	if best == 0 {
+		return 0, Errorf(CodeUnsupportedVersion, "none of the versions %v is supported, server speaks %v", client, SupportedVersions)
+	}
+	return best, nil
+}
+
+// Error is the payload of an error message.
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Fatal errors are followed by the server closing the socket.
+	Fatal bool `json:"fatal,omitempty"`
+}
+
+const (
+	CodeBadMessage         = "bad_message"
+	CodeInvalidPayload     = "invalid_payload"
+	CodeUnsupportedVersion = "unsupported_version"
+	CodeNotJoined          = "not_joined"
+	CodeUnexpected         = "unexpected_message"
+	CodeForbidden          = "forbidden"
+	CodeInternal           = "internal"
+)
+
+func Errorf(code, format string, args ...interface{}) *Error {
+	return &Error{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+func (e *Error) Error() string {
+	return e.Code + ": " + e.Message
+}
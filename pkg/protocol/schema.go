@@ -0,0 +1,143 @@
+package protocol
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// schemaJSON holds one JSON Schema per message type plus the schema of the
+// envelope. Only the subset of JSON Schema implemented by schema.validate is used.
+//
+//go:embed schema.json
+var schemaJSON []byte
+
+var schemas map[string]*schema
+
+type schema struct {
+	Type       schemaType         `json:"type"`
+	Required   []string           `json:"required"`
+	Properties map[string]*schema `json:"properties"`
+	Items      *schema            `json:"items"`
+	Enum       []string           `json:"enum"`
+	Minimum    *float64           `json:"minimum"`
+	MinLength  *int               `json:"minLength"`
+	MinItems   *int               `json:"minItems"`
+}
+
+// schemaType is the "type" keyword, either a single type name or a list of them.
+type schemaType []string
+
+func (t *schemaType) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err == nil {
+		*t = schemaType{name}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(t))
+}
+
+func init() {
+	if err := json.Unmarshal(schemaJSON, &schemas); err != nil {
+		panic(fmt.Sprintf("protocol: invalid schema.json: %s", err))
+	}
+}
+
+// validate checks v, as decoded by encoding/json with UseNumber, against s.
+// path is used to point at the offending field in the returned error.
+func (s *schema) validate(path string, v interface{}) error {
+	if len(s.Type) > 0 {
+		ok := false
+		for _, t := range s.Type {
+			if isType(t, v) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("%s: must be %s", path, strings.Join(s.Type, " or "))
+		}
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				return fmt.Errorf("%s: missing %q", path, name)
+			}
+		}
+		for name, prop := range s.Properties {
+			if value, ok := v[name]; ok {
+				if err := prop.validate(path+"."+name, value); err != nil {
+					return err
+				}
+			}
+		}
+
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			return fmt.Errorf("%s: must have at least %d items", path, *s.MinItems)
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				if err := s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item); err != nil {
+					return err
+				}
+			}
+		}
+
+	case string:
+		if s.MinLength != nil && len(v) < *s.MinLength {
+			return fmt.Errorf("%s: must be at least %d characters", path, *s.MinLength)
+		}
+		if len(s.Enum) > 0 {
+			for _, e := range s.Enum {
+				if v == e {
+					return nil
+				}
+			}
+			return fmt.Errorf("%s: must be one of %s", path, strings.Join(s.Enum, ", "))
+		}
+
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if s.Minimum != nil && f < *s.Minimum {
+			return fmt.Errorf("%s: must be at least %v", path, *s.Minimum)
+		}
+	}
+	return nil
+}
+
+func isType(name string, v interface{}) bool {
+	switch name {
+	case "object":
+		_, ok := v.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := v.([]interface{})
+		return ok
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "null":
+		return v == nil
+	case "number":
+		_, ok := v.(json.Number)
+		return ok
+	case "integer":
+		n, ok := v.(json.Number)
+		if !ok {
+			return false
+		}
+		_, err := n.Int64()
+		return err == nil
+	}
+	return false
+}
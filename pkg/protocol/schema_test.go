@@ -0,0 +1,101 @@
+package protocol
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDecodeValidates(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		// code is the code of the error, empty if the message is valid.
+		code string
+	}{
+		// The envelope.
+		{"not JSON", `{"v": 1,`, CodeBadMessage},
+		{"not an object", `[1]`, CodeBadMessage},
+		{"no version", `{"type": "leave"}`, CodeBadMessage},
+		{"no type", `{"v": 1}`, CodeBadMessage},
+		{"version as a string", `{"v": "1", "type": "leave"}`, CodeBadMessage},
+		{"fractional version", `{"v": 1.5, "type": "leave"}`, CodeBadMessage},
+		{"version 0", `{"v": 0, "type": "leave"}`, CodeBadMessage},
+		{"unknown type", `{"v": 1, "type": "hello"}`, CodeBadMessage},
+		{"type as a number", `{"v": 1, "type": 1}`, CodeBadMessage},
+		{"id as a number", `{"v": 1, "type": "leave", "id": 1}`, CodeBadMessage},
+		{"payload as a string", `{"v": 1, "type": "leave", "payload": "bye"}`, CodeBadMessage},
+		{"no payload", `{"v": 1, "type": "renegotiate"}`, ""},
+		{"null payload", `{"v": 1, "type": "renegotiate", "payload": null}`, CodeBadMessage},
+		// Unknown fields are left for newer peers to use.
+		{"unknown envelope field", `{"v": 1, "type": "leave", "extra": true}`, ""},
+		{"unknown payload field", `{"v": 1, "type": "leave", "payload": {"extra": true}}`, ""},
+
+		{"join", `{"v": 1, "type": "join", "payload": {"versions": [1, 2]}}`, ""},
+		{"join answer", `{"v": 1, "type": "join", "payload": {"version": 1}}`, ""},
+		{"join without versions", `{"v": 1, "type": "join", "payload": {"versions": []}}`, CodeInvalidPayload},
+		{"join with a string version", `{"v": 1, "type": "join", "payload": {"versions": ["1"]}}`, CodeInvalidPayload},
+		{"join with version 0", `{"v": 1, "type": "join", "payload": {"versions": [0]}}`, CodeInvalidPayload},
+
+		{"offer", `{"v": 1, "type": "offer", "payload": {"sdp": "v=0"}}`, ""},
+		{"offer without sdp", `{"v": 1, "type": "offer", "payload": {}}`, CodeInvalidPayload},
+		{"offer with an empty sdp", `{"v": 1, "type": "offer", "payload": {"sdp": ""}}`, CodeInvalidPayload},
+		{"answer", `{"v": 1, "type": "answer", "payload": {"sdp": "v=0"}}`, ""},
+		{"answer with a numeric sdp", `{"v": 1, "type": "answer", "payload": {"sdp": 0}}`, CodeInvalidPayload},
+
+		{"candidate", `{"v": 1, "type": "candidate", "payload": {"candidate": "candidate:1", "sdpMid": "0", "sdpMLineIndex": 0}}`, ""},
+		{"end of candidates", `{"v": 1, "type": "candidate", "payload": {"candidate": "", "sdpMid": null, "sdpMLineIndex": null}}`, ""},
+		{"candidate without candidate", `{"v": 1, "type": "candidate", "payload": {"sdpMid": "0"}}`, CodeInvalidPayload},
+		{"candidate with a negative index", `{"v": 1, "type": "candidate", "payload": {"candidate": "", "sdpMLineIndex": -1}}`, CodeInvalidPayload},
+		{"candidate with a numeric mid", `{"v": 1, "type": "candidate", "payload": {"candidate": "", "sdpMid": 0}}`, CodeInvalidPayload},
+
+		{"leave", `{"v": 1, "type": "leave", "payload": {"reason": "bye"}}`, ""},
+		{"leave with a numeric reason", `{"v": 1, "type": "leave", "payload": {"reason": 1}}`, CodeInvalidPayload},
+
+		{"error", `{"v": 1, "type": "error", "payload": {"code": "internal", "message": "oops"}}`, ""},
+		{"error without message", `{"v": 1, "type": "error", "payload": {"code": "internal"}}`, CodeInvalidPayload},
+
+		{"renegotiate", `{"v": 1, "type": "renegotiate", "payload": {}}`, ""},
+
+		{"mute", `{"v": 1, "type": "mute", "payload": {"trackId": "t", "muted": true}}`, ""},
+		{"mute without muted", `{"v": 1, "type": "mute", "payload": {"trackId": "t"}}`, CodeInvalidPayload},
+		{"mute with a string muted", `{"v": 1, "type": "mute", "payload": {"trackId": "t", "muted": "true"}}`, CodeInvalidPayload},
+		{"mute with an empty track", `{"v": 1, "type": "mute", "payload": {"trackId": "", "muted": true}}`, CodeInvalidPayload},
+
+		{"layer", `{"v": 1, "type": "layer", "payload": {"trackId": "t", "rid": "h"}}`, ""},
+		{"automatic layer", `{"v": 1, "type": "layer", "payload": {"trackId": "t", "rid": ""}}`, ""},
+		{"layer without rid", `{"v": 1, "type": "layer", "payload": {"trackId": "t"}}`, CodeInvalidPayload},
+		{"layer with a null rid", `{"v": 1, "type": "layer", "payload": {"trackId": "t", "rid": null}}`, CodeInvalidPayload},
+
+		{"track-info", `{"v": 1, "type": "track-info", "payload": {"tracks": [{"id": "t", "streamId": "s", "kind": "video"}]}}`, ""},
+		{"track-info without tracks", `{"v": 1, "type": "track-info", "payload": {}}`, CodeInvalidPayload},
+		{"track-info with an unknown kind", `{"v": 1, "type": "track-info", "payload": {"tracks": [{"id": "t", "streamId": "s", "kind": "text"}]}}`, CodeInvalidPayload},
+		{"track-info with a track as a string", `{"v": 1, "type": "track-info", "payload": {"tracks": ["t"]}}`, CodeInvalidPayload},
+
+		{"quality", `{"v": 1, "type": "quality", "payload": {"score": 5, "rtt": 12.5, "tracks": [{"trackId": "t", "kind": "audio", "direction": "inbound", "score": 4, "packetLoss": 0.01}]}}`, ""},
+		{"quality with score 0", `{"v": 1, "type": "quality", "payload": {"score": 0, "rtt": 0, "tracks": []}}`, CodeInvalidPayload},
+		{"quality with a negative rtt", `{"v": 1, "type": "quality", "payload": {"score": 1, "rtt": -1, "tracks": []}}`, CodeInvalidPayload},
+		{"quality with an unknown direction", `{"v": 1, "type": "quality", "payload": {"score": 1, "rtt": 0, "tracks": [{"trackId": "t", "kind": "audio", "direction": "up", "score": 1}]}}`, CodeInvalidPayload},
+		{"quality with a fractional bitrate", `{"v": 1, "type": "quality", "payload": {"score": 1, "rtt": 0, "tracks": [{"trackId": "t", "kind": "audio", "direction": "inbound", "score": 1, "bitrate": 1.5}]}}`, CodeInvalidPayload},
+	}
+
+	for _, tt := range tests {
+		m, err := Decode([]byte(tt.raw))
+		if tt.code == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			} else if m == nil {
+				t.Errorf("%s: no message", tt.name)
+			}
+			continue
+		}
+
+		var perr *Error
+		if !errors.As(err, &perr) {
+			t.Errorf("%s: got %v, want a %s error", tt.name, err, tt.code)
+			continue
+		}
+		if perr.Code != tt.code {
+			t.Errorf("%s: got %v, want a %s error", tt.name, err, tt.code)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package recorder
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// Composition is the timeline of a recording, laid out as a grid of the
+// participants present at each moment. All times are in seconds from the
+// start of the recording.
+type Composition struct {
+	Room         string        `json:"room"`
+	StartedAt    time.Time     `json:"startedAt"`
+	Duration     float64       `json:"duration"`
+	Participants []Participant `json:"participants"`
+	// Segments split the timeline wherever a participant joins or leaves,
+	// each segment is rendered with one grid.
+	Segments []Segment `json:"segments"`
+	// Audio is the file all the audio tracks are mixed into, if any.
+	Audio string `json:"audio,omitempty"`
+}
+
+type Participant struct {
+	StreamID string  `json:"streamId"`
+	JoinedAt float64 `json:"joinedAt"`
+	LeftAt   float64 `json:"leftAt"`
+	Video    []Clip  `json:"video"`
+	Audio    []Clip  `json:"audio"`
+}
+
+// Clip places a track recording on the timeline.
+type Clip struct {
+	File  string  `json:"file"`
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+	// Rate is how many seconds of the file are played per second of the
+	// timeline, correcting the drift of the publisher's clock.
+	Rate float64 `json:"rate"`
+}
+
+type Segment struct {
+	Start   float64 `json:"start"`
+	End     float64 `json:"end"`
+	Columns int     `json:"columns"`
+	Rows    int     `json:"rows"`
+	Cells   []Cell  `json:"cells"`
+}
+
+// Cell is the place of a participant in the grid of a segment.
+type Cell struct {
+	StreamID string `json:"streamId"`
+	Column   int    `json:"column"`
+	Row      int    `json:"row"`
+	// Video is the video file shown in the cell, starting Offset seconds
+	// into the file. It is empty while the participant publishes no video.
+	Video  string  `json:"video,omitempty"`
+	Offset float64 `json:"offset,omitempty"`
+}
+
+// Compose lays the tracks of the recording described by m out on a timeline.
+func Compose(m *Metadata) *Composition {
+	c := &Composition{
+		Room:         m.Room,
+		StartedAt:    m.StartedAt,
+		Participants: []Participant{},
+		Segments:     []Segment{},
+	}
+
+	index := map[string]int{}
+	for _, t := range m.Tracks {
+		if t.Samples == 0 {
+			continue
+		}
+
+		clip := Clip{
+			File:  t.File,
+			Start: t.StartedAt.Sub(m.StartedAt).Seconds(),
+			End:   t.EndedAt.Sub(m.StartedAt).Seconds(),
+			Rate:  rate(t),
+		}
+
+		i, ok := index[t.StreamID]
+		if !ok {
+			i = len(c.Participants)
+			index[t.StreamID] = i
+			c.Participants = append(c.Participants, Participant{
+				StreamID: t.StreamID,
+				JoinedAt: clip.Start,
+				LeftAt:   clip.End,
+				Video:    []Clip{},
+				Audio:    []Clip{},
+			})
+		}
+
+		p := &c.Participants[i]
+		p.JoinedAt = math.Min(p.JoinedAt, clip.Start)
+		p.LeftAt = math.Max(p.LeftAt, clip.End)
+		if t.Kind == "video" {
+			p.Video = append(p.Video, clip)
+		} else {
+			p.Audio = append(p.Audio, clip)
+		}
+		c.Duration = math.Max(c.Duration, clip.End)
+	}
+
+	sort.SliceStable(c.Participants, func(i, j int) bool {
+		return c.Participants[i].JoinedAt < c.Participants[j].JoinedAt
+	})
+
+	c.Segments = segments(c.Participants)
+	return c
+}
+
+// rate estimates the drift of a track from its first and last sync points.
+func rate(t TrackMetadata) float64 {
+	if len(t.SyncPoints) < 2 || t.ClockRate == 0 {
+		return 1
+	}
+
+	first, last := t.SyncPoints[0], t.SyncPoints[len(t.SyncPoints)-1]
+	wall := last.Time.Sub(first.Time).Seconds()
+	if wall <= 0 {
+		return 1
+	}
+	return float64(last.Timestamp-first.Timestamp) / float64(t.ClockRate) / wall
+}
+
+func segments(participants []Participant) []Segment {
+	var bounds []float64
+	for _, p := range participants {
+		bounds = append(bounds, p.JoinedAt, p.LeftAt)
+		for _, clip := range p.Video {
+			bounds = append(bounds, clip.Start, clip.End)
+		}
+	}
+	sort.Float64s(bounds)
+
+	segments := []Segment{}
+	for i := 0; i+1 < len(bounds); i++ {
+		start, end := bounds[i], bounds[i+1]
+		if end <= start {
+			continue
+		}
+
+		var cells []Cell
+		for _, p := range participants {
+			if p.JoinedAt > start || p.LeftAt < end {
+				continue
+			}
+
+			cell := Cell{StreamID: p.StreamID}
+			for _, clip := range p.Video {
+				if clip.Start <= start && clip.End >= end {
+					cell.Video = clip.File
+					cell.Offset = (start - clip.Start) * clip.Rate
+					break
+				}
+			}
+			cells = append(cells, cell)
+		}
+		if len(cells) == 0 {
+			continue
+		}
+
+		columns := int(math.Ceil(math.Sqrt(float64(len(cells)))))
+		for j := range cells {
+			cells[j].Column, cells[j].Row = j%columns, j/columns
+		}
+		segments = append(segments, Segment{
+			Start:   start,
+			End:     end,
+			Columns: columns,
+			Rows:    (len(cells) + columns - 1) / columns,
+			Cells:   cells,
+		})
+	}
+	return segments
+}
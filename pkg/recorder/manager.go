@@ -0,0 +1,69 @@
+package recorder
+
+import (
+	"errors"
+	"sync"
+
+	w "quick-video/pkg/webrtc"
+)
+
+var (
+	ErrRecording    = errors.New("room is already being recorded")
+	ErrNotRecording = errors.New("room is not being recorded")
+)
+
+// Manager keeps track of the recording of every room, writing them to Dir.
+type Manager struct {
+	Dir string
+
+	lock       sync.Mutex
+	recordings map[string]*Recorder
+}
+
+func NewManager(dir string) *Manager {
+	return &Manager{
+		Dir:        dir,
+		recordings: make(map[string]*Recorder),
+	}
+}
+
+// Start starts recording room.
+func (m *Manager) Start(room *w.Room) (*Recorder, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.recordings[room.ID]; ok {
+		return nil, ErrRecording
+	}
+
+	r, err := New(m.Dir, room)
+	if err != nil {
+		return nil, err
+	}
+	r.Start()
+
+	m.recordings[room.ID] = r
+	return r, nil
+}
+
+// Stop stops recording the room with the given ID.
+func (m *Manager) Stop(roomID string) (*Metadata, error) {
+	m.lock.Lock()
+	r, ok := m.recordings[roomID]
+	delete(m.recordings, roomID)
+	m.lock.Unlock()
+
+	if !ok {
+		return nil, ErrNotRecording
+	}
+	return r.Stop()
+}
+
+// Get returns the recorder of the room with the given ID, if it is being recorded.
+func (m *Manager) Get(roomID string) (*Recorder, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	r, ok := m.recordings[roomID]
+	return r, ok
+}
@@ -0,0 +1,248 @@
+package recorder
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// ivfClockRate is the time base of the IVF files, the RTP clock rate of video.
+const ivfClockRate = 90000
+
+// ivfWriter writes VP8 or VP9 frames to an IVF file, with the RTP timestamps
+// as presentation timestamps so that gaps in the recording are kept.
+type ivfWriter struct {
+	f             *os.File
+	frames        uint32
+	width, height uint16
+	vp8           bool
+}
+
+func newIVFWriter(f *os.File, mimeType string) (*ivfWriter, error) {
+	i := &ivfWriter{f: f, vp8: strings.EqualFold(mimeType, webrtc.MimeTypeVP8)}
+
+	fourcc := "VP90"
+	if i.vp8 {
+		fourcc = "VP80"
+	}
+
+	header := make([]byte, 32)
+	copy(header[0:], "DKIF")
+	binary.LittleEndian.PutUint16(header[4:], 0)  // Version
+	binary.LittleEndian.PutUint16(header[6:], 32) // Header size
+	copy(header[8:], fourcc)
+	// Width, height and frame count are filled in on Close.
+	binary.LittleEndian.PutUint32(header[16:], ivfClockRate) // Time base denominator
+	binary.LittleEndian.PutUint32(header[20:], 1)            // Time base numerator
+
+	if _, err := f.Write(header); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+func (i *ivfWriter) WriteSample(pts uint64, frame []byte) error {
+	if i.vp8 && i.width == 0 && len(frame) >= 10 && frame[0]&0x01 == 0 {
+		// Key frames carry the frame size after the 3 byte start code.
+		i.width = binary.LittleEndian.Uint16(frame[6:]) & 0x3fff
+		i.height = binary.LittleEndian.Uint16(frame[8:]) & 0x3fff
+	}
+
+	header := make([]byte, 12)
+	binary.LittleEndian.PutUint32(header[0:], uint32(len(frame)))
+	binary.LittleEndian.PutUint64(header[4:], pts)
+
+	if _, err := i.f.Write(header); err != nil {
+		return err
+	}
+	if _, err := i.f.Write(frame); err != nil {
+		return err
+	}
+	i.frames++
+	return nil
+}
+
+func (i *ivfWriter) Close() error {
+	header := make([]byte, 4)
+	binary.LittleEndian.PutUint16(header[0:], i.width)
+	binary.LittleEndian.PutUint16(header[2:], i.height)
+	if _, err := i.f.WriteAt(header, 12); err != nil {
+		i.f.Close()
+		return err
+	}
+
+	binary.LittleEndian.PutUint32(header, i.frames)
+	if _, err := i.f.WriteAt(header, 24); err != nil {
+		i.f.Close()
+		return err
+	}
+	return i.f.Close()
+}
+
+// oggWriter writes Opus packets to an Ogg file, one page per packet. The
+// granule position of a page is the pts of the end of its packet, so that
+// gaps in the recording are kept as with IVF.
+type oggWriter struct {
+	f         *os.File
+	clockRate uint32
+	serial    uint32
+	pages     uint32
+	// last is the last page written, at offset, marked as the end of the
+	// stream on Close.
+	last   []byte
+	offset int64
+}
+
+// opusSampleRate is the rate of the Ogg Opus granule positions.
+const opusSampleRate = 48000
+
+func newOggWriter(f *os.File, clockRate uint32, channels uint16) (*oggWriter, error) {
+	if channels == 0 {
+		channels = 2
+	}
+	if clockRate == 0 {
+		clockRate = opusSampleRate
+	}
+
+	var serial [4]byte
+	if _, err := rand.Read(serial[:]); err != nil {
+		return nil, err
+	}
+	o := &oggWriter{f: f, clockRate: clockRate, serial: binary.LittleEndian.Uint32(serial[:])}
+
+	// The encoder delay is not known, so no samples are skipped.
+	head := make([]byte, 19)
+	copy(head, "OpusHead")
+	head[8] = 1 // Version
+	head[9] = byte(channels)
+	binary.LittleEndian.PutUint16(head[10:], 0)         // Pre-skip
+	binary.LittleEndian.PutUint32(head[12:], clockRate) // Input sample rate
+	if err := o.writePage(head, oggBeginningOfStream, 0); err != nil {
+		return nil, err
+	}
+
+	vendor := "quick-video"
+	tags := make([]byte, 8+4+len(vendor)+4)
+	copy(tags, "OpusTags")
+	binary.LittleEndian.PutUint32(tags[8:], uint32(len(vendor)))
+	copy(tags[12:], vendor)
+	if err := o.writePage(tags, 0, 0); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (o *oggWriter) WriteSample(pts uint64, packet []byte) error {
+	if len(packet) == 0 {
+		return nil
+	}
+	granule := pts*opusSampleRate/uint64(o.clockRate) + opusSamples(packet)
+	return o.writePage(packet, 0, granule)
+}
+
+func (o *oggWriter) Close() error {
+	o.last[5] |= oggEndOfStream
+	binary.LittleEndian.PutUint32(o.last[22:], 0)
+	binary.LittleEndian.PutUint32(o.last[22:], oggChecksum(o.last))
+	if _, err := o.f.WriteAt(o.last, o.offset); err != nil {
+		o.f.Close()
+		return err
+	}
+	return o.f.Close()
+}
+
+// Header types of the Ogg pages.
+const (
+	oggBeginningOfStream = 0x02
+	oggEndOfStream       = 0x04
+)
+
+// maxOggPacket is the largest packet a page holds, in 255 lacing values.
+const maxOggPacket = 255*255 - 1
+
+func (o *oggWriter) writePage(packet []byte, headerType byte, granule uint64) error {
+	if len(packet) > maxOggPacket {
+		return fmt.Errorf("ogg: packet of %d bytes", len(packet))
+	}
+
+	segments := len(packet)/255 + 1
+	page := make([]byte, 27+segments+len(packet))
+	copy(page, "OggS")
+	page[5] = headerType
+	binary.LittleEndian.PutUint64(page[6:], granule)
+	binary.LittleEndian.PutUint32(page[14:], o.serial)
+	binary.LittleEndian.PutUint32(page[18:], o.pages)
+	page[26] = byte(segments)
+	for i := 0; i < segments-1; i++ {
+		page[27+i] = 255
+	}
+	page[27+segments-1] = byte(len(packet) % 255)
+	copy(page[27+segments:], packet)
+	binary.LittleEndian.PutUint32(page[22:], oggChecksum(page))
+
+	offset, err := o.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := o.f.Write(page); err != nil {
+		return err
+	}
+	o.pages++
+	o.last, o.offset = page, offset
+	return nil
+}
+
+var oggCRCTable = func() (table [256]uint32) {
+	for i := range table {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+		table[i] = r
+	}
+	return table
+}()
+
+// oggChecksum is the CRC of an Ogg page whose checksum field is zero.
+func oggChecksum(page []byte) uint32 {
+	var crc uint32
+	for _, b := range page {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	return crc
+}
+
+// opusSamples returns the duration of an Opus packet at 48 kHz, from its
+// TOC byte (RFC 6716, section 3.1).
+func opusSamples(packet []byte) uint64 {
+	config := packet[0] >> 3
+	var frame uint64
+	switch {
+	case config < 12: // SILK: 10, 20, 40 or 60 ms
+		frame = [...]uint64{480, 960, 1920, 2880}[config%4]
+	case config < 16: // Hybrid: 10 or 20 ms
+		frame = [...]uint64{480, 960}[config%2]
+	default: // CELT: 2.5, 5, 10 or 20 ms
+		frame = [...]uint64{120, 240, 480, 960}[config%4]
+	}
+
+	switch packet[0] & 0x03 {
+	case 0:
+		return frame
+	case 1, 2:
+		return 2 * frame
+	}
+	if len(packet) < 2 {
+		return 0
+	}
+	return uint64(packet[1]&0x3f) * frame
+}
@@ -0,0 +1,147 @@
+package recorder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type oggPage struct {
+	headerType byte
+	granule    uint64
+	sequence   uint32
+	packet     []byte
+}
+
+// readOggPages reads back the pages of an Ogg file of one packet per page.
+func readOggPages(t *testing.T, b []byte) []oggPage {
+	t.Helper()
+
+	var pages []oggPage
+	for len(b) > 0 {
+		if len(b) < 27 || string(b[:4]) != "OggS" {
+			t.Fatalf("page %d: no page header", len(pages))
+		}
+		segments := int(b[26])
+		size := 0
+		for _, lacing := range b[27 : 27+segments] {
+			size += int(lacing)
+		}
+		n := 27 + segments + size
+		page := append([]byte(nil), b[:n]...)
+
+		checksum := binary.LittleEndian.Uint32(page[22:])
+		binary.LittleEndian.PutUint32(page[22:], 0)
+		if oggChecksum(page) != checksum {
+			t.Errorf("page %d: bad checksum", len(pages))
+		}
+
+		pages = append(pages, oggPage{
+			headerType: page[5],
+			granule:    binary.LittleEndian.Uint64(page[6:]),
+			sequence:   binary.LittleEndian.Uint32(page[18:]),
+			packet:     page[27+segments:],
+		})
+		b = b[n:]
+	}
+	return pages
+}
+
+func TestOggGranules(t *testing.T) {
+	const (
+		celt20ms  = 19 << 3
+		silk60ms  = 3 << 3
+		twoFrames = 1
+	)
+
+	tests := []struct {
+		name    string
+		pts     []uint64
+		packets [][]byte
+		want    []uint64
+	}{
+		{
+			name:    "contiguous",
+			pts:     []uint64{0, 960, 1920},
+			packets: [][]byte{{celt20ms, 1}, {celt20ms, 2}, {celt20ms, 3}},
+			want:    []uint64{960, 1920, 2880},
+		},
+		{
+			name:    "gap",
+			pts:     []uint64{0, 960, 9600},
+			packets: [][]byte{{celt20ms, 1}, {celt20ms, 2}, {celt20ms, 3}},
+			want:    []uint64{960, 1920, 10560},
+		},
+		{
+			name:    "durations",
+			pts:     []uint64{0, 1920, 4800},
+			packets: [][]byte{{celt20ms | twoFrames, 1}, {silk60ms, 2}, {celt20ms, 3}},
+			want:    []uint64{1920, 4800, 5760},
+		},
+		{
+			name:    "one packet",
+			pts:     []uint64{0},
+			packets: [][]byte{bytes.Repeat([]byte{celt20ms}, 600)},
+			want:    []uint64{960},
+		},
+	}
+
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "audio.ogg")
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		o, err := newOggWriter(f, 48000, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, pts := range tt.pts {
+			if err := o.WriteSample(pts, tt.packets[i]); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+		}
+		if err := o.Close(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages := readOggPages(t, b)
+		if len(pages) != 2+len(tt.want) {
+			t.Errorf("%s: %d pages, want %d", tt.name, len(pages), 2+len(tt.want))
+			continue
+		}
+
+		if !bytes.HasPrefix(pages[0].packet, []byte("OpusHead")) || pages[0].headerType != oggBeginningOfStream {
+			t.Errorf("%s: first page is not the beginning of an Opus stream", tt.name)
+		}
+		if !bytes.HasPrefix(pages[1].packet, []byte("OpusTags")) {
+			t.Errorf("%s: second page is not the Opus tags", tt.name)
+		}
+		for i, page := range pages {
+			if page.sequence != uint32(i) {
+				t.Errorf("%s: page %d has sequence number %d", tt.name, i, page.sequence)
+			}
+			if i < 2 {
+				if page.granule != 0 {
+					t.Errorf("%s: header page %d has granule %d", tt.name, i, page.granule)
+				}
+				continue
+			}
+			if page.granule != tt.want[i-2] {
+				t.Errorf("%s: packet %d has granule %d, want %d", tt.name, i-2, page.granule, tt.want[i-2])
+			}
+			if !bytes.Equal(page.packet, tt.packets[i-2]) {
+				t.Errorf("%s: packet %d was not kept", tt.name, i-2)
+			}
+			if last := i == len(pages)-1; last != (page.headerType == oggEndOfStream) {
+				t.Errorf("%s: page %d has header type %d", tt.name, i, page.headerType)
+			}
+		}
+	}
+}
@@ -0,0 +1,218 @@
+// Package recorder records the tracks published in a room to disk.
+//
+// Every track is written to its own file, VP8 and VP9 video to IVF and Opus
+// audio to Ogg, next to a metadata file describing when each track started
+// and how its timestamps map to the wall clock, so that the tracks of a
+// recording can be aligned again afterwards.
+package recorder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	w "quick-video/pkg/webrtc"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// MetadataFile is the name of the metadata file written in the directory of a recording.
+const MetadataFile = "recording.json"
+
+type Metadata struct {
+	Room      string          `json:"room"`
+	StartedAt time.Time       `json:"startedAt"`
+	StoppedAt *time.Time      `json:"stoppedAt,omitempty"`
+	Tracks    []TrackMetadata `json:"tracks"`
+}
+
+type TrackMetadata struct {
+	ID string `json:"id"`
+	// StreamID identifies the participant that published the track.
+	StreamID  string `json:"streamId"`
+	Kind      string `json:"kind"`
+	MimeType  string `json:"mimeType"`
+	ClockRate uint32 `json:"clockRate"`
+	Channels  uint16 `json:"channels,omitempty"`
+	// File is the path of the track recording, relative to the metadata file.
+	File string `json:"file"`
+
+	// StartedAt and EndedAt are the arrival times of the first and last
+	// sample written to File.
+	StartedAt time.Time `json:"startedAt"`
+	EndedAt   time.Time `json:"endedAt"`
+	// SyncPoints map timestamps in File to arrival times, to correct the
+	// drift between the clock of the publisher and the clock of the server.
+	SyncPoints []SyncPoint `json:"syncPoints"`
+
+	Samples int `json:"samples"`
+	// Dropped counts the packets that could not be written fast enough.
+	Dropped int `json:"dropped"`
+}
+
+type SyncPoint struct {
+	Time time.Time `json:"time"`
+	// Timestamp is in units of the clock rate, relative to the first sample.
+	Timestamp uint64 `json:"timestamp"`
+}
+
+// ReadMetadata reads the metadata of the recording in dir.
+func ReadMetadata(dir string) (*Metadata, error) {
+	raw, err := os.ReadFile(filepath.Join(dir, MetadataFile))
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Metadata{}
+	if err := json.Unmarshal(raw, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Recorder records the tracks of one room. It is a webrtc.Sink.
+type Recorder struct {
+	Room      string
+	Dir       string
+	StartedAt time.Time
+
+	peers *w.Peers
+
+	lock      sync.Mutex
+	count     int
+	stoppedAt *time.Time
+	tracks    map[*w.Track]*trackWriter
+	finished  []TrackMetadata
+
+	// metadataLock serializes the writes of the metadata file.
+	metadataLock sync.Mutex
+}
+
+// New creates a recorder writing the tracks of room to a new directory in dir.
+func New(dir string, room *w.Room) (*Recorder, error) {
+	// The room ID comes from the client creating the room.
+	name := unsafeChars.ReplaceAllString(room.ID, "_")
+	if name == "" {
+		return nil, errors.New("recorder: room without an ID")
+	}
+
+	now := time.Now()
+	dir = filepath.Join(dir, name, now.UTC().Format("20060102T150405Z"))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	return &Recorder{
+		Room:      room.ID,
+		Dir:       dir,
+		StartedAt: now,
+		peers:     room.Peers,
+		tracks:    make(map[*w.Track]*trackWriter),
+	}, nil
+}
+
+// Start records every track published in the room until Stop is called.
+func (r *Recorder) Start() {
+	r.peers.Attach(r)
+}
+
+// Stop finishes the recording and writes its metadata.
+func (r *Recorder) Stop() (*Metadata, error) {
+	r.peers.Detach(r)
+
+	r.lock.Lock()
+	if r.stoppedAt == nil {
+		now := time.Now()
+		r.stoppedAt = &now
+	}
+	r.lock.Unlock()
+
+	m := r.Metadata()
+	return m, r.writeMetadata(m)
+}
+
+// Metadata describes the recording so far.
+func (r *Recorder) Metadata() *Metadata {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	m := &Metadata{
+		Room:      r.Room,
+		StartedAt: r.StartedAt,
+		StoppedAt: r.stoppedAt,
+		Tracks:    append([]TrackMetadata{}, r.finished...),
+	}
+	for _, t := range r.tracks {
+		m.Tracks = append(m.Tracks, t.metadata())
+	}
+	return m
+}
+
+var unsafeChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+func (r *Recorder) AddTrack(t *w.Track) webrtc.TrackLocalWriter {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.stoppedAt != nil {
+		return nil
+	}
+
+	r.count++
+	name := fmt.Sprintf("%02d-%s-%s", r.count, unsafeChars.ReplaceAllString(t.StreamID(), "_"), unsafeChars.ReplaceAllString(t.ID(), "_"))
+	tw, err := newTrackWriter(r.Dir, name, t)
+	if err != nil {
+		log.Printf("not recording track %s of room %s: %s", t.ID(), r.Room, err)
+		return nil
+	}
+
+	r.tracks[t] = tw
+	return tw
+}
+
+func (r *Recorder) RemoveTrack(t *w.Track) {
+	r.lock.Lock()
+	tw, ok := r.tracks[t]
+	delete(r.tracks, t)
+	r.lock.Unlock()
+
+	if !ok {
+		return
+	}
+
+	if err := tw.Close(); err != nil {
+		log.Println(err)
+	}
+
+	r.lock.Lock()
+	r.finished = append(r.finished, tw.metadata())
+	r.lock.Unlock()
+
+	// Keep the metadata on disk up to date, in case the server stops
+	// before the recording does.
+	if err := r.writeMetadata(r.Metadata()); err != nil {
+		log.Println(err)
+	}
+}
+
+func (r *Recorder) writeMetadata(m *Metadata) error {
+	r.metadataLock.Lock()
+	defer r.metadataLock.Unlock()
+
+	raw, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(r.Dir, MetadataFile+".tmp")
+	if err := os.WriteFile(tmp, raw, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(r.Dir, MetadataFile))
+}
@@ -0,0 +1,49 @@
+package recorder
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"quick-video/pkg/chat"
+	w "quick-video/pkg/webrtc"
+)
+
+func TestNewStaysInDir(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"room", "room"},
+		{"../../etc", "_etc"},
+		{"a/b", "a_b"},
+		{"..", "_"},
+		{"/abs", "_abs"},
+	}
+
+	for _, tt := range tests {
+		dir := t.TempDir()
+		room := w.NewRoom(tt.id, "stream", chat.Options{})
+		r, err := New(dir, room)
+		room.Hub.Stop()
+		if err != nil {
+			t.Errorf("%q: %v", tt.id, err)
+			continue
+		}
+
+		rel, err := filepath.Rel(dir, r.Dir)
+		if err != nil || strings.Count(rel, string(filepath.Separator)) != 1 {
+			t.Errorf("%q: recording to %s, outside %s", tt.id, r.Dir, dir)
+			continue
+		}
+		if got := filepath.Dir(rel); got != tt.want {
+			t.Errorf("%q: recording to %s, want %s", tt.id, got, tt.want)
+		}
+	}
+
+	room := w.NewRoom("", "stream", chat.Options{})
+	defer room.Hub.Stop()
+	if _, err := New(t.TempDir(), room); err == nil {
+		t.Error("recording a room without an ID")
+	}
+}
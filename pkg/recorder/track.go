@@ -0,0 +1,236 @@
+package recorder
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	w "quick-video/pkg/webrtc"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/samplebuilder"
+)
+
+const (
+	// maxLateVideo and maxLateAudio are how many packets are buffered to put
+	// reordered packets back in order and wait for late ones.
+	maxLateVideo = 256
+	maxLateAudio = 32
+	// maxDelay is how long a packet is waited for before the sample it
+	// belongs to is given up.
+	maxDelay = time.Second
+	// syncInterval is how often a sync point is added to the metadata.
+	syncInterval = 5 * time.Second
+	// queueSize is how many packets may wait to be written to disk.
+	queueSize = 1024
+)
+
+var ErrUnsupportedCodec = errors.New("codec cannot be recorded")
+
+// mediaWriter writes samples to a container. pts is in units of the clock
+// rate of the track, relative to the first sample.
+type mediaWriter interface {
+	WriteSample(pts uint64, data []byte) error
+	Close() error
+}
+
+type packet struct {
+	pkt *rtp.Packet
+	at  time.Time
+}
+
+// trackWriter is the webrtc.TrackLocalWriter recording one track. Packets are
+// queued and written to disk by a goroutine of their own, so that a slow
+// disk never holds back the forwarding of the track.
+type trackWriter struct {
+	lock    sync.Mutex
+	closed  bool
+	packets chan packet
+	done    chan struct{}
+
+	builder  *samplebuilder.SampleBuilder
+	media    mediaWriter
+	arrivals map[uint32]time.Time
+
+	started  bool
+	lastTS   uint32
+	pts      uint64
+	lastSync time.Time
+
+	metaLock sync.Mutex
+	meta     TrackMetadata
+}
+
+func newTrackWriter(dir, name string, t *w.Track) (*trackWriter, error) {
+	codec := t.Codec()
+
+	var (
+		depacketizer rtp.Depacketizer
+		maxLate      uint16
+		ext          string
+	)
+	switch {
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeVP8):
+		depacketizer, maxLate, ext = &codecs.VP8Packet{}, maxLateVideo, ".ivf"
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeVP9):
+		depacketizer, maxLate, ext = &codecs.VP9Packet{}, maxLateVideo, ".ivf"
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeOpus):
+		depacketizer, maxLate, ext = &codecs.OpusPacket{}, maxLateAudio, ".ogg"
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedCodec, codec.MimeType)
+	}
+
+	f, err := os.Create(filepath.Join(dir, name+ext))
+	if err != nil {
+		return nil, err
+	}
+
+	var media mediaWriter
+	if ext == ".ivf" {
+		media, err = newIVFWriter(f, codec.MimeType)
+	} else {
+		media, err = newOggWriter(f, codec.ClockRate, codec.Channels)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	tw := &trackWriter{
+		packets:  make(chan packet, queueSize),
+		done:     make(chan struct{}),
+		builder:  samplebuilder.New(maxLate, depacketizer, codec.ClockRate, samplebuilder.WithMaxTimeDelay(maxDelay)),
+		media:    media,
+		arrivals: make(map[uint32]time.Time),
+		meta: TrackMetadata{
+			ID:         t.ID(),
+			StreamID:   t.StreamID(),
+			Kind:       t.Kind().String(),
+			MimeType:   codec.MimeType,
+			ClockRate:  codec.ClockRate,
+			Channels:   codec.Channels,
+			File:       name + ext,
+			SyncPoints: []SyncPoint{},
+		},
+	}
+	go tw.run()
+	return tw, nil
+}
+
+func (t *trackWriter) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	pkt := &rtp.Packet{
+		Header:  header.Clone(),
+		Payload: append([]byte(nil), payload...),
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.closed {
+		return 0, os.ErrClosed
+	}
+
+	select {
+	case t.packets <- packet{pkt: pkt, at: time.Now()}:
+	default:
+		t.metaLock.Lock()
+		t.meta.Dropped++
+		t.metaLock.Unlock()
+	}
+	return len(payload), nil
+}
+
+func (t *trackWriter) Write(b []byte) (int, error) {
+	pkt := &rtp.Packet{}
+	if err := pkt.Unmarshal(b); err != nil {
+		return 0, err
+	}
+	return t.WriteRTP(&pkt.Header, pkt.Payload)
+}
+
+// Close writes the queued packets and closes the file.
+func (t *trackWriter) Close() error {
+	t.lock.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.packets)
+	}
+	t.lock.Unlock()
+
+	<-t.done
+	return t.media.Close()
+}
+
+func (t *trackWriter) metadata() TrackMetadata {
+	t.metaLock.Lock()
+	defer t.metaLock.Unlock()
+
+	m := t.meta
+	m.SyncPoints = append([]SyncPoint{}, t.meta.SyncPoints...)
+	return m
+}
+
+func (t *trackWriter) run() {
+	defer close(t.done)
+
+	for p := range t.packets {
+		if _, ok := t.arrivals[p.pkt.Timestamp]; !ok {
+			t.arrivals[p.pkt.Timestamp] = p.at
+		}
+
+		t.builder.Push(p.pkt)
+		for {
+			sample, ts := t.builder.PopWithTimestamp()
+			if sample == nil {
+				break
+			}
+			t.writeSample(ts, sample.Data)
+		}
+	}
+}
+
+func (t *trackWriter) writeSample(ts uint32, data []byte) {
+	at, ok := t.arrivals[ts]
+	if !ok {
+		at = time.Now()
+	}
+	// Forget the arrival of this sample and of the samples given up before it.
+	for k := range t.arrivals {
+		if int32(k-ts) <= 0 {
+			delete(t.arrivals, k)
+		}
+	}
+
+	if t.started {
+		if int32(ts-t.lastTS) <= 0 {
+			return
+		}
+		t.pts += uint64(ts - t.lastTS)
+	}
+	t.lastTS = ts
+
+	if err := t.media.WriteSample(t.pts, data); err != nil {
+		return
+	}
+
+	t.metaLock.Lock()
+	defer t.metaLock.Unlock()
+
+	if !t.started {
+		t.started = true
+		t.meta.StartedAt = at
+	}
+	t.meta.EndedAt = at
+	t.meta.Samples++
+
+	if at.Sub(t.lastSync) >= syncInterval {
+		t.lastSync = at
+		t.meta.SyncPoints = append(t.meta.SyncPoints, SyncPoint{Time: at, Timestamp: t.pts})
+	}
+}
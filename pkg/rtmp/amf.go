@@ -0,0 +1,214 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// AMF0 markers, see the Action Message Format 0 specification.
+const (
+	amfNumber      = 0x00
+	amfBoolean     = 0x01
+	amfString      = 0x02
+	amfObject      = 0x03
+	amfNull        = 0x05
+	amfUndefined   = 0x06
+	amfECMAArray   = 0x08
+	amfObjectEnd   = 0x09
+	amfStrictArray = 0x0a
+	amfDate        = 0x0b
+	amfLongString  = 0x0c
+)
+
+var errAMFUnsupported = errors.New("unsupported AMF0 type")
+
+// amfObj is an AMF0 object or ECMA array.
+type amfObj map[string]interface{}
+
+// amfUndef is the AMF0 undefined value; nil is encoded as null.
+type amfUndef struct{}
+
+// decodeAMF decodes every AMF0 value in b.
+func decodeAMF(b []byte) ([]interface{}, error) {
+	r := bytes.NewReader(b)
+	var values []interface{}
+	for r.Len() > 0 {
+		v, err := readAMF(r)
+		if err != nil {
+			return values, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+func readAMF(r *bytes.Reader) (interface{}, error) {
+	marker, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch marker {
+	case amfNumber:
+		var bits uint64
+		if err := binary.Read(r, binary.BigEndian, &bits); err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(bits), nil
+	case amfBoolean:
+		b, err := r.ReadByte()
+		return b != 0, err
+	case amfString:
+		return readAMFString(r, 2)
+	case amfLongString:
+		return readAMFString(r, 4)
+	case amfObject:
+		return readAMFProperties(r)
+	case amfECMAArray:
+		if _, err := r.Seek(4, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+		return readAMFProperties(r)
+	case amfStrictArray:
+		var n uint32
+		if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+			return nil, err
+		}
+		values := make([]interface{}, 0, n)
+		for i := uint32(0); i < n; i++ {
+			v, err := readAMF(r)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		return values, nil
+	case amfDate:
+		var bits uint64
+		if err := binary.Read(r, binary.BigEndian, &bits); err != nil {
+			return nil, err
+		}
+		// The time zone is reserved and ignored.
+		_, err := r.Seek(2, io.SeekCurrent)
+		return math.Float64frombits(bits), err
+	case amfNull:
+		return nil, nil
+	case amfUndefined:
+		return amfUndef{}, nil
+	}
+	return nil, fmt.Errorf("%w 0x%02x", errAMFUnsupported, marker)
+}
+
+func readAMFString(r *bytes.Reader, sizeLen int) (string, error) {
+	var n uint32
+	if sizeLen == 2 {
+		var n16 uint16
+		if err := binary.Read(r, binary.BigEndian, &n16); err != nil {
+			return "", err
+		}
+		n = uint32(n16)
+	} else if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return "", err
+	}
+
+	if int64(n) > int64(r.Len()) {
+		return "", io.ErrUnexpectedEOF
+	}
+	b := make([]byte, n)
+	_, err := io.ReadFull(r, b)
+	return string(b), err
+}
+
+func readAMFProperties(r *bytes.Reader) (amfObj, error) {
+	obj := amfObj{}
+	for {
+		key, err := readAMFString(r, 2)
+		if err != nil {
+			return nil, err
+		}
+		if key == "" {
+			marker, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			if marker == amfObjectEnd {
+				return obj, nil
+			}
+			if err := r.UnreadByte(); err != nil {
+				return nil, err
+			}
+		}
+
+		v, err := readAMF(r)
+		if err != nil {
+			return nil, err
+		}
+		obj[key] = v
+	}
+}
+
+// encodeAMF encodes values as AMF0. It supports the types readAMF returns,
+// plus int.
+func encodeAMF(values ...interface{}) ([]byte, error) {
+	b := &bytes.Buffer{}
+	for _, v := range values {
+		if err := writeAMF(b, v); err != nil {
+			return nil, err
+		}
+	}
+	return b.Bytes(), nil
+}
+
+func writeAMF(b *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		b.WriteByte(amfNull)
+	case amfUndef:
+		b.WriteByte(amfUndefined)
+	case float64:
+		b.WriteByte(amfNumber)
+		_ = binary.Write(b, binary.BigEndian, math.Float64bits(v))
+	case int:
+		return writeAMF(b, float64(v))
+	case bool:
+		b.WriteByte(amfBoolean)
+		if v {
+			b.WriteByte(1)
+		} else {
+			b.WriteByte(0)
+		}
+	case string:
+		if len(v) > math.MaxUint16 {
+			b.WriteByte(amfLongString)
+			_ = binary.Write(b, binary.BigEndian, uint32(len(v)))
+		} else {
+			b.WriteByte(amfString)
+			_ = binary.Write(b, binary.BigEndian, uint16(len(v)))
+		}
+		b.WriteString(v)
+	case amfObj:
+		b.WriteByte(amfObject)
+		// Sorted, so that the encoding is stable.
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			_ = binary.Write(b, binary.BigEndian, uint16(len(k)))
+			b.WriteString(k)
+			if err := writeAMF(b, v[k]); err != nil {
+				return err
+			}
+		}
+		b.Write([]byte{0, 0, amfObjectEnd})
+	default:
+		return fmt.Errorf("%w %T", errAMFUnsupported, v)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package rtmp
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeAMF(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      []byte
+		want    []interface{}
+		wantErr error
+	}{
+		{
+			name: "number",
+			in:   []byte{amfNumber, 0x3f, 0xf0, 0, 0, 0, 0, 0, 0},
+			want: []interface{}{1.0},
+		},
+		{
+			name: "booleans",
+			in:   []byte{amfBoolean, 1, amfBoolean, 0},
+			want: []interface{}{true, false},
+		},
+		{
+			name: "string",
+			in:   []byte{amfString, 0, 7, 'c', 'o', 'n', 'n', 'e', 'c', 't'},
+			want: []interface{}{"connect"},
+		},
+		{
+			name: "long string",
+			in:   []byte{amfLongString, 0, 0, 0, 2, 'h', 'i'},
+			want: []interface{}{"hi"},
+		},
+		{
+			name: "null and undefined",
+			in:   []byte{amfNull, amfUndefined},
+			want: []interface{}{nil, amfUndef{}},
+		},
+		{
+			name: "object",
+			in: []byte{
+				amfObject,
+				0, 3, 'a', 'p', 'p', amfString, 0, 4, 'l', 'i', 'v', 'e',
+				0, 5, 'f', 'l', 'a', 's', 'h', amfBoolean, 1,
+				0, 0, amfObjectEnd,
+			},
+			want: []interface{}{amfObj{"app": "live", "flash": true}},
+		},
+		{
+			name: "ECMA array",
+			in: []byte{
+				amfECMAArray, 0, 0, 0, 1,
+				0, 5, 'w', 'i', 'd', 't', 'h', amfNumber, 0x40, 0x94, 0, 0, 0, 0, 0, 0,
+				0, 0, amfObjectEnd,
+			},
+			want: []interface{}{amfObj{"width": 1280.0}},
+		},
+		{
+			name: "nested object",
+			in: []byte{
+				amfObject,
+				0, 1, 'o', amfObject, 0, 0, amfObjectEnd,
+				0, 0, amfObjectEnd,
+			},
+			want: []interface{}{amfObj{"o": amfObj{}}},
+		},
+		{
+			name: "strict array",
+			in:   []byte{amfStrictArray, 0, 0, 0, 2, amfNull, amfBoolean, 1},
+			want: []interface{}{[]interface{}{nil, true}},
+		},
+		{
+			name: "date",
+			in:   []byte{amfDate, 0x40, 0x59, 0, 0, 0, 0, 0, 0, 0, 0},
+			want: []interface{}{100.0},
+		},
+		{
+			name: "command",
+			in: []byte{
+				amfString, 0, 7, 'p', 'u', 'b', 'l', 'i', 's', 'h',
+				amfNumber, 0x40, 0x14, 0, 0, 0, 0, 0, 0,
+				amfNull,
+				amfString, 0, 3, 'k', 'e', 'y',
+			},
+			want: []interface{}{"publish", 5.0, nil, "key"},
+		},
+		{
+			name: "empty",
+			in:   nil,
+			want: nil,
+		},
+		{
+			name:    "unsupported marker",
+			in:      []byte{amfNull, 0x11},
+			want:    []interface{}{nil},
+			wantErr: errAMFUnsupported,
+		},
+		{
+			name:    "short number",
+			in:      []byte{amfNumber, 0x3f, 0xf0},
+			wantErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name:    "string longer than the payload",
+			in:      []byte{amfString, 0, 9, 'h', 'i'},
+			wantErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name:    "unterminated object",
+			in:      []byte{amfObject, 0, 1, 'a', amfNull},
+			wantErr: io.EOF,
+		},
+		{
+			name:    "missing boolean",
+			in:      []byte{amfBoolean},
+			wantErr: io.EOF,
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := decodeAMF(tt.in)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: decodeAMF error %v, want %v", tt.name, err, tt.wantErr)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: decodeAMF = %#v, want %#v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEncodeAMFRoundTrips(t *testing.T) {
+	tests := [][]interface{}{
+		{"_result", 1.0, nil, amfObj{"level": "status", "code": "NetStream.Publish.Start"}},
+		{true, false, amfUndef{}},
+		{amfObj{"nested": amfObj{"n": -2.5}, "empty": amfObj{}}},
+		{strings.Repeat("x", 70000)},
+	}
+
+	for _, values := range tests {
+		b, err := encodeAMF(values...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := decodeAMF(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, values) {
+			t.Errorf("encoded and decoded %.100v, got %.100v", values, got)
+		}
+	}
+
+	if b, err := encodeAMF(3); err != nil || !reflect.DeepEqual(b, []byte{amfNumber, 0x40, 0x08, 0, 0, 0, 0, 0, 0}) {
+		t.Errorf("encodeAMF(3) = %v, %v", b, err)
+	}
+	if _, err := encodeAMF([]int{1}); !errors.Is(err, errAMFUnsupported) {
+		t.Errorf("encodeAMF([]int) error %v, want %v", err, errAMFUnsupported)
+	}
+}
@@ -0,0 +1,392 @@
+package rtmp
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Message types of the RTMP specification.
+const (
+	msgSetChunkSize     = 1
+	msgAbort            = 2
+	msgAck              = 3
+	msgUserControl      = 4
+	msgWindowAckSize    = 5
+	msgSetPeerBandwidth = 6
+	msgAudio            = 8
+	msgVideo            = 9
+	msgDataAMF3         = 15
+	msgCommandAMF3      = 17
+	msgDataAMF0         = 18
+	msgCommandAMF0      = 20
+)
+
+// Chunk stream IDs used for the messages the server sends.
+const (
+	csidControl = 2
+	csidCommand = 3
+)
+
+const (
+	handshakeSize    = 1536
+	defaultChunkSize = 128
+	// serverChunkSize is the chunk size the server announces and sends with.
+	serverChunkSize = 4096
+	// windowAckSize is the acknowledgement window the server asks the client for.
+	windowAckSize = 2500000
+	// readTimeout bounds how long a publisher may stay silent.
+	readTimeout = 30 * time.Second
+	// maxMessageLength and maxChunkStreams bound the memory a client, not
+	// authenticated until it publishes, makes the server hold. The largest
+	// message is a video frame.
+	maxMessageLength = 4 << 20
+	maxChunkStreams  = 16
+)
+
+var errProtocol = errors.New("rtmp protocol error")
+
+type message struct {
+	typ       byte
+	streamID  uint32
+	timestamp uint32
+	payload   []byte
+}
+
+// chunkStream is the state of a chunk stream, which the chunk headers of a
+// message are compressed against.
+type chunkStream struct {
+	timestamp uint32
+	delta     uint32
+	length    uint32
+	typ       byte
+	streamID  uint32
+	extended  bool
+	buf       []byte
+}
+
+// conn reads and writes RTMP messages over the chunk stream of a connection.
+type conn struct {
+	nc net.Conn
+	r  *bufio.Reader
+	w  *bufio.Writer
+
+	readChunkSize uint32
+	streams       map[uint32]*chunkStream
+
+	// received counts the bytes read, acknowledged once per window of
+	// windowAckSize bytes as the client asked for.
+	received, acked, windowAckSize uint32
+}
+
+func newConn(nc net.Conn) *conn {
+	c := &conn{
+		nc:            nc,
+		w:             bufio.NewWriter(nc),
+		readChunkSize: defaultChunkSize,
+		streams:       make(map[uint32]*chunkStream),
+	}
+	c.r = bufio.NewReader(countingReader{nc, &c.received})
+	return c
+}
+
+type countingReader struct {
+	r io.Reader
+	n *uint32
+}
+
+func (c countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	*c.n += uint32(n)
+	return n, err
+}
+
+// handshake runs the simple RTMP handshake as the server.
+func (c *conn) handshake() error {
+	_ = c.nc.SetDeadline(time.Now().Add(readTimeout))
+	defer c.nc.SetDeadline(time.Time{})
+
+	c0c1 := make([]byte, 1+handshakeSize)
+	if _, err := io.ReadFull(c.r, c0c1); err != nil {
+		return err
+	}
+	if c0c1[0] != 3 {
+		return fmt.Errorf("%w: unsupported version %d", errProtocol, c0c1[0])
+	}
+
+	s0s1s2 := make([]byte, 1+2*handshakeSize)
+	s0s1s2[0] = 3
+	if _, err := rand.Read(s0s1s2[9 : 1+handshakeSize]); err != nil {
+		return err
+	}
+	// S2 echoes C1.
+	copy(s0s1s2[1+handshakeSize:], c0c1[1:])
+	if _, err := c.w.Write(s0s1s2); err != nil {
+		return err
+	}
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+
+	c2 := make([]byte, handshakeSize)
+	_, err := io.ReadFull(c.r, c2)
+	return err
+}
+
+// readMessage returns the next message, handling the protocol control
+// messages on the way.
+func (c *conn) readMessage() (*message, error) {
+	for {
+		_ = c.nc.SetReadDeadline(time.Now().Add(readTimeout))
+		m, err := c.readChunk()
+		if err != nil {
+			return nil, err
+		}
+
+		if c.windowAckSize > 0 && c.received-c.acked >= c.windowAckSize {
+			c.acked = c.received
+			if err := c.writeControl(msgAck, c.received); err != nil {
+				return nil, err
+			}
+		}
+
+		if m == nil {
+			continue
+		}
+
+		switch m.typ {
+		case msgSetChunkSize:
+			if len(m.payload) < 4 {
+				return nil, fmt.Errorf("%w: short set chunk size", errProtocol)
+			}
+			size := binary.BigEndian.Uint32(m.payload) & 0x7fffffff
+			if size == 0 || size > maxMessageLength {
+				return nil, fmt.Errorf("%w: chunk size %d", errProtocol, size)
+			}
+			c.readChunkSize = size
+		case msgAbort:
+			if len(m.payload) >= 4 {
+				if cs, ok := c.streams[binary.BigEndian.Uint32(m.payload)]; ok {
+					cs.buf = nil
+				}
+			}
+		case msgWindowAckSize:
+			if len(m.payload) >= 4 {
+				c.windowAckSize = binary.BigEndian.Uint32(m.payload)
+			}
+		case msgAck, msgUserControl, msgSetPeerBandwidth:
+		default:
+			return m, nil
+		}
+	}
+}
+
+// readChunk reads one chunk and returns the message it completes, if any.
+func (c *conn) readChunk() (*message, error) {
+	b0, err := c.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	format, csid := b0>>6, uint32(b0&0x3f)
+	switch csid {
+	case 0:
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		csid = 64 + uint32(b)
+	case 1:
+		var b [2]byte
+		if _, err := io.ReadFull(c.r, b[:]); err != nil {
+			return nil, err
+		}
+		csid = 64 + uint32(b[0]) + uint32(b[1])<<8
+	}
+
+	cs, ok := c.streams[csid]
+	if !ok {
+		if format != 0 {
+			return nil, fmt.Errorf("%w: chunk stream %d starts with format %d", errProtocol, csid, format)
+		}
+		if len(c.streams) == maxChunkStreams {
+			return nil, fmt.Errorf("%w: more than %d chunk streams", errProtocol, maxChunkStreams)
+		}
+		cs = &chunkStream{}
+		c.streams[csid] = cs
+	}
+
+	var header [11]byte
+	switch format {
+	case 0:
+		if _, err := io.ReadFull(c.r, header[:11]); err != nil {
+			return nil, err
+		}
+		cs.length = uint24(header[3:])
+		cs.typ = header[6]
+		cs.streamID = binary.LittleEndian.Uint32(header[7:])
+		ts, err := c.timestamp(cs, uint24(header[:]))
+		if err != nil {
+			return nil, err
+		}
+		cs.timestamp, cs.delta = ts, ts
+	case 1, 2:
+		n := 7
+		if format == 2 {
+			n = 3
+		}
+		if _, err := io.ReadFull(c.r, header[:n]); err != nil {
+			return nil, err
+		}
+		if format == 1 {
+			cs.length = uint24(header[3:])
+			cs.typ = header[6]
+		}
+		delta, err := c.timestamp(cs, uint24(header[:]))
+		if err != nil {
+			return nil, err
+		}
+		cs.delta = delta
+		cs.timestamp += delta
+	case 3:
+		if cs.extended {
+			if _, err := io.ReadFull(c.r, header[:4]); err != nil {
+				return nil, err
+			}
+		}
+		// A format 3 chunk starting a message repeats the last delta.
+		if len(cs.buf) == 0 {
+			cs.timestamp += cs.delta
+		}
+	}
+
+	if cs.length > maxMessageLength {
+		return nil, fmt.Errorf("%w: message of %d bytes", errProtocol, cs.length)
+	}
+	n := cs.length - uint32(len(cs.buf))
+	if n > c.readChunkSize {
+		n = c.readChunkSize
+	}
+	// The buffer grows with the chunks received rather than with the
+	// length the header claims.
+	start := len(cs.buf)
+	if cs.buf == nil || cap(cs.buf)-start < int(n) {
+		size := 2*cap(cs.buf) + int(n)
+		if size > int(cs.length) {
+			size = int(cs.length)
+		}
+		buf := make([]byte, start, size)
+		copy(buf, cs.buf)
+		cs.buf = buf
+	}
+	cs.buf = cs.buf[:start+int(n)]
+	if _, err := io.ReadFull(c.r, cs.buf[start:]); err != nil {
+		return nil, err
+	}
+
+	if uint32(len(cs.buf)) < cs.length {
+		return nil, nil
+	}
+
+	m := &message{
+		typ:       cs.typ,
+		streamID:  cs.streamID,
+		timestamp: cs.timestamp,
+		payload:   cs.buf,
+	}
+	cs.buf = nil
+	return m, nil
+}
+
+// timestamp reads the extended timestamp if the 24 bit field ts says there is one.
+func (c *conn) timestamp(cs *chunkStream, ts uint32) (uint32, error) {
+	cs.extended = ts == 0xffffff
+	if !cs.extended {
+		return ts, nil
+	}
+
+	var b [4]byte
+	if _, err := io.ReadFull(c.r, b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b[:]), nil
+}
+
+// writeMessage sends m on the chunk stream csid.
+func (c *conn) writeMessage(csid byte, m *message) error {
+	header := make([]byte, 12, 16)
+	header[0] = csid
+	ts := m.timestamp
+	extended := ts >= 0xffffff
+	if extended {
+		ts = 0xffffff
+	}
+	putUint24(header[1:], ts)
+	putUint24(header[4:], uint32(len(m.payload)))
+	header[7] = m.typ
+	binary.LittleEndian.PutUint32(header[8:], m.streamID)
+	if extended {
+		header = binary.BigEndian.AppendUint32(header, m.timestamp)
+	}
+	if _, err := c.w.Write(header); err != nil {
+		return err
+	}
+
+	for payload := m.payload; len(payload) > 0; {
+		n := len(payload)
+		if n > serverChunkSize {
+			n = serverChunkSize
+		}
+		if _, err := c.w.Write(payload[:n]); err != nil {
+			return err
+		}
+		payload = payload[n:]
+
+		if len(payload) > 0 {
+			if err := c.w.WriteByte(0xc0 | csid); err != nil {
+				return err
+			}
+			if extended {
+				if _, err := c.w.Write(binary.BigEndian.AppendUint32(nil, m.timestamp)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return c.w.Flush()
+}
+
+// writeControl sends a protocol control message carrying a 32 bit value.
+func (c *conn) writeControl(typ byte, value uint32, extra ...byte) error {
+	payload := binary.BigEndian.AppendUint32(nil, value)
+	return c.writeMessage(csidControl, &message{
+		typ:     typ,
+		payload: append(payload, extra...),
+	})
+}
+
+// writeCommand sends an AMF0 command on the message stream streamID.
+func (c *conn) writeCommand(streamID uint32, values ...interface{}) error {
+	payload, err := encodeAMF(values...)
+	if err != nil {
+		return err
+	}
+	return c.writeMessage(csidCommand, &message{
+		typ:      msgCommandAMF0,
+		streamID: streamID,
+		payload:  payload,
+	})
+}
+
+func uint24(b []byte) uint32 {
+	return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0], b[1], b[2] = byte(v>>16), byte(v>>8), byte(v)
+}
@@ -0,0 +1,287 @@
+package rtmp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// chunks splits m into chunks of size bytes on the chunk stream csid, the
+// first with a header of the given format carrying ts, a timestamp for
+// format 0 and a delta otherwise.
+func chunks(csid byte, format byte, ts uint32, m *message, size int) [][]byte {
+	field := ts
+	extended := ts >= 0xffffff
+	if extended {
+		field = 0xffffff
+	}
+
+	header := []byte{format<<6 | csid}
+	if format < 3 {
+		header = append(header, byte(field>>16), byte(field>>8), byte(field))
+	}
+	if format < 2 {
+		n := len(m.payload)
+		header = append(header, byte(n>>16), byte(n>>8), byte(n), m.typ)
+	}
+	if format == 0 {
+		header = binary.LittleEndian.AppendUint32(header, m.streamID)
+	}
+	if extended {
+		header = binary.BigEndian.AppendUint32(header, ts)
+	}
+
+	var out [][]byte
+	payload := m.payload
+	for first := true; first || len(payload) > 0; first = false {
+		n := len(payload)
+		if n > size {
+			n = size
+		}
+		var chunk []byte
+		if first {
+			chunk = append(chunk, header...)
+		} else {
+			chunk = append(chunk, 0xc0|csid)
+			if extended {
+				chunk = binary.BigEndian.AppendUint32(chunk, ts)
+			}
+		}
+		out = append(out, append(chunk, payload[:n]...))
+		payload = payload[n:]
+	}
+	return out
+}
+
+func payload(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	return b
+}
+
+// readAll reads the chunks of b with a chunk size of size until b is consumed.
+func readAll(t *testing.T, b []byte, size uint32) []*message {
+	t.Helper()
+
+	c := &conn{
+		r:             bufio.NewReader(bytes.NewReader(b)),
+		readChunkSize: size,
+		streams:       make(map[uint32]*chunkStream),
+	}
+	var messages []*message
+	for {
+		m, err := c.readChunk()
+		if err == io.EOF {
+			return messages
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m != nil {
+			messages = append(messages, m)
+		}
+	}
+}
+
+func TestReadChunkReassembles(t *testing.T) {
+	for _, size := range []int{1, 60, 128, 4096} {
+		for _, n := range []int{0, 1, 127, 128, 129, 1000, 5000} {
+			m := &message{typ: msgVideo, streamID: 1, timestamp: 40, payload: payload(n)}
+
+			got := readAll(t, bytes.Join(chunks(4, 0, 40, m, size), nil), uint32(size))
+			if len(got) != 1 || !reflect.DeepEqual(got[0], m) {
+				t.Errorf("chunk size %d, %d bytes: read %+v", size, n, got)
+			}
+		}
+	}
+}
+
+func TestReadChunkInterleavesStreams(t *testing.T) {
+	video := &message{typ: msgVideo, streamID: 1, timestamp: 1000, payload: payload(300)}
+	audio := &message{typ: msgAudio, streamID: 1, timestamp: 1020, payload: payload(200)}
+
+	// The chunks of both messages alternate, audio completes first.
+	v, a := chunks(6, 0, 1000, video, 100), chunks(4, 0, 1020, audio, 100)
+	b := bytes.Join([][]byte{v[0], a[0], v[1], a[1], v[2]}, nil)
+
+	got := readAll(t, b, 100)
+	if want := []*message{audio, video}; !reflect.DeepEqual(got, want) {
+		t.Errorf("read %+v, want %+v", got, want)
+	}
+}
+
+func TestReadChunkHeaderFormats(t *testing.T) {
+	first := &message{typ: msgVideo, streamID: 1, timestamp: 1000, payload: payload(150)}
+	// Format 1 changes the length and the type.
+	second := &message{typ: msgAudio, streamID: 1, timestamp: 1040, payload: payload(20)}
+	// Format 2 and 3 keep them, format 3 repeats the last delta.
+	third := &message{typ: msgAudio, streamID: 1, timestamp: 1060, payload: payload(20)}
+	fourth := &message{typ: msgAudio, streamID: 1, timestamp: 1080, payload: payload(20)}
+	// An extended timestamp, repeated on the continuation chunks.
+	fifth := &message{typ: msgVideo, streamID: 1, timestamp: 0x01000000, payload: payload(300)}
+
+	var b [][]byte
+	b = append(b, chunks(4, 0, 1000, first, 128)...)
+	b = append(b, chunks(4, 1, 40, second, 128)...)
+	b = append(b, chunks(4, 2, 20, third, 128)...)
+	b = append(b, chunks(4, 3, 0, fourth, 128)...)
+	b = append(b, chunks(4, 0, 0x01000000, fifth, 128)...)
+
+	got := readAll(t, bytes.Join(b, nil), 128)
+	want := []*message{first, second, third, fourth, fifth}
+	if len(got) != len(want) {
+		t.Fatalf("read %d messages, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Errorf("message %d is %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestReadChunkExtendedStreamIDs(t *testing.T) {
+	for _, csid := range []uint32{2, 63, 64, 319, 320, 65599} {
+		m := &message{typ: msgDataAMF0, payload: payload(10)}
+		chunk := chunks(0, 0, 0, m, 128)[0]
+		switch {
+		case csid < 64:
+			chunk[0] = byte(csid)
+		case csid < 320:
+			chunk = append([]byte{0, byte(csid - 64)}, chunk[1:]...)
+		default:
+			chunk = append([]byte{1, byte(csid - 64), byte((csid - 64) >> 8)}, chunk[1:]...)
+		}
+
+		c := &conn{r: bufio.NewReader(bytes.NewReader(chunk)), readChunkSize: 128, streams: make(map[uint32]*chunkStream)}
+		got, err := c.readChunk()
+		if err != nil || !reflect.DeepEqual(got, m) || c.streams[csid] == nil {
+			t.Errorf("chunk stream %d: read %+v, %v", csid, got, err)
+		}
+	}
+}
+
+func TestReadChunkRejectsCompressedStart(t *testing.T) {
+	for _, format := range []byte{1, 2, 3} {
+		m := &message{typ: msgVideo, payload: payload(10)}
+		c := &conn{r: bufio.NewReader(bytes.NewReader(chunks(4, format, 0, m, 128)[0])), readChunkSize: 128, streams: make(map[uint32]*chunkStream)}
+		if _, err := c.readChunk(); err == nil {
+			t.Errorf("a chunk stream starting with format %d was read", format)
+		}
+	}
+}
+
+func TestReadMessageFollowsChunkSize(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	video := &message{typ: msgVideo, streamID: 1, timestamp: 40, payload: payload(5000)}
+	go func() {
+		defer client.Close()
+
+		setChunkSize := &message{typ: msgSetChunkSize, payload: binary.BigEndian.AppendUint32(nil, 1000)}
+		abort := &message{typ: msgAbort, payload: binary.BigEndian.AppendUint32(nil, 6)}
+		partial := chunks(6, 0, 0, &message{typ: msgVideo, payload: payload(2000)}, 1000)[0]
+
+		var b [][]byte
+		b = append(b, chunks(csidControl, 0, 0, setChunkSize, 128)...)
+		// The first chunk of a message on stream 6, dropped by an abort.
+		b = append(b, partial)
+		b = append(b, chunks(csidControl, 0, 0, abort, 1000)...)
+		b = append(b, chunks(4, 0, 40, video, 1000)...)
+		client.Write(bytes.Join(b, nil))
+	}()
+
+	c := newConn(server)
+	m, err := c.readMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, video) {
+		t.Errorf("read %+v, want %+v", m, video)
+	}
+	if c.readChunkSize != 1000 {
+		t.Errorf("chunk size is %d, want 1000", c.readChunkSize)
+	}
+	if len(c.streams[6].buf) != 0 {
+		t.Errorf("aborted message kept %d bytes", len(c.streams[6].buf))
+	}
+	if _, err := c.readMessage(); err != io.EOF {
+		t.Errorf("read past the end: %v", err)
+	}
+}
+
+func TestWriteMessageReadsBack(t *testing.T) {
+	for _, m := range []*message{
+		{typ: msgCommandAMF0, streamID: 1, timestamp: 0, payload: payload(10)},
+		{typ: msgVideo, streamID: 1, timestamp: 1234, payload: payload(serverChunkSize)},
+		{typ: msgVideo, streamID: 1, timestamp: 1234, payload: payload(3*serverChunkSize + 1)},
+		{typ: msgAudio, streamID: 1, timestamp: 0xffffff, payload: payload(serverChunkSize + 1)},
+	} {
+		b := &bytes.Buffer{}
+		c := &conn{w: bufio.NewWriter(b)}
+		if err := c.writeMessage(csidCommand, m); err != nil {
+			t.Fatal(err)
+		}
+
+		got := readAll(t, b.Bytes(), serverChunkSize)
+		if len(got) != 1 || !reflect.DeepEqual(got[0], m) {
+			t.Errorf("wrote %d bytes at %d, read back %d messages", len(m.payload), m.timestamp, len(got))
+		}
+	}
+}
+
+func TestServeClosesOnOversizedMessages(t *testing.T) {
+	header := func(csid byte, length int) []byte {
+		return []byte{csid, 0, 0, 0, byte(length >> 16), byte(length >> 8), byte(length), msgVideo, 1, 0, 0, 0}
+	}
+	var streams []byte
+	for csid := byte(2); csid < 2+maxChunkStreams+1; csid++ {
+		streams = append(streams, bytes.Join(chunks(csid, 0, 0, &message{typ: msgUserControl, payload: payload(6)}, 128), nil)...)
+	}
+	setChunkSize := bytes.Join(chunks(csidControl, 0, 0, &message{typ: msgSetChunkSize, payload: binary.BigEndian.AppendUint32(nil, maxMessageLength+1)}, 128), nil)
+
+	tests := []struct {
+		name string
+		in   []byte
+	}{
+		{name: "oversized message", in: header(4, maxMessageLength+1)},
+		{name: "largest message length", in: header(4, 0xffffff)},
+		{name: "too many chunk streams", in: streams},
+		{name: "oversized chunk size", in: setChunkSize},
+	}
+
+	for _, tt := range tests {
+		client, server := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			(&Server{}).serve(server)
+			close(done)
+		}()
+
+		c0c1 := make([]byte, 1+handshakeSize)
+		c0c1[0] = 3
+		s0s1s2 := make([]byte, 1+2*handshakeSize)
+		if _, err := client.Write(c0c1); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(client, s0s1s2); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Write(make([]byte, handshakeSize)); err != nil {
+			t.Fatal(err)
+		}
+
+		go client.Write(tt.in)
+		if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("%s: read %v, want the connection closed", tt.name, err)
+		}
+		<-done
+		client.Close()
+	}
+}
@@ -0,0 +1,221 @@
+package rtmp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+
+	w "quick-video/pkg/webrtc"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// flvCodecAVC is the FLV codec ID of H.264, see the FLV specification.
+	flvCodecAVC = 7
+
+	flvFrameKey = 1
+
+	nalTypeSPS = 7
+	nalTypePPS = 8
+	nalTypeAUD = 9
+
+	rtpMTU = 1200
+	// streamID is the media stream ID the ingested tracks are published with.
+	streamID = "rtmp"
+)
+
+// h264Codec is the codec of the video track, with the payload type the
+// default codecs of the SFU give it.
+var h264Codec = webrtc.RTPCodecParameters{
+	RTPCodecCapability: webrtc.RTPCodecCapability{
+		MimeType:    webrtc.MimeTypeH264,
+		ClockRate:   90000,
+		SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+	},
+	PayloadType: 106,
+}
+
+var errAVCConfig = errors.New("invalid AVCDecoderConfigurationRecord")
+
+// ingest turns the FLV video messages of a publish into RTP and publishes
+// them as a local track of a room.
+type ingest struct {
+	room *w.Room
+	name string
+
+	video      *w.Track
+	packetizer rtp.Packetizer
+	sps, pps   [][]byte
+	nalLength  int
+
+	warned map[string]bool
+}
+
+func newIngest(room *w.Room, name string) *ingest {
+	return &ingest{
+		room:   room,
+		name:   name,
+		warned: make(map[string]bool),
+	}
+}
+
+// warn logs msg once per publish.
+func (i *ingest) warn(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if i.warned[msg] {
+		return
+	}
+	i.warned[msg] = true
+	log.Printf("rtmp %s: %s", i.name, msg)
+}
+
+func (i *ingest) writeVideo(m *message) {
+	p := m.payload
+	if len(p) < 5 {
+		return
+	}
+	if p[0]&0x80 != 0 {
+		i.warn("dropping video, enhanced RTMP codecs are not supported")
+		return
+	}
+	if codec := p[0] & 0x0f; codec != flvCodecAVC {
+		i.warn("dropping video, codec %d is not H.264", codec)
+		return
+	}
+
+	keyFrame := p[0]>>4 == flvFrameKey
+	cts := int32(uint24(p[2:])<<8) >> 8
+
+	switch p[1] {
+	case 0:
+		if err := i.configureVideo(p[5:]); err != nil {
+			i.warn("dropping video: %s", err)
+		}
+	case 1:
+		if i.video == nil {
+			return
+		}
+		i.writeNALUs(p[5:], keyFrame, int64(m.timestamp)+int64(cts))
+		if keyFrame {
+			i.room.Touch()
+		}
+	}
+}
+
+// configureVideo reads the SPS and PPS of an AVC sequence header and
+// publishes the video track on the first one.
+func (i *ingest) configureVideo(record []byte) error {
+	if len(record) < 6 {
+		return errAVCConfig
+	}
+	i.nalLength = int(record[4]&0x03) + 1
+
+	var sets [2][][]byte
+	b := record[5:]
+	for s := range sets {
+		if len(b) < 1 {
+			return errAVCConfig
+		}
+		n := int(b[0])
+		if s == 0 {
+			n &= 0x1f
+		}
+		b = b[1:]
+
+		for j := 0; j < n; j++ {
+			if len(b) < 2 {
+				return errAVCConfig
+			}
+			size := int(binary.BigEndian.Uint16(b))
+			if len(b) < 2+size {
+				return errAVCConfig
+			}
+			sets[s] = append(sets[s], b[2:2+size])
+			b = b[2+size:]
+		}
+	}
+	i.sps, i.pps = sets[0], sets[1]
+
+	if i.video != nil {
+		return nil
+	}
+	i.packetizer = rtp.NewPacketizer(rtpMTU, uint8(h264Codec.PayloadType), 0, &codecs.H264Payloader{}, rtp.NewRandomSequencer(), h264Codec.ClockRate)
+	i.video = w.NewLocalTrack(h264Codec, "rtmp-video", streamID)
+	if !i.room.Peers.Publish(i.video) {
+		i.video = nil
+		return errors.New("a video track is already published by RTMP")
+	}
+	return nil
+}
+
+// writeNALUs packetizes the length prefixed NAL units of an access unit
+// presented at pts milliseconds.
+func (i *ingest) writeNALUs(b []byte, keyFrame bool, pts int64) {
+	var annexB []byte
+	appendNALU := func(nalu []byte) {
+		annexB = append(annexB, 0, 0, 0, 1)
+		annexB = append(annexB, nalu...)
+	}
+
+	// Repeat the parameter sets on every key frame for the subscribers
+	// joining in the middle of the stream.
+	if keyFrame {
+		for _, sps := range i.sps {
+			appendNALU(sps)
+		}
+		for _, pps := range i.pps {
+			appendNALU(pps)
+		}
+	}
+
+	for len(b) >= i.nalLength {
+		size := 0
+		for _, c := range b[:i.nalLength] {
+			size = size<<8 | int(c)
+		}
+		b = b[i.nalLength:]
+		if size > len(b) {
+			i.warn("truncated NAL unit")
+			return
+		}
+
+		nalu := b[:size]
+		b = b[size:]
+		if len(nalu) == 0 {
+			continue
+		}
+		switch nalu[0] & 0x1f {
+		case nalTypeAUD:
+			continue
+		case nalTypeSPS, nalTypePPS:
+			if keyFrame {
+				continue
+			}
+		}
+		appendNALU(nalu)
+	}
+
+	ts := uint32(pts * int64(h264Codec.ClockRate) / 1000)
+	for _, pkt := range i.packetizer.Packetize(annexB, 0) {
+		pkt.Timestamp = ts
+		i.video.WriteRTP("", pkt)
+	}
+}
+
+// writeAudio drops the audio: WebRTC has no AAC, and transcoding it to
+// Opus is left out.
+func (i *ingest) writeAudio(*message) {
+	i.warn("dropping audio, RTMP ingest is video only")
+}
+
+// close unpublishes the track of the ingest.
+func (i *ingest) close() {
+	if i.video != nil {
+		i.room.Peers.RemoveTrack(i.video, "")
+	}
+	i.room.Touch()
+}
@@ -0,0 +1,229 @@
+package rtmp
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"quick-video/pkg/chat"
+	w "quick-video/pkg/webrtc"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+)
+
+var (
+	testSPS = []byte{0x67, 0x42, 0xc0, 0x1f}
+	testPPS = []byte{0x68, 0xce, 0x3c, 0x80}
+)
+
+// capture is a sink keeping the packets of the tracks of a room.
+type capture struct {
+	packets []*rtp.Packet
+}
+
+func (c *capture) AddTrack(t *w.Track) webrtc.TrackLocalWriter { return c }
+func (c *capture) RemoveTrack(t *w.Track)                      {}
+
+func (c *capture) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	c.packets = append(c.packets, &rtp.Packet{Header: *header, Payload: append([]byte(nil), payload...)})
+	return len(payload), nil
+}
+
+func (c *capture) Write(b []byte) (int, error) {
+	p := &rtp.Packet{}
+	if err := p.Unmarshal(b); err != nil {
+		return 0, err
+	}
+	c.packets = append(c.packets, p)
+	return len(b), nil
+}
+
+// avcConfig is an AVCDecoderConfigurationRecord with NAL unit lengths of
+// nalLength bytes.
+func avcConfig(nalLength int) []byte {
+	b := []byte{1, 0x42, 0xc0, 0x1f, 0xfc | byte(nalLength-1), 0xe1}
+	b = append(b, 0, byte(len(testSPS)))
+	b = append(b, testSPS...)
+	b = append(b, 1, 0, byte(len(testPPS)))
+	return append(b, testPPS...)
+}
+
+// videoTag is the FLV video payload of an AVC packet.
+func videoTag(keyFrame bool, packetType byte, cts int32, data []byte) []byte {
+	frameType := byte(2)
+	if keyFrame {
+		frameType = flvFrameKey
+	}
+	b := []byte{frameType<<4 | flvCodecAVC, packetType, byte(cts >> 16), byte(cts >> 8), byte(cts)}
+	return append(b, data...)
+}
+
+// lengthPrefixed joins nalus, each after its length in n bytes.
+func lengthPrefixed(n int, nalus ...[]byte) []byte {
+	var b []byte
+	for _, nalu := range nalus {
+		for i := n - 1; i >= 0; i-- {
+			b = append(b, byte(len(nalu)>>(8*i)))
+		}
+		b = append(b, nalu...)
+	}
+	return b
+}
+
+func annexB(nalus ...[]byte) []byte {
+	var b []byte
+	for _, nalu := range nalus {
+		b = append(b, 0, 0, 0, 1)
+		b = append(b, nalu...)
+	}
+	return b
+}
+
+func nalu(header byte, n int) []byte {
+	b := payload(n)
+	b[0] = header
+	return b
+}
+
+func TestIngestPacketizesH264(t *testing.T) {
+	idr := nalu(0x65, 500)
+	slice := nalu(0x41, 300)
+	aud := []byte{0x09, 0xf0}
+	sei := nalu(0x06, 20)
+	inBandSPS := []byte{0x67, 0x4d, 0x00, 0x28}
+	inBandPPS := []byte{0x68, 0xee, 0x3c, 0x80}
+
+	tests := []struct {
+		name      string
+		nalLength int
+		keyFrame  bool
+		timestamp uint32
+		cts       int32
+		data      []byte
+		// want is the access unit sent, in Annex B, nil if nothing is.
+		want []byte
+	}{
+		{
+			name:      "key frame",
+			nalLength: 4,
+			keyFrame:  true,
+			timestamp: 1000,
+			data:      lengthPrefixed(4, idr),
+			want:      annexB(testSPS, testPPS, idr),
+		},
+		{
+			name:      "key frame with in-band parameter sets",
+			nalLength: 4,
+			keyFrame:  true,
+			timestamp: 1000,
+			data:      lengthPrefixed(4, aud, inBandSPS, testPPS, sei, idr),
+			want:      annexB(testSPS, testPPS, sei, idr),
+		},
+		{
+			name:      "delta frame",
+			nalLength: 4,
+			timestamp: 1000,
+			data:      lengthPrefixed(4, aud, slice),
+			want:      annexB(slice),
+		},
+		{
+			name:      "delta frame with new parameter sets",
+			nalLength: 4,
+			timestamp: 1000,
+			data:      lengthPrefixed(4, inBandSPS, inBandPPS, slice),
+			want:      annexB(inBandSPS, inBandPPS, slice),
+		},
+		{
+			name:      "composition time",
+			nalLength: 4,
+			timestamp: 1000,
+			cts:       80,
+			data:      lengthPrefixed(4, slice),
+			want:      annexB(slice),
+		},
+		{
+			name:      "fragmented",
+			nalLength: 4,
+			keyFrame:  true,
+			timestamp: 1000,
+			data:      lengthPrefixed(4, nalu(0x65, 5000), slice),
+			want:      annexB(testSPS, testPPS, nalu(0x65, 5000), slice),
+		},
+		{
+			name:      "2 byte lengths",
+			nalLength: 2,
+			timestamp: 1000,
+			data:      lengthPrefixed(2, slice, slice),
+			want:      annexB(slice, slice),
+		},
+		{
+			name:      "1 byte lengths and empty NAL units",
+			nalLength: 1,
+			timestamp: 1000,
+			data:      lengthPrefixed(1, nil, nalu(0x41, 100), nil),
+			want:      annexB(nalu(0x41, 100)),
+		},
+		{
+			name:      "truncated",
+			nalLength: 4,
+			timestamp: 1000,
+			data:      lengthPrefixed(4, slice)[:100],
+		},
+	}
+
+	for _, tt := range tests {
+		room := w.NewRoom("room", "stream", chat.Options{})
+		sink := &capture{}
+		room.Peers.Attach(sink)
+		i := newIngest(room, "test")
+
+		i.writeVideo(&message{typ: msgVideo, payload: videoTag(true, 0, 0, avcConfig(tt.nalLength))})
+		// A key frame at 0 first, which subscribers wait for.
+		i.writeVideo(&message{typ: msgVideo, payload: videoTag(true, 1, 0, lengthPrefixed(tt.nalLength, nalu(0x65, 10)))})
+		if len(sink.packets) == 0 {
+			t.Fatalf("%s: the first key frame was not sent", tt.name)
+		}
+		start := sink.packets[0].Timestamp
+		sink.packets = nil
+
+		i.writeVideo(&message{typ: msgVideo, timestamp: tt.timestamp, payload: videoTag(tt.keyFrame, 1, tt.cts, tt.data)})
+		room.Hub.Stop()
+
+		var got []byte
+		h264 := &codecs.H264Packet{}
+		for j, pkt := range sink.packets {
+			if pkt.PayloadType != uint8(h264Codec.PayloadType) {
+				t.Errorf("%s: packet %d has payload type %d", tt.name, j, pkt.PayloadType)
+			}
+			if size := pkt.MarshalSize(); size > rtpMTU {
+				t.Errorf("%s: packet %d is %d bytes", tt.name, j, size)
+			}
+			if want := start + (tt.timestamp+uint32(tt.cts))*90; pkt.Timestamp != want {
+				t.Errorf("%s: packet %d has timestamp %d, want %d", tt.name, j, pkt.Timestamp, want)
+			}
+			if last := j == len(sink.packets)-1; pkt.Marker != last {
+				t.Errorf("%s: packet %d has marker %t", tt.name, j, pkt.Marker)
+			}
+			b, err := h264.Unmarshal(pkt.Payload)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			got = append(got, b...)
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: sent %d bytes in %d packets, want %d bytes", tt.name, len(got), len(sink.packets), len(tt.want))
+		}
+	}
+}
+
+func TestIngestRejectsInvalidAVCConfig(t *testing.T) {
+	valid := avcConfig(4)
+	for n := 0; n < len(valid); n++ {
+		i := newIngest(nil, "test")
+		if err := i.configureVideo(valid[:n]); !errors.Is(err, errAVCConfig) {
+			t.Errorf("configured with %d bytes of the record: %v", n, err)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package rtmp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strings"
+)
+
+// StreamKey returns the key publishing into the stream streamID requires,
+// derived from the server secret so that it never has to be stored.
+func StreamKey(secret, streamID string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(streamID))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// PublishName returns the name an encoder publishes streamID with, the
+// "stream key" field of OBS.
+func PublishName(secret, streamID string) string {
+	return streamID + "?key=" + StreamKey(secret, streamID)
+}
+
+// parsePublishName splits a publish name into the stream ID and its key.
+func parsePublishName(name string) (streamID, key string) {
+	streamID, query, _ := strings.Cut(name, "?")
+	values, _ := url.ParseQuery(query)
+	return streamID, values.Get("key")
+}
+
+// validKey reports whether key is the stream key of streamID.
+func validKey(secret, streamID, key string) bool {
+	return hmac.Equal([]byte(StreamKey(secret, streamID)), []byte(key))
+}
@@ -0,0 +1,246 @@
+// Package rtmp accepts RTMP publishes, e.g. from OBS, and feeds their H.264
+// video into the stream of a room. Their audio is dropped.
+//
+// Encoders publish to rtmp://<host>/live with the publish name, the "stream
+// key", returned by PublishName.
+package rtmp
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+
+	w "quick-video/pkg/webrtc"
+)
+
+// Server accepts RTMP publishes into the streams of Rooms.
+type Server struct {
+	Addr  string
+	Rooms w.RoomStore
+	// Secret signs the stream keys, see StreamKey.
+	Secret string
+
+	lock       sync.Mutex
+	listener   net.Listener
+	publishing map[string]bool
+}
+
+// ListenAndServe listens on s.Addr and serves publishes until Close is called.
+func (s *Server) ListenAndServe() error {
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+func (s *Server) Serve(l net.Listener) error {
+	s.lock.Lock()
+	s.listener = l
+	if s.publishing == nil {
+		s.publishing = make(map[string]bool)
+	}
+	s.lock.Unlock()
+
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.serve(nc)
+	}
+}
+
+func (s *Server) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+// claim reserves the stream streamID for one publisher at a time.
+func (s *Server) claim(streamID string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.publishing[streamID] {
+		return false
+	}
+	s.publishing[streamID] = true
+	return true
+}
+
+func (s *Server) release(streamID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.publishing, streamID)
+}
+
+func (s *Server) serve(nc net.Conn) {
+	defer nc.Close()
+
+	sess := &session{server: s, conn: newConn(nc)}
+	defer sess.unpublish()
+
+	if err := sess.run(); err != nil && !errors.Is(err, errDone) {
+		log.Printf("rtmp %s: %s", nc.RemoteAddr(), err)
+	}
+}
+
+var errDone = errors.New("publish ended")
+
+// session is the server side of one RTMP connection.
+type session struct {
+	server *Server
+	conn   *conn
+
+	streamID string
+	ingest   *ingest
+}
+
+func (s *session) run() error {
+	if err := s.conn.handshake(); err != nil {
+		return err
+	}
+
+	for {
+		m, err := s.conn.readMessage()
+		if err != nil {
+			return err
+		}
+
+		switch m.typ {
+		case msgCommandAMF3:
+			if len(m.payload) < 1 {
+				continue
+			}
+			m.payload = m.payload[1:]
+			fallthrough
+		case msgCommandAMF0:
+			values, err := decodeAMF(m.payload)
+			if err != nil {
+				return err
+			}
+			if err := s.command(m.streamID, values); err != nil {
+				return err
+			}
+		case msgVideo:
+			if s.ingest != nil {
+				s.ingest.writeVideo(m)
+			}
+		case msgAudio:
+			if s.ingest != nil {
+				s.ingest.writeAudio(m)
+			}
+		}
+	}
+}
+
+func (s *session) command(streamID uint32, values []interface{}) error {
+	if len(values) < 2 {
+		return nil
+	}
+	name, _ := values[0].(string)
+	txn, _ := values[1].(float64)
+
+	switch name {
+	case "connect":
+		if err := s.conn.writeControl(msgSetChunkSize, serverChunkSize); err != nil {
+			return err
+		}
+		if err := s.conn.writeControl(msgWindowAckSize, windowAckSize); err != nil {
+			return err
+		}
+		// Dynamic limit type.
+		if err := s.conn.writeControl(msgSetPeerBandwidth, windowAckSize, 2); err != nil {
+			return err
+		}
+		return s.conn.writeCommand(0, "_result", txn,
+			amfObj{"fmsVer": "FMS/3,0,1,123", "capabilities": 31},
+			amfObj{
+				"level":          "status",
+				"code":           "NetConnection.Connect.Success",
+				"description":    "Connection succeeded.",
+				"objectEncoding": 0,
+			})
+	case "releaseStream", "FCPublish":
+		return s.conn.writeCommand(0, "_result", txn, nil, amfUndef{})
+	case "createStream":
+		return s.conn.writeCommand(0, "_result", txn, nil, 1)
+	case "publish":
+		if len(values) < 4 {
+			return fmt.Errorf("%w: publish without a name", errProtocol)
+		}
+		publishName, _ := values[3].(string)
+		return s.publish(streamID, publishName)
+	case "FCUnpublish", "deleteStream", "closeStream":
+		return errDone
+	}
+	return nil
+}
+
+func (s *session) publish(messageStreamID uint32, name string) error {
+	if s.ingest != nil {
+		return s.status(messageStreamID, "error", "NetStream.Publish.BadName", "already publishing")
+	}
+
+	streamID, key := parsePublishName(name)
+	if !validKey(s.server.Secret, streamID, key) {
+		return s.reject(messageStreamID, "invalid stream key")
+	}
+
+	room, ok := s.server.Rooms.ByStreamID(streamID)
+	if !ok {
+		return s.reject(messageStreamID, "unknown stream")
+	}
+
+	if !s.server.claim(streamID) {
+		return s.reject(messageStreamID, "the stream is already published")
+	}
+	s.streamID = streamID
+	s.ingest = newIngest(room, streamID)
+	log.Printf("rtmp %s: publishing into stream %s", s.conn.nc.RemoteAddr(), streamID)
+
+	// Stream Begin.
+	if err := s.conn.writeMessage(csidControl, &message{
+		typ:     msgUserControl,
+		payload: []byte{0, 0, byte(messageStreamID >> 24), byte(messageStreamID >> 16), byte(messageStreamID >> 8), byte(messageStreamID)},
+	}); err != nil {
+		return err
+	}
+	return s.status(messageStreamID, "status", "NetStream.Publish.Start", "publishing")
+}
+
+// reject refuses a publish and ends the connection.
+func (s *session) reject(messageStreamID uint32, reason string) error {
+	if err := s.status(messageStreamID, "error", "NetStream.Publish.BadName", reason); err != nil {
+		return err
+	}
+	return fmt.Errorf("publish rejected: %s", reason)
+}
+
+func (s *session) status(messageStreamID uint32, level, code, description string) error {
+	return s.conn.writeCommand(messageStreamID, "onStatus", 0, nil, amfObj{
+		"level":       level,
+		"code":        code,
+		"description": description,
+	})
+}
+
+func (s *session) unpublish() {
+	if s.ingest == nil {
+		return
+	}
+
+	s.ingest.close()
+	s.server.release(s.streamID)
+	log.Printf("rtmp %s: stopped publishing into stream %s", s.conn.nc.RemoteAddr(), s.streamID)
+}
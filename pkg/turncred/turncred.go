@@ -0,0 +1,50 @@
+// Package turncred implements the time-limited TURN credentials of the
+// "REST API For Access To TURN Services" draft, which coturn and pion share:
+// the username is "expiry:userid", where expiry is a unix timestamp, and the
+// password is the base64 encoded HMAC-SHA1 of the username keyed with a
+// secret known to both the TURN server and the application server.
+package turncred
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMalformed = errors.New("turncred: malformed username")
+	ErrExpired   = errors.New("turncred: credentials expired")
+)
+
+// Generate returns a username and password for userID that stay valid for ttl.
+func Generate(secret, userID string, ttl time.Duration) (username, password string) {
+	username = strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	if userID != "" {
+		username += ":" + userID
+	}
+	return username, Password(secret, username)
+}
+
+// Password returns the password that belongs to username.
+func Password(secret, username string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Validate checks that username has not expired at now and returns its password.
+func Validate(secret, username string, now time.Time) (string, error) {
+	expiry, _, _ := strings.Cut(username, ":")
+	timestamp, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		return "", ErrMalformed
+	}
+	if now.Unix() > timestamp {
+		return "", ErrExpired
+	}
+	return Password(secret, username), nil
+}
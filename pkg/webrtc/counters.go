@@ -0,0 +1,38 @@
+package webrtc
+
+import "sync/atomic"
+
+// Counters count what the SFU does for the peers of a room, for monitoring.
+type Counters struct {
+	// ForwardedPackets and ForwardedBytes count the RTP packets sent to
+	// subscribers and sinks.
+	ForwardedPackets atomic.Uint64
+	ForwardedBytes   atomic.Uint64
+
+	// PLIsReceived counts the key frame requests (PLI and FIR) of the
+	// subscribers, PLIsSent the PLIs sent to the publishers.
+	PLIsReceived  atomic.Uint64
+	PLIsSent      atomic.Uint64
+	NACKsReceived atomic.Uint64
+
+	// SyncAttempts counts the passes of SignalPeerConnections over the
+	// connections, and SyncGiveUps the times it gave up after too many
+	// passes and tried again later. Offers counts the offers sent.
+	SyncAttempts atomic.Uint64
+	SyncGiveUps  atomic.Uint64
+	Offers       atomic.Uint64
+}
+
+func (c *Counters) forwarded(bytes int) {
+	if c == nil {
+		return
+	}
+	c.ForwardedPackets.Add(1)
+	c.ForwardedBytes.Add(uint64(bytes))
+}
+
+func (c *Counters) pliSent() {
+	if c != nil {
+		c.PLIsSent.Add(1)
+	}
+}
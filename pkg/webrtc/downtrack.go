@@ -0,0 +1,273 @@
+package webrtc
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// keyFrameRequestInterval is the minimum time between two key frame
+// requests a DownTrack sends while it waits for a key frame.
+const keyFrameRequestInterval = 500 * time.Millisecond
+
+// DownTrack is the TrackLocal sending a Track to a single subscriber. It
+// rewrites the SSRC, sequence numbers and timestamps of the forwarded
+// packets, so that it can be paused, resumed or switched to another
+// simulcast layer while the subscriber keeps seeing one continuous stream.
+type DownTrack struct {
+	track      *Track
+	subscriber *webrtc.PeerConnection
+	bandwidth  *Bandwidth
+
+	lock        sync.Mutex
+	bound       bool
+	ssrc        webrtc.SSRC
+	payloadType webrtc.PayloadType
+	clockRate   uint32
+	writer      webrtc.TrackLocalWriter
+
+	// forwarding is set while packets of the current layer are sent. target
+	// is the layer to switch to on its next key frame and pinned the layer
+	// the subscriber asked for.
+	forwarding              bool
+	current, target, pinned string
+	paused                  bool
+	maxBitrate              int
+	lastEvaluation          time.Time
+	lastKeyFrameRequest     time.Time
+
+	started   bool
+	seqOffset uint16
+	tsOffset  uint32
+	lastSeq   uint16
+	lastTS    uint32
+	lastWrite time.Time
+	// frames counts the frames sent, ended by a marker bit.
+	frames uint64
+}
+
+func (d *DownTrack) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	codec, ok := matchCodec(d.track.codec, ctx.CodecParameters())
+	if !ok {
+		return webrtc.RTPCodecParameters{}, webrtc.ErrUnsupportedCodec
+	}
+
+	d.lock.Lock()
+	d.bound = true
+	d.ssrc = ctx.SSRC()
+	d.payloadType = codec.PayloadType
+	d.clockRate = codec.ClockRate
+	d.writer = ctx.WriteStream()
+	d.lock.Unlock()
+
+	if d.Kind() == webrtc.RTPCodecTypeVideo {
+		d.bandwidth.tracks.Add(1)
+	}
+	return codec, nil
+}
+
+func (d *DownTrack) Unbind(webrtc.TrackLocalContext) error {
+	d.lock.Lock()
+	wasBound := d.bound
+	d.bound = false
+	d.lock.Unlock()
+
+	if wasBound && d.Kind() == webrtc.RTPCodecTypeVideo {
+		d.bandwidth.tracks.Add(-1)
+	}
+	d.track.removeDownTrack(d)
+	return nil
+}
+
+func (d *DownTrack) ID() string { return d.track.ID() }
+
+func (d *DownTrack) RID() string { return "" }
+
+func (d *DownTrack) StreamID() string { return d.track.StreamID() }
+
+func (d *DownTrack) Kind() webrtc.RTPCodecType { return d.track.Kind() }
+
+// Pause stops forwarding packets to the subscriber until Resume is called.
+func (d *DownTrack) Pause() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.paused = true
+	d.forwarding = false
+}
+
+// Resume starts forwarding again, from the next key frame on.
+func (d *DownTrack) Resume() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.paused = false
+	d.lastEvaluation = time.Time{}
+	d.lastKeyFrameRequest = time.Time{}
+}
+
+func (d *DownTrack) Paused() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.paused
+}
+
+// SetMaxBitrate caps the bitrate, in bits per second, of the layer picked
+// for the subscriber. Zero removes the cap.
+func (d *DownTrack) SetMaxBitrate(bitrate int) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.maxBitrate = bitrate
+	d.lastEvaluation = time.Time{}
+}
+
+// sent returns the SSRC the DownTrack sends with, whether it is bound, and
+// the number of frames it sent.
+func (d *DownTrack) sent() (webrtc.SSRC, bool, uint64) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.ssrc, d.bound, d.frames
+}
+
+// RequestKeyFrame forwards a key frame request of the subscriber to the
+// publisher of the layer it receives.
+func (d *DownTrack) RequestKeyFrame() {
+	d.lock.Lock()
+	current, forwarding := d.current, d.forwarding
+	d.lock.Unlock()
+
+	if forwarding {
+		d.track.requestKeyFrame(current)
+	}
+}
+
+func (d *DownTrack) pin(rid string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.pinned = rid
+	d.lastEvaluation = time.Time{}
+}
+
+func (d *DownTrack) writeRTP(rid string, pkt *rtp.Packet, keyFrame bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if !d.bound || d.paused {
+		return
+	}
+
+	if time.Since(d.lastEvaluation) >= layerEvaluationInterval {
+		d.lastEvaluation = time.Now()
+		d.selectLayer()
+	}
+
+	if !d.forwarding || rid != d.current {
+		// Start on a key frame of the target layer, or of any layer if
+		// none has been picked yet.
+		if d.target != "" && rid != d.target {
+			return
+		}
+		if !keyFrame {
+			d.waitKeyFrame(rid)
+			return
+		}
+		d.switchTo(rid, pkt)
+	}
+
+	header := pkt.Header
+	header.SSRC = uint32(d.ssrc)
+	header.PayloadType = uint8(d.payloadType)
+	header.SequenceNumber -= d.seqOffset
+	header.Timestamp -= d.tsOffset
+	// The header extension IDs negotiated with the publisher mean nothing
+	// to the subscriber.
+	header.Extension = false
+	header.Extensions = nil
+
+	if _, err := d.writer.WriteRTP(&header, pkt.Payload); err != nil {
+		return
+	}
+	d.track.counters.forwarded(header.MarshalSize() + len(pkt.Payload))
+	if header.Marker {
+		d.frames++
+	}
+
+	if !d.started || int16(header.SequenceNumber-d.lastSeq) > 0 {
+		d.started = true
+		d.lastSeq = header.SequenceNumber
+		d.lastTS = header.Timestamp
+		d.lastWrite = time.Now()
+	}
+}
+
+// selectLayer picks the target layer among the live ones: the pinned one if
+// any, otherwise the highest layer that fits in the subscriber's share of the
+// bandwidth and under its bitrate cap.
+func (d *DownTrack) selectLayer() {
+	layers := d.track.layerBitrates()
+	if len(layers) == 0 {
+		return
+	}
+
+	pinned := false
+	for _, l := range layers {
+		pinned = pinned || l.rid == d.pinned
+	}
+
+	target := layers[0].rid
+	if pinned {
+		target = d.pinned
+	} else if d.bandwidth == nil {
+		// Sinks are not limited by a network link and get the best layer.
+		target = layers[len(layers)-1].rid
+	} else {
+		budget := d.bandwidth.Share()
+		if d.maxBitrate > 0 && d.maxBitrate < budget {
+			budget = d.maxBitrate
+		}
+		for _, l := range layers {
+			if l.bitrate <= budget {
+				target = l.rid
+			}
+		}
+	}
+
+	if target != d.target {
+		d.target = target
+		if !d.forwarding || target != d.current {
+			d.lastKeyFrameRequest = time.Time{}
+			d.waitKeyFrame(target)
+		}
+	}
+}
+
+// waitKeyFrame asks the publisher for a key frame on layer rid, unless it
+// was asked very recently.
+func (d *DownTrack) waitKeyFrame(rid string) {
+	if time.Since(d.lastKeyFrameRequest) < keyFrameRequestInterval {
+		return
+	}
+	d.lastKeyFrameRequest = time.Now()
+	go d.track.requestKeyFrame(rid)
+}
+
+// switchTo starts forwarding layer rid from pkt on, continuing the sequence
+// numbers and timestamps sent so far.
+func (d *DownTrack) switchTo(rid string, pkt *rtp.Packet) {
+	d.current = rid
+	d.forwarding = true
+	if !d.started {
+		return
+	}
+
+	ts := d.lastTS + uint32(time.Since(d.lastWrite).Seconds()*float64(d.clockRate))
+	if ts == d.lastTS {
+		ts++
+	}
+	d.seqOffset = pkt.SequenceNumber - (d.lastSeq + 1)
+	d.tsOffset = pkt.Timestamp - ts
+}
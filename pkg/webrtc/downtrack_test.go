@@ -0,0 +1,211 @@
+package webrtc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// packetWriter keeps the packets written to a DownTrack.
+type packetWriter struct {
+	packets []rtp.Packet
+}
+
+func (p *packetWriter) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	p.packets = append(p.packets, rtp.Packet{Header: *header, Payload: append([]byte(nil), payload...)})
+	return len(payload), nil
+}
+
+func (p *packetWriter) Write(b []byte) (int, error) {
+	pkt := rtp.Packet{}
+	if err := pkt.Unmarshal(b); err != nil {
+		return 0, err
+	}
+	return p.WriteRTP(&pkt.Header, pkt.Payload)
+}
+
+// newTestTrack returns a video track with the layers rids, of a codec whose
+// packets all start key frames, sent to a DownTrack as to a sink.
+func newTestTrack(rids ...string) (*Track, *DownTrack, *packetWriter) {
+	t := newTrack(webrtc.RTPCodecCapability{MimeType: "video/test", ClockRate: 90000}, "track", "stream")
+	for _, rid := range rids {
+		// The bitrate is measured from the first packet on.
+		t.layers[rid] = &trackLayer{rid: rid, windowStart: time.Now().Add(-layerEvaluationInterval)}
+	}
+
+	out := &packetWriter{}
+	d := &DownTrack{track: t, bound: true, clockRate: 90000, writer: out}
+	t.downTracks[nil] = d
+	return t, d, out
+}
+
+// reevaluate makes d pick its layer again on the next packet.
+func reevaluate(d *DownTrack) {
+	d.lock.Lock()
+	d.lastEvaluation = time.Time{}
+	d.lock.Unlock()
+}
+
+func TestLayerStopsMidStream(t *testing.T) {
+	track, d, out := newTestTrack("q", "f")
+
+	var seq uint16
+	send := func(rid string, size int) {
+		seq++
+		payload := make([]byte, size)
+		payload[0] = rid[0]
+		track.WriteRTP(rid, &rtp.Packet{
+			Header:  rtp.Header{SequenceNumber: seq, Timestamp: uint32(seq) * 3000, Marker: true},
+			Payload: payload,
+		})
+	}
+	forwarded := func() string {
+		if len(out.packets) == 0 {
+			return ""
+		}
+		return string(out.packets[len(out.packets)-1].Payload[:1])
+	}
+
+	// Only q has sent yet: it is picked rather than nothing.
+	send("q", 100)
+	if got := track.layerBitrates(); len(got) != 1 || got[0].rid != "q" {
+		t.Fatalf("live layers %v, want q", got)
+	}
+	if got := forwarded(); got != "q" {
+		t.Fatalf("forwarding %q, want q", got)
+	}
+
+	// f sends at a higher bitrate and the sink moves up to it.
+	send("f", 1000)
+	reevaluate(d)
+	send("f", 1000)
+	if got := forwarded(); got != "f" {
+		t.Fatalf("forwarding %q, want f", got)
+	}
+
+	// f stops: its last bitrate keeps no one on it.
+	track.lock.Lock()
+	track.layers["f"].lastPacket = time.Now().Add(-layerEvaluationInterval)
+	track.lock.Unlock()
+	reevaluate(d)
+	send("q", 100)
+	if got := track.layerBitrates(); len(got) != 1 || got[0].rid != "q" {
+		t.Fatalf("live layers %v, want q", got)
+	}
+	if got := forwarded(); got != "q" {
+		t.Fatalf("forwarding %q after f stopped, want q", got)
+	}
+
+	// A layer pinned but silent is left for a live one too.
+	if err := track.SetLayer(nil, "f"); err != nil {
+		t.Fatal(err)
+	}
+	send("q", 100)
+	if got := forwarded(); got != "q" {
+		t.Errorf("forwarding %q with f pinned but stopped, want q", got)
+	}
+
+	// f is back.
+	reevaluate(d)
+	send("f", 1000)
+	if got := forwarded(); got != "f" {
+		t.Errorf("forwarding %q once f is back, want f", got)
+	}
+}
+
+// checkContiguous fails unless the sequence numbers of packets follow each
+// other and their timestamps never go back, across wraps.
+func checkContiguous(t *testing.T, packets []rtp.Packet) {
+	t.Helper()
+
+	for i := 1; i < len(packets); i++ {
+		prev, cur := packets[i-1].Header, packets[i].Header
+		if cur.SequenceNumber != prev.SequenceNumber+1 {
+			t.Errorf("packet %d: sequence number %d after %d", i, cur.SequenceNumber, prev.SequenceNumber)
+		}
+		if int32(cur.Timestamp-prev.Timestamp) <= 0 {
+			t.Errorf("packet %d: timestamp %d after %d", i, cur.Timestamp, prev.Timestamp)
+		}
+		if cur.SSRC != prev.SSRC {
+			t.Errorf("packet %d: SSRC %d after %d", i, cur.SSRC, prev.SSRC)
+		}
+	}
+}
+
+func TestDownTrackRewrite(t *testing.T) {
+	type layerStart struct {
+		rid string
+		seq uint16
+		ts  uint32
+	}
+	tests := []struct {
+		name string
+		// layers are the layers sent, a packet of each in turn, and the
+		// DownTrack is switched from the first to the second halfway.
+		layers []layerStart
+	}{
+		{"one layer", []layerStart{{"", 1000, 90000}}},
+		{"sequence wrap", []layerStart{{"", 65530, 90000}}},
+		{"timestamp wrap", []layerStart{{"", 1000, 1<<32 - 3*3000}}},
+		{"layer switch", []layerStart{{"q", 1000, 90000}, {"f", 30000, 5000000}}},
+		{"layer switch up across wraps", []layerStart{{"q", 65530, 1<<32 - 3*3000}, {"f", 100, 90000}}},
+		{"layer switch down across wraps", []layerStart{{"f", 100, 90000}, {"q", 65530, 1<<32 - 3*3000}}},
+	}
+
+	for _, tt := range tests {
+		rids := make([]string, len(tt.layers))
+		for i, l := range tt.layers {
+			rids[i] = l.rid
+		}
+		track, d, out := newTestTrack(rids...)
+		d.ssrc = 1234
+		if err := track.SetLayer(nil, tt.layers[0].rid); tt.layers[0].rid != "" && err != nil {
+			t.Fatal(err)
+		}
+
+		const packets = 12
+		for i := 0; i < packets; i++ {
+			if i == packets/2 && len(tt.layers) > 1 {
+				if err := track.SetLayer(nil, tt.layers[1].rid); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, l := range tt.layers {
+				track.WriteRTP(l.rid, &rtp.Packet{
+					Header: rtp.Header{
+						SSRC:           uint32(len(l.rid)),
+						SequenceNumber: l.seq + uint16(i),
+						Timestamp:      l.ts + uint32(i)*3000,
+						Marker:         true,
+					},
+					Payload: []byte(l.rid + "!"),
+				})
+			}
+		}
+
+		// The first layer is forwarded until the key frame of the second,
+		// which comes after one more packet of the first.
+		switched := packets / 2
+		if len(tt.layers) > 1 {
+			switched++
+		}
+		if len(out.packets) != packets+switched-packets/2 {
+			t.Errorf("%s: forwarded %d packets, want %d", tt.name, len(out.packets), packets+switched-packets/2)
+		}
+		if len(out.packets) > 0 && out.packets[0].SSRC != 1234 {
+			t.Errorf("%s: sent with SSRC %d", tt.name, out.packets[0].SSRC)
+		}
+		for i, pkt := range out.packets {
+			want := tt.layers[0].rid
+			if i >= switched {
+				want = tt.layers[len(tt.layers)-1].rid
+			}
+			if string(pkt.Payload) != want+"!" {
+				t.Errorf("%s: packet %d from layer %q, want %q", tt.name, i, pkt.Payload, want)
+			}
+		}
+		checkContiguous(t, out.packets)
+	}
+}
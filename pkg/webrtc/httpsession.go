@@ -0,0 +1,256 @@
+package webrtc
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	guuid "github.com/google/uuid"
+	"github.com/pion/webrtc/v3"
+)
+
+// gatheringTimeout bounds how long the answer to an HTTP offer waits for the
+// server candidates.
+const gatheringTimeout = 5 * time.Second
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// HTTPSession is a peer negotiated with a single offer/answer exchange over
+// HTTP, as in WHIP and WHEP, instead of over the signaling socket. The server
+// cannot send it offers, so its tracks are fixed by the first exchange: a
+// subscriber receives the tracks published at that time, as many of them as
+// it offered m-lines for.
+type HTTPSession struct {
+	ID    string
+	Role  Role
+	Peers *Peers
+
+	peerConnection *webrtc.PeerConnection
+	done           chan struct{}
+	closeOnce      sync.Once
+}
+
+// NewHTTPSession answers offer with a new peer of the given role. The answer
+// carries every server candidate, the client may still trickle its own.
+func NewHTTPSession(p *Peers, s *Settings, role Role, offer string) (*HTTPSession, string, error) {
+	peerConnection, estimator, getter, err := s.NewPeerConnection()
+	if err != nil {
+		return nil, "", err
+	}
+
+	session := &HTTPSession{
+		ID:             guuid.New().String(),
+		Role:           role,
+		Peers:          p,
+		peerConnection: peerConnection,
+		done:           make(chan struct{}),
+	}
+
+	if role.Publishes() {
+		peerConnection.OnTrack(func(tr *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+			p.forward(tr, peerConnection)
+		})
+	}
+	peerConnection.OnConnectionStateChange(func(pcs webrtc.PeerConnectionState) {
+		switch pcs {
+		case webrtc.PeerConnectionStateFailed:
+			session.Close()
+		case webrtc.PeerConnectionStateClosed:
+			session.Close()
+			p.SignalPeerConnections()
+		}
+	})
+
+	state := PeerConnectionState{
+		ID:             session.ID,
+		JoinedAt:       time.Now(),
+		PeerConnection: peerConnection,
+		Bandwidth:      NewBandwidth(estimator),
+		Role:           role,
+		Quality:        NewQualityMonitor(peerConnection, getter),
+	}
+
+	// The tracks are added before the offer is applied, so that they are
+	// matched with the m-lines the client offered to receive.
+	var downTracks map[*webrtc.RTPSender]*DownTrack
+	fail := func(err error) (*HTTPSession, string, error) {
+		for _, d := range downTracks {
+			d.track.removeDownTrack(d)
+		}
+		session.Close()
+		return nil, "", err
+	}
+
+	if role.Subscribes() {
+		if downTracks, err = p.subscribe(state); err != nil {
+			return fail(err)
+		}
+	}
+
+	if err := peerConnection.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  offer,
+	}); err != nil {
+		return fail(err)
+	}
+
+	p.ListLock.Lock()
+	p.Connections = append(p.Connections, state)
+	p.ListLock.Unlock()
+
+	answer, err := peerConnection.CreateAnswer(nil)
+	if err != nil {
+		return fail(err)
+	}
+
+	gathered := webrtc.GatheringCompletePromise(peerConnection)
+	if err = peerConnection.SetLocalDescription(answer); err != nil {
+		return fail(err)
+	}
+
+	for _, t := range peerConnection.GetTransceivers() {
+		d, ok := downTracks[t.Sender()]
+		if !ok {
+			continue
+		}
+
+		// Tracks the client has no m-line for are not sent.
+		if t.Mid() == "" {
+			d.track.removeDownTrack(d)
+			if err := peerConnection.RemoveTrack(t.Sender()); err != nil {
+				log.Println(err)
+			}
+			continue
+		}
+		go readRTCP(t.Sender(), d.RequestKeyFrame, &p.Counters)
+	}
+
+	select {
+	case <-gathered:
+	case <-time.After(gatheringTimeout):
+	}
+
+	return session, peerConnection.LocalDescription().SDP, nil
+}
+
+// AddICECandidates adds the candidates of a trickle-ice-sdpfrag (RFC 8840) body.
+func (s *HTTPSession) AddICECandidates(frag string) error {
+	var mid, ufrag string
+	for _, line := range strings.Split(frag, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			ufrag = strings.TrimPrefix(line, "a=ice-ufrag:")
+		case strings.HasPrefix(line, "m="):
+			mid = ""
+		case strings.HasPrefix(line, "a=mid:"):
+			mid = strings.TrimPrefix(line, "a=mid:")
+		case strings.HasPrefix(line, "a=candidate:"):
+			candidate := webrtc.ICECandidateInit{
+				Candidate: strings.TrimPrefix(line, "a="),
+			}
+			if mid != "" {
+				candidate.SDPMid = &mid
+			}
+			if ufrag != "" {
+				candidate.UsernameFragment = &ufrag
+			}
+
+			if err := s.peerConnection.AddICECandidate(candidate); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Done is closed once the session ended.
+func (s *HTTPSession) Done() <-chan struct{} {
+	return s.done
+}
+
+// Close ends the session.
+func (s *HTTPSession) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		err = s.peerConnection.Close()
+		close(s.done)
+	})
+	return err
+}
+
+// HTTPSessions keeps the HTTP sessions by ID until they end.
+type HTTPSessions struct {
+	lock     sync.Mutex
+	sessions map[string]*HTTPSession
+}
+
+func NewHTTPSessions() *HTTPSessions {
+	return &HTTPSessions{sessions: make(map[string]*HTTPSession)}
+}
+
+// Add keeps s until it is done.
+func (h *HTTPSessions) Add(s *HTTPSession) {
+	h.lock.Lock()
+	h.sessions[s.ID] = s
+	h.lock.Unlock()
+
+	go func() {
+		<-s.Done()
+		h.lock.Lock()
+		delete(h.sessions, s.ID)
+		h.lock.Unlock()
+	}()
+}
+
+func (h *HTTPSessions) Get(id string) (*HTTPSession, bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	s, ok := h.sessions[id]
+	return s, ok
+}
+
+// Close ends the session with the given ID.
+func (h *HTTPSessions) Close(id string) error {
+	s, ok := h.Get(id)
+	if !ok {
+		return ErrSessionNotFound
+	}
+	return s.Close()
+}
+
+// subscribe adds every published track to the PeerConnection of state,
+// ordered by stream so that the tracks of a publisher stay together.
+func (p *Peers) subscribe(state PeerConnectionState) (map[*webrtc.RTPSender]*DownTrack, error) {
+	p.ListLock.RLock()
+	tracks := make([]*Track, 0, len(p.Tracks))
+	for _, t := range p.Tracks {
+		tracks = append(tracks, t)
+	}
+	p.ListLock.RUnlock()
+
+	sort.Slice(tracks, func(i, j int) bool {
+		if tracks[i].StreamID() != tracks[j].StreamID() {
+			return tracks[i].StreamID() < tracks[j].StreamID()
+		}
+		return tracks[i].ID() < tracks[j].ID()
+	})
+
+	downTracks := make(map[*webrtc.RTPSender]*DownTrack)
+	for _, t := range tracks {
+		d := t.Subscribe(state.PeerConnection, state.Bandwidth)
+		transceiver, err := state.PeerConnection.AddTransceiverFromTrack(d, webrtc.RTPTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionSendonly,
+		})
+		if err != nil {
+			t.removeDownTrack(d)
+			return downTracks, err
+		}
+		downTracks[transceiver.Sender()] = d
+	}
+	return downTracks, nil
+}
@@ -0,0 +1,108 @@
+package webrtc
+
+import (
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// isKeyFrame reports whether payload, the payload of an RTP packet of the
+// given codec, starts a key frame. Codecs it does not know are always
+// reported as key frames, so that layer switches are never held back forever.
+func isKeyFrame(mimeType string, payload []byte) bool {
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		return isVP8KeyFrame(payload)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		return isVP9KeyFrame(payload)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		return isH264KeyFrame(payload)
+	}
+	return true
+}
+
+// isVP8KeyFrame parses the VP8 payload descriptor of RFC 7741 and the first
+// byte of the VP8 frame header it precedes.
+func isVP8KeyFrame(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+
+	// Only the first partition of a frame carries the frame header.
+	s, pid := payload[0]&0x10 != 0, payload[0]&0x07
+	if !s || pid != 0 {
+		return false
+	}
+
+	i := 1
+	if payload[0]&0x80 != 0 {
+		if len(payload) <= i {
+			return false
+		}
+		x := payload[i]
+		i++
+		if x&0x80 != 0 { // PictureID, 7 or 15 bits
+			if len(payload) <= i {
+				return false
+			}
+			if payload[i]&0x80 != 0 {
+				i++
+			}
+			i++
+		}
+		if x&0x40 != 0 { // TL0PICIDX
+			i++
+		}
+		if x&0x30 != 0 { // TID, KEYIDX
+			i++
+		}
+	}
+
+	if len(payload) <= i {
+		return false
+	}
+	// The P bit of the frame header is 0 for key frames.
+	return payload[i]&0x01 == 0
+}
+
+// isVP9KeyFrame checks the flexible and non-flexible VP9 payload descriptor:
+// a key frame starts a frame (B) and is not inter-picture predicted (P).
+func isVP9KeyFrame(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	p, b := payload[0]&0x40 != 0, payload[0]&0x08 != 0
+	return !p && b
+}
+
+// isH264KeyFrame looks for an IDR slice or a sequence parameter set in
+// single NAL unit, STAP-A and FU-A packets.
+func isH264KeyFrame(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+
+	switch nalType := payload[0] & 0x1F; nalType {
+	case 5, 7:
+		return true
+	case 24: // STAP-A
+		for i := 1; i+2 < len(payload); {
+			size := int(payload[i])<<8 | int(payload[i+1])
+			i += 2
+			if i >= len(payload) {
+				return false
+			}
+			if t := payload[i] & 0x1F; t == 5 || t == 7 {
+				return true
+			}
+			i += size
+		}
+	case 28: // FU-A
+		if len(payload) < 2 {
+			return false
+		}
+		start, t := payload[1]&0x80 != 0, payload[1]&0x1F
+		return start && (t == 5 || t == 7)
+	}
+	return false
+}
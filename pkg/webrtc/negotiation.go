@@ -0,0 +1,145 @@
+package webrtc
+
+import (
+	"sync"
+
+	"quick-video/pkg/protocol"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Negotiation serializes the offers the server makes on a PeerConnection
+// with the offers made by the client, following the perfect negotiation
+// pattern. The server is the impolite peer: when both sides offer at the same
+// time the client's offer is ignored, and the client, being polite, rolls its
+// own offer back and answers the server's one.
+type Negotiation struct {
+	lock sync.Mutex
+	pc   *webrtc.PeerConnection
+
+	// pending is set when the server had to hold back an offer because the
+	// client was in the middle of its own negotiation.
+	pending bool
+	// ignoredOffer is set while the last client offer was ignored, so that
+	// the candidates trickled for it can be ignored as well.
+	ignoredOffer bool
+}
+
+func NewNegotiation(pc *webrtc.PeerConnection) *Negotiation {
+	return &Negotiation{pc: pc}
+}
+
+// State returns the signaling state of the PeerConnection.
+func (n *Negotiation) State() webrtc.SignalingState {
+	return n.pc.SignalingState()
+}
+
+// Offer creates a server offer and hands it to send. If the client offer is
+// being answered the offer is held back until the client is stable again.
+func (n *Negotiation) Offer(send func(offer webrtc.SessionDescription) error) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.pc.SignalingState() == webrtc.SignalingStateHaveRemoteOffer {
+		n.pending = true
+		return nil
+	}
+
+	offer, err := n.pc.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+
+	if err = n.pc.SetLocalDescription(offer); err != nil {
+		return err
+	}
+	return send(offer)
+}
+
+// AcceptOffer applies an offer made by the client and hands the answer to
+// send. It reports false if the offer collided with a server offer and was ignored.
+//
+// The lock is released once the offer is applied, so that the server offers
+// made until the answer is set are held back as pending rather than waiting
+// for it, with the peers locked.
+func (n *Negotiation) AcceptOffer(sdp string, send func(answer webrtc.SessionDescription) error) (bool, error) {
+	n.lock.Lock()
+	n.ignoredOffer = n.pc.SignalingState() != webrtc.SignalingStateStable
+	if n.ignoredOffer {
+		n.lock.Unlock()
+		return false, nil
+	}
+
+	err := n.pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  sdp,
+	})
+	n.lock.Unlock()
+	if err != nil {
+		return false, err
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	// Only the goroutine reading the client applies remote descriptions,
+	// and Offer leaves the PeerConnection alone in this state.
+	if state := n.pc.SignalingState(); state != webrtc.SignalingStateHaveRemoteOffer {
+		return false, protocol.Errorf(protocol.CodeUnexpected, "offer applied, but signaling state is %s", state)
+	}
+
+	answer, err := n.pc.CreateAnswer(nil)
+	if err != nil {
+		return false, err
+	}
+
+	if err = n.pc.SetLocalDescription(answer); err != nil {
+		return false, err
+	}
+
+	// The answer is sent while holding the lock, a server offer must not
+	// overtake it on the socket.
+	return true, send(answer)
+}
+
+// AcceptAnswer applies the client answer to the last server offer.
+func (n *Negotiation) AcceptAnswer(sdp string) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if state := n.pc.SignalingState(); state != webrtc.SignalingStateHaveLocalOffer {
+		return protocol.Errorf(protocol.CodeUnexpected, "answer received in signaling state %s", state)
+	}
+
+	return n.pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  sdp,
+	})
+}
+
+// AddICECandidate adds a client candidate. Candidates of an ignored offer are dropped.
+func (n *Negotiation) AddICECandidate(candidate webrtc.ICECandidateInit) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	err := n.pc.AddICECandidate(candidate)
+	if err != nil && n.ignoredOffer {
+		return nil
+	}
+	return err
+}
+
+// TakePending reports whether an offer was held back and clears the flag.
+// The caller is expected to renegotiate if it was set.
+func (n *Negotiation) TakePending() bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.pc.SignalingState() != webrtc.SignalingStateStable {
+		return false
+	}
+
+	pending := n.pending
+	n.pending = false
+	return pending
+}
@@ -0,0 +1,135 @@
+package webrtc
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"quick-video/pkg/protocol"
+
+	"github.com/pion/webrtc/v3"
+)
+
+var (
+	ErrUnknownParticipant = errors.New("unknown participant")
+	ErrUnknownTrack       = errors.New("unknown track")
+)
+
+// Participant is a snapshot of a connection in a room.
+type Participant struct {
+	ID       string
+	Identity string
+	Name     string
+	Role     Role
+	// HTTP tells WHIP and WHEP sessions from signaling socket sessions.
+	HTTP     bool
+	State    webrtc.PeerConnectionState
+	JoinedAt time.Time
+	// Tracks are the IDs of the tracks the participant publishes.
+	Tracks []string
+	// Quality is the last quality sample of the connection, taken at
+	// QualityAt, nil before the first one.
+	Quality   *protocol.Quality
+	QualityAt time.Time
+}
+
+// Participants returns a snapshot of the connections of p.
+func (p *Peers) Participants() []Participant {
+	p.ListLock.RLock()
+	defer p.ListLock.RUnlock()
+
+	tracks := make(map[*webrtc.PeerConnection][]string)
+	for id, t := range p.Tracks {
+		if t.Publisher() != nil {
+			tracks[t.Publisher()] = append(tracks[t.Publisher()], id)
+		}
+	}
+
+	participants := make([]Participant, 0, len(p.Connections))
+	for _, c := range p.Connections {
+		quality, at := c.Quality.Last()
+		participants = append(participants, Participant{
+			ID:        c.ID,
+			Identity:  c.Identity,
+			Name:      c.Name,
+			Role:      c.Role,
+			HTTP:      c.Websocket == nil,
+			State:     c.PeerConnection.ConnectionState(),
+			JoinedAt:  c.JoinedAt,
+			Tracks:    tracks[c.PeerConnection],
+			Quality:   quality,
+			QualityAt: at,
+		})
+	}
+	return participants
+}
+
+// Publisher returns the ID of the connection t is published by, empty for
+// local tracks.
+func (p *Peers) Publisher(t *Track) string {
+	p.ListLock.RLock()
+	defer p.ListLock.RUnlock()
+
+	for _, c := range p.Connections {
+		if c.PeerConnection == t.Publisher() {
+			return c.ID
+		}
+	}
+	return ""
+}
+
+// Kick closes the connection with the given ID, telling the client why on
+// its signaling socket first.
+func (p *Peers) Kick(id, reason string) error {
+	p.ListLock.RLock()
+	var (
+		state PeerConnectionState
+		found bool
+	)
+	for _, c := range p.Connections {
+		if c.ID == id {
+			state, found = c, true
+			break
+		}
+	}
+	p.ListLock.RUnlock()
+
+	if !found {
+		return ErrUnknownParticipant
+	}
+
+	if state.Websocket != nil {
+		if err := state.Websocket.Send(protocol.TypeLeave, &protocol.Leave{Reason: reason}); err != nil {
+			log.Println(err)
+		}
+		if err := state.Websocket.Conn.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+	return state.PeerConnection.Close()
+}
+
+// MuteTrack stops or resumes forwarding the track trackID and tells every
+// subscriber, and the publisher, about it.
+func (p *Peers) MuteTrack(trackID string, muted bool) error {
+	p.ListLock.RLock()
+	track, ok := p.Tracks[trackID]
+	p.ListLock.RUnlock()
+
+	if !ok {
+		return ErrUnknownTrack
+	}
+
+	track.Mute(muted)
+	p.SetMuted(nil, trackID, muted)
+	return nil
+}
+
+// mutedByServer reports whether trackID was muted with MuteTrack.
+func (p *Peers) mutedByServer(trackID string) bool {
+	p.ListLock.RLock()
+	defer p.ListLock.RUnlock()
+
+	track, ok := p.Tracks[trackID]
+	return ok && track.Muted()
+}
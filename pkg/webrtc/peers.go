@@ -1,57 +1,64 @@
 package webrtc
 
 import (
-	"encoding/json"
 	"log"
-	"quick-video/pkg/chat"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"quick-video/pkg/chat"
+	"quick-video/pkg/protocol"
+
 	"github.com/gofiber/websocket/v2"
 	"github.com/pion/rtcp"
 	"github.com/pion/webrtc/v3"
 )
 
-var (
-	RoomsLock sync.RWMutex
-	Rooms     map[string]*Room
-	Streams   map[string]*Room
-)
-
-var (
-	turnConfig = webrtc.Configuration{
-		ICETransportPolicy: webrtc.ICETransportPolicyRelay,
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:turn.localhost:3478"},
-			},
-			{
-
-				URLs: []string{"turn:turn.localhost:3478"},
-
-				Username: "satya",
-
-				Credential:     "satya",
-				CredentialType: webrtc.ICECredentialTypePassword,
-			},
-		},
-	}
-)
-
 type Room struct {
-	Peers *Peers
-	Hub   *chat.Hub
+	ID        string
+	StreamID  string
+	Peers     *Peers
+	Hub       *chat.Hub
+	CreatedAt time.Time
+
+	lastUsed atomic.Int64
+	// viewers counts the open viewer sockets, which keep the room in use.
+	viewers atomic.Int32
 }
 
 type Peers struct {
 	ListLock    sync.RWMutex
 	Connections []PeerConnectionState
-	TrackLocals map[string]*webrtc.TrackLocalStaticRTP
+	// Tracks holds the published tracks by ID, which every subscriber
+	// receives through its own DownTrack.
+	Tracks map[string]*Track
+	// Muted holds the IDs of the tracks their publisher has muted.
+	Muted map[string]bool
+	// Counters count the packets forwarded and the signaling in the room.
+	Counters Counters
+
+	// sinkLock serializes the calls to the sinks, which may do disk I/O and
+	// are made without ListLock. It is taken before ListLock.
+	sinkLock sync.Mutex
+	sinks    map[Sink]bool
 }
 
 type PeerConnectionState struct {
+	// ID identifies the connection in the room. Identity and Name are those
+	// of the client's join token, if it had one.
+	ID             string
+	Identity       string
+	Name           string
+	JoinedAt       time.Time
 	PeerConnection *webrtc.PeerConnection
-	Websocket      *ThreadSafeWriter
+	// Negotiation and Websocket are nil for the peers negotiated over HTTP,
+	// which cannot be renegotiated.
+	Negotiation *Negotiation
+	Bandwidth   *Bandwidth
+	Websocket   *ThreadSafeWriter
+	Role        Role
+	// Quality measures the media sent and received over the connection.
+	Quality *QualityMonitor
 }
 
 type ThreadSafeWriter struct {
@@ -59,42 +66,114 @@ type ThreadSafeWriter struct {
 	Mutex sync.Mutex
 }
 
-type WebSocketMessage struct {
-	Event string `json:"event"`
-	Data  string `json:"data"`
-}
-
 func (t *ThreadSafeWriter) WriteJSON(v interface{}) error {
 	t.Mutex.Lock()
 	defer t.Mutex.Unlock()
 	return t.Conn.WriteJSON(v)
 }
 
-func (p *Peers) AddTrack(t *webrtc.TrackRemote) *webrtc.TrackLocalStaticRTP {
+// Send writes a signaling message of type typ carrying payload.
+func (t *ThreadSafeWriter) Send(typ protocol.Type, payload interface{}) error {
+	m, err := protocol.New(typ, payload)
+	if err != nil {
+		return err
+	}
+	return t.WriteJSON(m)
+}
+
+// SendError replies to the message m, which may be nil, with the error e.
+func (t *ThreadSafeWriter) SendError(m *protocol.Message, e *protocol.Error) error {
+	reply, err := protocol.New(protocol.TypeError, e)
+	if err != nil {
+		return err
+	}
+	if m != nil {
+		reply.ID = m.ID
+	}
+	return t.WriteJSON(reply)
+}
+
+// AddTrack adds the layer received on t to the track it belongs to,
+// creating the track on its first layer.
+func (p *Peers) AddTrack(t *webrtc.TrackRemote, publisher *webrtc.PeerConnection) *Track {
 	p.ListLock.Lock()
-	defer func() {
-		p.ListLock.Unlock()
+	track, ok := p.Tracks[t.ID()]
+	if !ok {
+		track = NewTrack(t, publisher)
+		track.counters = &p.Counters
+		p.Tracks[t.ID()] = track
+	}
+	track.AddLayer(t)
+	p.ListLock.Unlock()
+
+	if !ok {
+		p.attachSinks(track)
 		p.SignalPeerConnections()
-	}()
+	}
+	return track
+}
 
-	trackLocal, err := webrtc.NewTrackLocalStaticRTP(t.Codec().RTPCodecCapability, t.ID(), t.StreamID())
-	if err != nil {
-		log.Println(err.Error())
-		return nil
+// Publish makes a local track available to every subscriber, until it is
+// removed with RemoveTrack. It reports false if a track with the same ID is
+// already published.
+func (p *Peers) Publish(t *Track) bool {
+	p.ListLock.Lock()
+	if _, ok := p.Tracks[t.ID()]; ok {
+		p.ListLock.Unlock()
+		return false
 	}
 
-	p.TrackLocals[t.ID()] = trackLocal
-	return trackLocal
+	t.counters = &p.Counters
+	p.Tracks[t.ID()] = t
+	p.ListLock.Unlock()
+
+	p.attachSinks(t)
+	p.SignalPeerConnections()
+	return true
 }
 
-func (p *Peers) RemoveTrack(t *webrtc.TrackLocalStaticRTP) {
+// RemoveTrack removes layer rid from t, and t itself once its last layer is gone.
+func (p *Peers) RemoveTrack(t *Track, rid string) {
 	p.ListLock.Lock()
-	defer func() {
+	if t.RemoveLayer(rid) > 0 {
 		p.ListLock.Unlock()
-		p.SignalPeerConnections()
-	}()
+		return
+	}
 
-	delete(p.TrackLocals, t.ID())
+	delete(p.Tracks, t.ID())
+	delete(p.Muted, t.ID())
+	p.ListLock.Unlock()
+
+	p.detachSinks(t)
+	p.SignalPeerConnections()
+}
+
+// forward fans out the packets received on tr until the publisher stops
+// sending them. Simulcast tracks are received once per layer, each layer on
+// its own TrackRemote.
+func (p *Peers) forward(tr *webrtc.TrackRemote, publisher *webrtc.PeerConnection) {
+	track := p.AddTrack(tr, publisher)
+	defer p.RemoveTrack(track, tr.RID())
+
+	for {
+		pkt, _, err := tr.ReadRTP()
+		if err != nil {
+			return
+		}
+		track.WriteRTP(tr.RID(), pkt)
+	}
+}
+
+// SetLayer makes subscriber receive layer rid of the simulcast track trackID.
+func (p *Peers) SetLayer(subscriber *webrtc.PeerConnection, trackID, rid string) error {
+	p.ListLock.RLock()
+	track, ok := p.Tracks[trackID]
+	p.ListLock.RUnlock()
+
+	if !ok {
+		return ErrUnknownLayer
+	}
+	return track.SetLayer(subscriber, rid)
 }
 
 func (p *Peers) SignalPeerConnections() {
@@ -105,6 +184,7 @@ func (p *Peers) SignalPeerConnections() {
 	}()
 
 	attemptSync := func() (tryAgain bool) {
+		p.Counters.SyncAttempts.Add(1)
 		for i := range p.Connections {
 			if p.Connections[i].PeerConnection.ConnectionState() == webrtc.PeerConnectionStateClosed {
 				p.Connections = append(p.Connections[:i], p.Connections[i+1:]...)
@@ -112,6 +192,10 @@ func (p *Peers) SignalPeerConnections() {
 				return true
 			}
 
+			if p.Connections[i].Websocket == nil {
+				continue
+			}
+
 			existingSenders := map[string]bool{}
 			for _, sender := range p.Connections[i].PeerConnection.GetSenders() {
 				if sender.Track() == nil {
@@ -120,7 +204,7 @@ func (p *Peers) SignalPeerConnections() {
 
 				existingSenders[sender.Track().ID()] = true
 
-				if _, ok := p.TrackLocals[sender.Track().ID()]; !ok {
+				if _, ok := p.Tracks[sender.Track().ID()]; !ok {
 					if err := p.Connections[i].PeerConnection.RemoveTrack(sender); err != nil {
 						return true
 					}
@@ -135,31 +219,32 @@ func (p *Peers) SignalPeerConnections() {
 				existingSenders[receiver.Track().ID()] = true
 			}
 
-			for trackID := range p.TrackLocals {
-				if _, ok := existingSenders[trackID]; !ok {
-					if _, err := p.Connections[i].PeerConnection.AddTrack(p.TrackLocals[trackID]); err != nil {
-						return true
+			if p.Connections[i].Role.Subscribes() {
+				for trackID, track := range p.Tracks {
+					if _, ok := existingSenders[trackID]; !ok {
+						downTrack := track.Subscribe(p.Connections[i].PeerConnection, p.Connections[i].Bandwidth)
+						sender, err := p.Connections[i].PeerConnection.AddTrack(downTrack)
+						if err != nil {
+							return true
+						}
+						go readRTCP(sender, downTrack.RequestKeyFrame, &p.Counters)
 					}
 				}
 			}
 
-			offer, err := p.Connections[i].PeerConnection.CreateOffer(nil)
-			if err != nil {
-				return true
-			}
-
-			if err = p.Connections[i].PeerConnection.SetLocalDescription(offer); err != nil {
-				return true
-			}
+			if err := p.Connections[i].Negotiation.Offer(func(offer webrtc.SessionDescription) error {
+				if err := p.Connections[i].Websocket.Send(protocol.TypeTrackInfo, p.trackInfo(p.Connections[i].PeerConnection)); err != nil {
+					return err
+				}
 
-			offerString, err := json.Marshal(offer)
-			if err != nil {
-				return true
-			}
+				if err := p.Connections[i].Websocket.Send(protocol.TypeOffer, &protocol.SessionDescription{
+					SDP: offer.SDP,
+				}); err != nil {
+					return err
+				}
 
-			if err = p.Connections[i].Websocket.WriteJSON(&WebSocketMessage{
-				Event: "offer",
-				Data:  string(offerString),
+				p.Counters.Offers.Add(1)
+				return nil
 			}); err != nil {
 				return true
 			}
@@ -169,6 +254,7 @@ func (p *Peers) SignalPeerConnections() {
 
 	for syncAttemp := 0; ; syncAttemp++ {
 		if syncAttemp == 25 {
+			p.Counters.SyncGiveUps.Add(1)
 			go func() {
 				time.Sleep(3 * time.Second)
 				p.SignalPeerConnections()
@@ -182,21 +268,145 @@ func (p *Peers) SignalPeerConnections() {
 	}
 }
 
+// Close closes every PeerConnection and signaling socket still attached to
+// p, and detaches every sink.
+func (p *Peers) Close() {
+	p.ListLock.Lock()
+	connections := p.Connections
+	p.Connections = nil
+	p.ListLock.Unlock()
+
+	p.sinkLock.Lock()
+	for s := range p.sinks {
+		for _, track := range p.tracks() {
+			track.detach(s)
+		}
+	}
+	p.sinks = nil
+	p.sinkLock.Unlock()
+
+	for i := range connections {
+		if err := connections[i].PeerConnection.Close(); err != nil {
+			log.Println(err)
+		}
+		if connections[i].Websocket == nil {
+			continue
+		}
+		if err := connections[i].Websocket.Conn.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// trackInfo describes the tracks sent to pc. p.ListLock must be held.
+func (p *Peers) trackInfo(pc *webrtc.PeerConnection) *protocol.TrackInfo {
+	info := &protocol.TrackInfo{Tracks: []protocol.Track{}}
+	for _, sender := range pc.GetSenders() {
+		track := sender.Track()
+		if track == nil {
+			continue
+		}
+
+		info.Tracks = append(info.Tracks, protocol.Track{
+			ID:       track.ID(),
+			StreamID: track.StreamID(),
+			Kind:     track.Kind().String(),
+			Muted:    p.Muted[track.ID()],
+		})
+	}
+	return info
+}
+
+// SetMuted records whether the track trackID is muted and tells every other
+// subscriber about it.
+func (p *Peers) SetMuted(from *webrtc.PeerConnection, trackID string, muted bool) {
+	p.ListLock.Lock()
+	defer p.ListLock.Unlock()
+
+	if muted {
+		p.Muted[trackID] = true
+	} else {
+		delete(p.Muted, trackID)
+	}
+
+	for i := range p.Connections {
+		if p.Connections[i].PeerConnection == from || !p.Connections[i].Role.Subscribes() || p.Connections[i].Websocket == nil {
+			continue
+		}
+
+		if err := p.Connections[i].Websocket.Send(protocol.TypeMute, &protocol.Mute{
+			TrackID: trackID,
+			Muted:   muted,
+		}); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// Counts returns the number of open connections that publish media and the
+// number of viewers, the open connections that only subscribe to it.
+func (p *Peers) Counts() (publishers, viewers int) {
+	p.ListLock.RLock()
+	defer p.ListLock.RUnlock()
+
+	for i := range p.Connections {
+		if p.Connections[i].PeerConnection.ConnectionState() == webrtc.PeerConnectionStateClosed {
+			continue
+		}
+
+		if p.Connections[i].Role.Publishes() {
+			publishers++
+		} else {
+			viewers++
+		}
+	}
+	return
+}
+
 func (p *Peers) DispatchKeyFrame() {
 	p.ListLock.Lock()
 	defer p.ListLock.Unlock()
 
 	for i := range p.Connections {
+		if !p.Connections[i].Role.Publishes() {
+			continue
+		}
+
+		// Simulcast receivers have one track per layer.
 		for _, receiver := range p.Connections[i].PeerConnection.GetReceivers() {
-			if receiver.Track() == nil {
-				continue
+			for _, track := range receiver.Tracks() {
+				_ = p.Connections[i].PeerConnection.WriteRTCP([]rtcp.Packet{
+					&rtcp.PictureLossIndication{
+						MediaSSRC: uint32(track.SSRC()),
+					},
+				})
+				p.Counters.pliSent()
 			}
+		}
+	}
+}
+
+// readRTCP reads the RTCP a subscriber sends for sender until the sender is
+// stopped. Reading runs the packets through the interceptors, which need the
+// feedback for NACKs and bandwidth estimation. onKeyFrameRequest, if not
+// nil, is called for every PLI and FIR. The packets are counted in counters.
+func readRTCP(sender *webrtc.RTPSender, onKeyFrameRequest func(), counters *Counters) {
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
 
-			_ = p.Connections[i].PeerConnection.WriteRTCP([]rtcp.Packet{
-				&rtcp.PictureLossIndication{
-					MediaSSRC: uint32(receiver.Track().SSRC()),
-				},
-			})
+		for _, pkt := range packets {
+			switch pkt.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				counters.PLIsReceived.Add(1)
+				if onKeyFrameRequest != nil {
+					onKeyFrameRequest()
+				}
+			case *rtcp.TransportLayerNack:
+				counters.NACKsReceived.Add(1)
+			}
 		}
 	}
 }
@@ -0,0 +1,232 @@
+package webrtc
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"quick-video/pkg/protocol"
+
+	"github.com/pion/interceptor/pkg/stats"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	directionInbound  = "inbound"
+	directionOutbound = "outbound"
+)
+
+// QualityMonitor measures the quality of the tracks sent and received over a
+// PeerConnection, from the statistics of its RTP streams. Every sample
+// covers the time since the previous one.
+type QualityMonitor struct {
+	pc     *webrtc.PeerConnection
+	getter stats.Getter
+
+	lock      sync.Mutex
+	previous  map[webrtc.SSRC]streamSample
+	last      *protocol.Quality
+	sampledAt time.Time
+}
+
+// streamSample holds the counters of an RTP stream at the time of a sample.
+type streamSample struct {
+	at      time.Time
+	packets uint64
+	lost    int64
+	bytes   uint64
+	frames  uint64
+}
+
+func NewQualityMonitor(pc *webrtc.PeerConnection, getter stats.Getter) *QualityMonitor {
+	return &QualityMonitor{
+		pc:       pc,
+		getter:   getter,
+		previous: make(map[webrtc.SSRC]streamSample),
+	}
+}
+
+// Last returns the last sample and when it was taken, nil before the first one.
+func (m *QualityMonitor) Last() (*protocol.Quality, time.Time) {
+	if m == nil {
+		return nil, time.Time{}
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.last, m.sampledAt
+}
+
+// sample measures the tracks p receives from and sends to the PeerConnection.
+func (m *QualityMonitor) sample(p *Peers) *protocol.Quality {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := time.Now()
+	q := &protocol.Quality{
+		RTT:    m.connectionRTT(),
+		Tracks: []protocol.TrackQuality{},
+	}
+	samples := make(map[webrtc.SSRC]streamSample)
+
+	for _, receiver := range m.pc.GetReceivers() {
+		for _, tr := range receiver.Tracks() {
+			s := m.getter.Get(uint32(tr.SSRC()))
+			if s == nil {
+				continue
+			}
+
+			p.ListLock.RLock()
+			track, ok := p.Tracks[tr.ID()]
+			p.ListLock.RUnlock()
+
+			cur := streamSample{
+				at:      now,
+				packets: s.InboundRTPStreamStats.PacketsReceived,
+				lost:    s.InboundRTPStreamStats.PacketsLost,
+				bytes:   s.InboundRTPStreamStats.BytesReceived,
+			}
+			if ok {
+				cur.frames = track.frames(tr.RID())
+			}
+			samples[tr.SSRC()] = cur
+
+			t := m.measure(tr.SSRC(), cur, tr.Kind())
+			t.TrackID, t.RID, t.Direction = tr.ID(), tr.RID(), directionInbound
+			t.RTT = q.RTT
+			if clockRate := tr.Codec().ClockRate; clockRate > 0 {
+				t.Jitter = s.InboundRTPStreamStats.Jitter / float64(clockRate) * 1000
+			}
+			t.Score = score(t)
+			q.Tracks = append(q.Tracks, t)
+		}
+	}
+
+	for _, sender := range m.pc.GetSenders() {
+		d, ok := sender.Track().(*DownTrack)
+		if !ok {
+			continue
+		}
+		ssrc, bound, frames := d.sent()
+		if !bound {
+			continue
+		}
+		s := m.getter.Get(uint32(ssrc))
+		if s == nil {
+			continue
+		}
+
+		cur := streamSample{
+			at:      now,
+			packets: s.OutboundRTPStreamStats.PacketsSent,
+			bytes:   s.OutboundRTPStreamStats.BytesSent,
+			frames:  frames,
+		}
+		samples[ssrc] = cur
+
+		t := m.measure(ssrc, cur, d.Kind())
+		t.TrackID, t.Direction = d.ID(), directionOutbound
+		// The receiver reports of the subscriber carry its view of the stream.
+		t.PacketLoss = s.RemoteInboundRTPStreamStats.FractionLost
+		t.Jitter = s.RemoteInboundRTPStreamStats.Jitter * 1000
+		t.RTT = q.RTT
+		if rtt := s.RemoteInboundRTPStreamStats.RoundTripTime; rtt > 0 {
+			t.RTT = float64(rtt) / float64(time.Millisecond)
+		}
+		t.Score = score(t)
+		q.Tracks = append(q.Tracks, t)
+	}
+
+	q.Score = 5
+	if len(q.Tracks) == 0 {
+		q.Score = score(protocol.TrackQuality{RTT: q.RTT})
+	}
+	for _, t := range q.Tracks {
+		if t.Score < q.Score {
+			q.Score = t.Score
+		}
+	}
+
+	m.previous = samples
+	m.last = q
+	m.sampledAt = now
+	return q
+}
+
+// measure computes the rates of a stream since its previous sample, and the
+// packet loss of an inbound stream.
+func (m *QualityMonitor) measure(ssrc webrtc.SSRC, cur streamSample, kind webrtc.RTPCodecType) protocol.TrackQuality {
+	t := protocol.TrackQuality{Kind: kind.String()}
+
+	prev, ok := m.previous[ssrc]
+	if !ok {
+		return t
+	}
+	elapsed := cur.at.Sub(prev.at).Seconds()
+	if elapsed <= 0 {
+		return t
+	}
+
+	t.Bitrate = int(float64(cur.bytes-prev.bytes) * 8 / elapsed)
+	if kind == webrtc.RTPCodecTypeVideo {
+		t.FrameRate = float64(cur.frames-prev.frames) / elapsed
+	}
+
+	// Retransmissions make the lost count go down.
+	lost := cur.lost - prev.lost
+	received := int64(cur.packets - prev.packets)
+	if lost > 0 && lost+received > 0 {
+		t.PacketLoss = float64(lost) / float64(lost+received)
+	}
+	return t
+}
+
+// connectionRTT returns the round-trip time, in milliseconds, of the ICE
+// candidate pair in use.
+func (m *QualityMonitor) connectionRTT() float64 {
+	for _, s := range m.pc.GetStats() {
+		pair, ok := s.(webrtc.ICECandidatePairStats)
+		if ok && pair.Nominated && pair.State == webrtc.StatsICECandidatePairStateSucceeded {
+			return pair.CurrentRoundTripTime * 1000
+		}
+	}
+	return 0
+}
+
+// score rates a track from 1 (unusable) to 5 (excellent), after its worst measure.
+func score(t protocol.TrackQuality) int {
+	switch {
+	case t.PacketLoss < 0.01 && t.RTT < 150 && t.Jitter < 30:
+		return 5
+	case t.PacketLoss < 0.03 && t.RTT < 300 && t.Jitter < 50:
+		return 4
+	case t.PacketLoss < 0.08 && t.RTT < 500 && t.Jitter < 100:
+		return 3
+	case t.PacketLoss < 0.15 && t.RTT < 1000:
+		return 2
+	}
+	return 1
+}
+
+// SampleQuality samples the quality of every open connection of p, and
+// sends it to the clients connected with a signaling socket.
+func (p *Peers) SampleQuality() {
+	p.ListLock.RLock()
+	connections := make([]PeerConnectionState, len(p.Connections))
+	copy(connections, p.Connections)
+	p.ListLock.RUnlock()
+
+	for _, c := range connections {
+		if c.Quality == nil || c.PeerConnection.ConnectionState() != webrtc.PeerConnectionStateConnected {
+			continue
+		}
+
+		q := c.Quality.sample(p)
+		if c.Websocket == nil {
+			continue
+		}
+		if err := c.Websocket.Send(protocol.TypeQuality, q); err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package webrtc
+
+import (
+	"log"
+	"time"
+
+	"quick-video/pkg/chat"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// NewRoom creates a room with an empty set of peers and starts its chat
+// hub with the given options.
+func NewRoom(id, streamID string, chatOpts chat.Options) *Room {
+	hub := chat.NewHub(id, chatOpts)
+	room := &Room{
+		ID:       id,
+		StreamID: streamID,
+		Peers: &Peers{
+			Tracks: make(map[string]*Track),
+			Muted:  make(map[string]bool),
+		},
+		Hub:       hub,
+		CreatedAt: time.Now(),
+	}
+	room.Touch()
+
+	go hub.Run()
+	return room
+}
+
+// Touch marks the room as used now.
+func (r *Room) Touch() {
+	r.lastUsed.Store(time.Now().UnixNano())
+}
+
+// Watch counts a viewer session in the room until the returned function is called.
+func (r *Room) Watch() (leave func()) {
+	r.viewers.Add(1)
+	r.Touch()
+	return func() {
+		r.viewers.Add(-1)
+		r.Touch()
+	}
+}
+
+// LastUsed returns the last time a peer, chat client or viewer joined or left
+// the room.
+func (r *Room) LastUsed() time.Time {
+	return time.Unix(0, r.lastUsed.Load())
+}
+
+// Empty reports whether no open PeerConnection, chat client or viewer is left
+// in the room.
+func (r *Room) Empty() bool {
+	if r.Hub != nil && r.Hub.Clients() > 0 || r.viewers.Load() > 0 {
+		return false
+	}
+
+	r.Peers.ListLock.RLock()
+	defer r.Peers.ListLock.RUnlock()
+
+	for i := range r.Peers.Connections {
+		if r.Peers.Connections[i].PeerConnection.ConnectionState() != webrtc.PeerConnectionStateClosed {
+			return false
+		}
+	}
+	return true
+}
+
+// Close stops the chat hub and closes every PeerConnection left in the room.
+func (r *Room) Close() {
+	if r.Hub != nil {
+		r.Hub.Stop()
+	}
+	r.Peers.Close()
+}
+
+// ReapRooms removes and closes every room in store that has been empty for
+// longer than ttl, and returns the rooms it closed.
+func ReapRooms(store RoomStore, ttl time.Duration) []*Room {
+	var reaped []*Room
+	for _, candidate := range store.List() {
+		room, ok := store.DeleteIf(candidate.ID, func(room *Room) bool {
+			return time.Since(room.LastUsed()) >= ttl && room.Empty()
+		})
+		if !ok {
+			continue
+		}
+
+		log.Printf("closing room %s, idle since %s", room.ID, room.LastUsed().Format(time.RFC3339))
+		room.Close()
+		reaped = append(reaped, room)
+	}
+	return reaped
+}
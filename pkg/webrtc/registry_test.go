@@ -0,0 +1,34 @@
+package webrtc
+
+import (
+	"testing"
+	"time"
+
+	"quick-video/pkg/chat"
+)
+
+func TestViewersKeepRoomsFromBeingReaped(t *testing.T) {
+	s := NewMemoryRoomStore(chat.Options{})
+	room, err := s.Create("room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer room.Close()
+
+	const ttl = 50 * time.Millisecond
+	leave := room.Watch()
+	time.Sleep(2 * ttl)
+	if reaped := ReapRooms(s, ttl); len(reaped) != 0 {
+		t.Fatal("reaped a room with a viewer")
+	}
+
+	// Leaving counts as activity too.
+	leave()
+	if reaped := ReapRooms(s, ttl); len(reaped) != 0 {
+		t.Fatal("reaped a room right after its last viewer left")
+	}
+	time.Sleep(2 * ttl)
+	if reaped := ReapRooms(s, ttl); len(reaped) != 1 || reaped[0] != room {
+		t.Fatalf("reaped %v, want the idle room", reaped)
+	}
+}
@@ -0,0 +1,400 @@
+package webrtc
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"quick-video/pkg/protocol"
+
+	"github.com/gofiber/websocket/v2"
+	guuid "github.com/google/uuid"
+	"github.com/pion/webrtc/v3"
+)
+
+// Role describes which way media flows in a Session.
+type Role int
+
+const (
+	// RolePublisher sends media that is fanned out to the other peers.
+	RolePublisher Role = 1 << iota
+	// RoleSubscriber receives the media published by the other peers.
+	RoleSubscriber
+
+	RoleBoth = RolePublisher | RoleSubscriber
+)
+
+func (r Role) Publishes() bool {
+	return r&RolePublisher != 0
+}
+
+func (r Role) Subscribes() bool {
+	return r&RoleSubscriber != 0
+}
+
+func (r Role) String() string {
+	switch r {
+	case RolePublisher:
+		return "publisher"
+	case RoleSubscriber:
+		return "subscriber"
+	case RoleBoth:
+		return "both"
+	}
+	return "unknown"
+}
+
+// Session is the server side of one peer: it owns the PeerConnection, trickles
+// ICE candidates over the signaling socket and runs the message loop until
+// the socket is closed.
+type Session struct {
+	ID       string
+	Role     Role
+	Peers    *Peers
+	Settings *Settings
+	// Identity and Name describe the client, if known.
+	Identity string
+	Name     string
+
+	conn           *websocket.Conn
+	peerConnection *webrtc.PeerConnection
+	negotiation    *Negotiation
+	websocket      *ThreadSafeWriter
+	version        int
+
+	// tracks counts the remote tracks, or simulcast layers, this session
+	// publishes by track ID.
+	tracksLock sync.Mutex
+	tracks     map[string]int
+}
+
+func NewSession(c *websocket.Conn, p *Peers, s *Settings, role Role) *Session {
+	return &Session{
+		ID:       guuid.New().String(),
+		Role:     role,
+		Peers:    p,
+		Settings: s,
+		conn:     c,
+		websocket: &ThreadSafeWriter{
+			Conn:  c,
+			Mutex: sync.Mutex{},
+		},
+		tracks: make(map[string]int),
+	}
+}
+
+// RoomConn runs the session of a room participant, who both publishes and subscribes.
+func RoomConn(c *websocket.Conn, p *Peers, s *Settings) {
+	NewSession(c, p, s, RoleBoth).Run()
+}
+
+// StreamConn runs the session of a stream viewer.
+func StreamConn(c *websocket.Conn, p *Peers, s *Settings) {
+	NewSession(c, p, s, RoleSubscriber).Run()
+}
+
+// Run blocks until the signaling socket or the PeerConnection is closed.
+func (s *Session) Run() {
+	if !s.join() {
+		return
+	}
+
+	peerConnection, estimator, getter, err := s.Settings.NewPeerConnection()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	defer peerConnection.Close()
+	s.peerConnection = peerConnection
+	s.negotiation = NewNegotiation(peerConnection)
+
+	// Subscribers never send media, so they only get the sendonly
+	// transceivers SignalPeerConnections adds for the published tracks.
+	if s.Role.Publishes() {
+		for _, typ := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+			if _, err := peerConnection.AddTransceiverFromKind(typ, webrtc.RTPTransceiverInit{
+				Direction: webrtc.RTPTransceiverDirectionRecvonly,
+			}); err != nil {
+				log.Print(err)
+				return
+			}
+		}
+	}
+
+	// Add new PeerConnection to global list
+	s.Peers.ListLock.Lock()
+	s.Peers.Connections = append(s.Peers.Connections, PeerConnectionState{
+		ID:             s.ID,
+		Identity:       s.Identity,
+		Name:           s.Name,
+		JoinedAt:       time.Now(),
+		PeerConnection: peerConnection,
+		Negotiation:    s.negotiation,
+		Bandwidth:      NewBandwidth(estimator),
+		Websocket:      s.websocket,
+		Role:           s.Role,
+		Quality:        NewQualityMonitor(peerConnection, getter),
+	})
+	s.Peers.ListLock.Unlock()
+
+	peerConnection.OnICECandidate(s.onICECandidate)
+	peerConnection.OnConnectionStateChange(s.onConnectionStateChange)
+	if s.Role.Publishes() {
+		peerConnection.OnTrack(s.onTrack)
+	}
+
+	s.Peers.SignalPeerConnections()
+	s.readLoop()
+}
+
+// join reads the join message every client starts with and negotiates the
+// protocol version of the session.
+func (s *Session) join() bool {
+	m, err := s.read()
+	if err != nil {
+		s.fail(nil, err)
+		return false
+	}
+
+	if m.Type != protocol.TypeJoin {
+		s.fail(m, protocol.Errorf(protocol.CodeNotJoined, "expected %s, got %s", protocol.TypeJoin, m.Type))
+		return false
+	}
+
+	join := &protocol.Join{}
+	if err := m.Unmarshal(join); err != nil {
+		s.fail(m, err)
+		return false
+	}
+
+	if s.version, err = protocol.Negotiate(join.Versions); err != nil {
+		s.fail(m, err)
+		return false
+	}
+
+	if err := s.websocket.Send(protocol.TypeJoin, &protocol.Join{Version: s.version}); err != nil {
+		log.Println(err)
+		return false
+	}
+	return true
+}
+
+// read returns the next message on the signaling socket. Messages that are
+// not valid are returned as a *protocol.Error, socket errors as is.
+func (s *Session) read() (*protocol.Message, error) {
+	_, raw, err := s.conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	return protocol.Decode(raw)
+}
+
+// fail tells the client why its session ends, if err is a protocol error.
+func (s *Session) fail(m *protocol.Message, err error) {
+	e, ok := err.(*protocol.Error)
+	if !ok {
+		log.Println(err)
+		return
+	}
+
+	e.Fatal = true
+	if err := s.websocket.SendError(m, e); err != nil {
+		log.Println(err)
+	}
+}
+
+// Trickle ICE. Emit server candidate to client
+func (s *Session) onICECandidate(i *webrtc.ICECandidate) {
+	if i == nil {
+		return
+	}
+
+	candidate := i.ToJSON()
+	if err := s.websocket.Send(protocol.TypeCandidate, &protocol.Candidate{
+		Candidate:        candidate.Candidate,
+		SDPMid:           candidate.SDPMid,
+		SDPMLineIndex:    candidate.SDPMLineIndex,
+		UsernameFragment: candidate.UsernameFragment,
+	}); err != nil {
+		log.Println(err)
+	}
+}
+
+// If PeerConnection is closed remove it from global list
+func (s *Session) onConnectionStateChange(pcs webrtc.PeerConnectionState) {
+	switch pcs {
+	case webrtc.PeerConnectionStateFailed:
+		if err := s.peerConnection.Close(); err != nil {
+			log.Print(err)
+		}
+	case webrtc.PeerConnectionStateClosed:
+		s.Peers.SignalPeerConnections()
+	}
+}
+
+func (s *Session) onTrack(tr *webrtc.TrackRemote, r *webrtc.RTPReceiver) {
+	s.own(tr.ID())
+	defer s.disown(tr.ID())
+
+	s.Peers.forward(tr, s.peerConnection)
+}
+
+func (s *Session) own(trackID string) {
+	s.tracksLock.Lock()
+	defer s.tracksLock.Unlock()
+	s.tracks[trackID]++
+}
+
+func (s *Session) disown(trackID string) {
+	s.tracksLock.Lock()
+	defer s.tracksLock.Unlock()
+
+	if s.tracks[trackID]--; s.tracks[trackID] <= 0 {
+		delete(s.tracks, trackID)
+	}
+}
+
+func (s *Session) owns(trackID string) bool {
+	s.tracksLock.Lock()
+	defer s.tracksLock.Unlock()
+	return s.tracks[trackID] > 0
+}
+
+func (s *Session) readLoop() {
+	for {
+		m, err := s.read()
+		if e, ok := err.(*protocol.Error); ok {
+			if err := s.websocket.SendError(m, e); err != nil {
+				log.Println(err)
+				return
+			}
+			continue
+		} else if err != nil {
+			log.Println(err)
+			return
+		}
+
+		if m.Version != s.version {
+			s.reply(m, protocol.Errorf(protocol.CodeUnsupportedVersion, "session uses version %d", s.version))
+			continue
+		}
+
+		if m.Type == protocol.TypeLeave {
+			return
+		}
+		s.reply(m, s.handle(m))
+	}
+}
+
+// renegotiateIfPending sends the server offers that were held back while the
+// client was negotiating.
+func (s *Session) renegotiateIfPending() {
+	if s.negotiation.TakePending() {
+		go s.Peers.SignalPeerConnections()
+	}
+}
+
+// reply sends err back to the client if handling m failed.
+func (s *Session) reply(m *protocol.Message, err error) {
+	if err == nil {
+		return
+	}
+
+	e, ok := err.(*protocol.Error)
+	if !ok {
+		e = protocol.Errorf(protocol.CodeInternal, "%s", err)
+	}
+	if err := s.websocket.SendError(m, e); err != nil {
+		log.Println(err)
+	}
+}
+
+func (s *Session) handle(m *protocol.Message) error {
+	switch m.Type {
+	case protocol.TypeCandidate:
+		candidate := &protocol.Candidate{}
+		if err := m.Unmarshal(candidate); err != nil {
+			return err
+		}
+
+		return s.negotiation.AddICECandidate(webrtc.ICECandidateInit{
+			Candidate:        candidate.Candidate,
+			SDPMid:           candidate.SDPMid,
+			SDPMLineIndex:    candidate.SDPMLineIndex,
+			UsernameFragment: candidate.UsernameFragment,
+		})
+
+	case protocol.TypeOffer:
+		offer := &protocol.SessionDescription{}
+		if err := m.Unmarshal(offer); err != nil {
+			return err
+		}
+
+		accepted, err := s.negotiation.AcceptOffer(offer.SDP, func(answer webrtc.SessionDescription) error {
+			return s.websocket.Send(protocol.TypeAnswer, &protocol.SessionDescription{
+				SDP: answer.SDP,
+			})
+		})
+		if err != nil {
+			return err
+		}
+		if !accepted {
+			log.Println("ignored client offer colliding with a server offer")
+		}
+		s.renegotiateIfPending()
+		return nil
+
+	case protocol.TypeAnswer:
+		answer := &protocol.SessionDescription{}
+		if err := m.Unmarshal(answer); err != nil {
+			return err
+		}
+
+		if err := s.negotiation.AcceptAnswer(answer.SDP); err != nil {
+			return err
+		}
+		s.renegotiateIfPending()
+		return nil
+
+	case protocol.TypeRenegotiate:
+		go s.Peers.SignalPeerConnections()
+		return nil
+
+	case protocol.TypeMute:
+		mute := &protocol.Mute{}
+		if err := m.Unmarshal(mute); err != nil {
+			return err
+		}
+
+		if !s.owns(mute.TrackID) {
+			return protocol.Errorf(protocol.CodeForbidden, "track %s is not published by this session", mute.TrackID)
+		}
+		if !mute.Muted && s.Peers.mutedByServer(mute.TrackID) {
+			return protocol.Errorf(protocol.CodeForbidden, "track %s is muted by the server", mute.TrackID)
+		}
+
+		s.Peers.SetMuted(s.peerConnection, mute.TrackID, mute.Muted)
+		return nil
+
+	case protocol.TypeLayer:
+		layer := &protocol.Layer{}
+		if err := m.Unmarshal(layer); err != nil {
+			return err
+		}
+
+		if err := s.Peers.SetLayer(s.peerConnection, layer.TrackID, layer.RID); err != nil {
+			return protocol.Errorf(protocol.CodeInvalidPayload, "%s %s of track %s", err, layer.RID, layer.TrackID)
+		}
+		return nil
+
+	case protocol.TypeError:
+		e := &protocol.Error{}
+		if err := m.Unmarshal(e); err != nil {
+			return err
+		}
+		log.Println("client error:", e)
+		return nil
+	}
+
+	return protocol.Errorf(protocol.CodeUnexpected, "%s is not expected from a client", m.Type)
+}
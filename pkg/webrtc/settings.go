@@ -0,0 +1,127 @@
+package webrtc
+
+import (
+	"time"
+
+	"quick-video/pkg/turncred"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/interceptor/pkg/stats"
+	"github.com/pion/webrtc/v3"
+)
+
+// initialBitrate is the bandwidth estimate, in bits per second, a
+// PeerConnection starts with before any feedback is received.
+const initialBitrate = 1_000_000
+
+// Settings holds the ICE configuration every server side PeerConnection is created with.
+type Settings struct {
+	ICEServers         []webrtc.ICEServer
+	ICETransportPolicy webrtc.ICETransportPolicy
+	// NAT1To1IPs are the public IPs advertised as host candidates when the
+	// server runs behind a 1:1 NAT, e.g. on a cloud VM.
+	NAT1To1IPs []string
+
+	// TURNURLs are handed out with time-limited credentials signed with
+	// TURNSecret, see package turncred.
+	TURNURLs          []string
+	TURNSecret        string
+	TURNCredentialTTL time.Duration
+}
+
+// ICEServersFor returns the static ICE servers plus, if a TURN secret is
+// configured, a TURN server entry with fresh credentials issued to userID.
+func (s *Settings) ICEServersFor(userID string) []webrtc.ICEServer {
+	servers := append([]webrtc.ICEServer{}, s.ICEServers...)
+	if len(s.TURNURLs) == 0 || s.TURNSecret == "" {
+		return servers
+	}
+
+	username, password := turncred.Generate(s.TURNSecret, userID, s.TURNCredentialTTL)
+	return append(servers, webrtc.ICEServer{
+		URLs:           s.TURNURLs,
+		Username:       username,
+		Credential:     password,
+		CredentialType: webrtc.ICECredentialTypePassword,
+	})
+}
+
+// Configuration returns the PeerConnection configuration described by s.
+func (s *Settings) Configuration() webrtc.Configuration {
+	return webrtc.Configuration{
+		ICEServers:         s.ICEServersFor("sfu"),
+		ICETransportPolicy: s.ICETransportPolicy,
+	}
+}
+
+// simulcastExtensions are the RTP header extensions publishers use to tell
+// the simulcast layers of a track apart.
+var simulcastExtensions = []string{
+	"urn:ietf:params:rtp-hdrext:sdes:mid",
+	"urn:ietf:params:rtp-hdrext:sdes:rtp-stream-id",
+	"urn:ietf:params:rtp-hdrext:sdes:repaired-rtp-stream-id",
+}
+
+// NewPeerConnection creates a PeerConnection with the default codecs and
+// interceptors, configured according to s. It also returns the estimator of
+// the bandwidth available to send media over the PeerConnection, and the
+// statistics of its RTP streams.
+func (s *Settings) NewPeerConnection() (*webrtc.PeerConnection, cc.BandwidthEstimator, stats.Getter, error) {
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		return nil, nil, nil, err
+	}
+
+	for _, uri := range simulcastExtensions {
+		if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: uri}, webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	i := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+		return nil, nil, nil, err
+	}
+
+	congestionController, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		return gcc.NewSendSideBWE(gcc.SendSideBWEInitialBitrate(initialBitrate), gcc.SendSideBWEPacer(gcc.NewNoOpPacer()))
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var estimator cc.BandwidthEstimator
+	congestionController.OnNewPeerConnection(func(_ string, e cc.BandwidthEstimator) {
+		estimator = e
+	})
+	i.Add(congestionController)
+
+	statsInterceptor, err := stats.NewInterceptor()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var getter stats.Getter
+	statsInterceptor.OnNewPeerConnection(func(_ string, g stats.Getter) {
+		getter = g
+	})
+	i.Add(statsInterceptor)
+
+	if err = webrtc.ConfigureTWCCHeaderExtensionSender(m, i); err != nil {
+		return nil, nil, nil, err
+	}
+
+	se := webrtc.SettingEngine{}
+	if len(s.NAT1To1IPs) > 0 {
+		se.SetNAT1To1IPs(s.NAT1To1IPs, webrtc.ICECandidateTypeHost)
+	}
+
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(se))
+	pc, err := api.NewPeerConnection(s.Configuration())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return pc, estimator, getter, nil
+}
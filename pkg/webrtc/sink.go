@@ -0,0 +1,123 @@
+package webrtc
+
+import (
+	"github.com/pion/webrtc/v3"
+)
+
+// Sink is an in-process subscriber, e.g. a recorder, that receives the
+// tracks published in a room without a PeerConnection.
+type Sink interface {
+	// AddTrack returns the writer the packets of t are forwarded to, or nil
+	// to leave t out. Packets are written from the goroutine reading the
+	// publisher, so the writer must not block.
+	AddTrack(t *Track) webrtc.TrackLocalWriter
+	// RemoveTrack is called once t is unpublished or the sink detached.
+	RemoveTrack(t *Track)
+}
+
+// Attach makes s receive every track published in p, now and until s is detached.
+func (p *Peers) Attach(s Sink) {
+	p.sinkLock.Lock()
+	defer p.sinkLock.Unlock()
+
+	if p.sinks == nil {
+		p.sinks = make(map[Sink]bool)
+	}
+	p.sinks[s] = true
+
+	for _, track := range p.tracks() {
+		p.attach(track, s)
+	}
+}
+
+// Detach stops forwarding the tracks of p to s.
+func (p *Peers) Detach(s Sink) {
+	p.sinkLock.Lock()
+	defer p.sinkLock.Unlock()
+
+	if !p.sinks[s] {
+		return
+	}
+	delete(p.sinks, s)
+
+	for _, track := range p.tracks() {
+		track.detach(s)
+	}
+}
+
+// attachSinks starts forwarding a track just published to every sink.
+func (p *Peers) attachSinks(t *Track) {
+	p.sinkLock.Lock()
+	defer p.sinkLock.Unlock()
+
+	for s := range p.sinks {
+		p.attach(t, s)
+	}
+}
+
+// detachSinks stops forwarding a track just unpublished to the sinks.
+func (p *Peers) detachSinks(t *Track) {
+	p.sinkLock.Lock()
+	defer p.sinkLock.Unlock()
+
+	for s := range p.sinks {
+		t.detach(s)
+	}
+}
+
+// tracks returns the tracks published in p.
+func (p *Peers) tracks() []*Track {
+	p.ListLock.RLock()
+	defer p.ListLock.RUnlock()
+
+	tracks := make([]*Track, 0, len(p.Tracks))
+	for _, track := range p.Tracks {
+		tracks = append(tracks, track)
+	}
+	return tracks
+}
+
+// attach starts forwarding t to s, unless it does already or t was
+// unpublished meanwhile. It is called with sinkLock held, so t is detached
+// after it if t is being unpublished.
+func (p *Peers) attach(t *Track, s Sink) {
+	p.ListLock.RLock()
+	published := p.Tracks[t.ID()] == t
+	p.ListLock.RUnlock()
+
+	t.lock.RLock()
+	_, attached := t.sinks[s]
+	t.lock.RUnlock()
+
+	if !published || attached {
+		return
+	}
+
+	w := s.AddTrack(t)
+	if w == nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.sinks[s] = &DownTrack{
+		track:       t,
+		bound:       true,
+		payloadType: t.payloadType,
+		clockRate:   t.codec.ClockRate,
+		writer:      w,
+	}
+}
+
+// detach stops forwarding t to s.
+func (t *Track) detach(s Sink) {
+	t.lock.Lock()
+	_, ok := t.sinks[s]
+	delete(t.sinks, s)
+	t.lock.Unlock()
+
+	if ok {
+		s.RemoveTrack(t)
+	}
+}
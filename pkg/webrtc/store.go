@@ -0,0 +1,144 @@
+package webrtc
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"quick-video/pkg/chat"
+)
+
+// RoomStore keeps track of the rooms served by a server, indexed both by
+// room ID and by the stream ID viewers use to watch the room.
+type RoomStore interface {
+	// Get returns the room with the given ID.
+	Get(id string) (*Room, bool)
+	// Create returns the room with the given ID, creating it if it does not exist yet.
+	Create(id string) (*Room, error)
+	// CreateNew creates the room with the given ID, failing with
+	// ErrRoomExists if there is one already.
+	CreateNew(id string) (*Room, error)
+	// Delete removes the room from the store. It does not close the room.
+	Delete(id string)
+	// DeleteIf removes the room from the store if remove returns true for
+	// it, with no room created or deleted meanwhile, and returns the room
+	// removed. It does not close the room.
+	DeleteIf(id string, remove func(*Room) bool) (*Room, bool)
+	// List returns a snapshot of every room in the store.
+	List() []*Room
+	// ByStreamID returns the room whose stream has the given ID.
+	ByStreamID(suuid string) (*Room, bool)
+}
+
+var ErrRoomExists = errors.New("room already exists")
+
+// StreamID derives the public stream ID of a room from its ID.
+func StreamID(id string) string {
+	h := sha256.New()
+	h.Write([]byte(id))
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// MemoryRoomStore is a RoomStore that keeps rooms in process memory.
+type MemoryRoomStore struct {
+	// chat are the options of the chat hubs of the rooms.
+	chat chat.Options
+
+	lock    sync.RWMutex
+	rooms   map[string]*Room
+	streams map[string]*Room
+}
+
+func NewMemoryRoomStore(chatOpts chat.Options) *MemoryRoomStore {
+	return &MemoryRoomStore{
+		chat:    chatOpts,
+		rooms:   make(map[string]*Room),
+		streams: make(map[string]*Room),
+	}
+}
+
+func (s *MemoryRoomStore) Get(id string) (*Room, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	room, ok := s.rooms[id]
+	return room, ok
+}
+
+func (s *MemoryRoomStore) Create(id string) (*Room, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if room, ok := s.rooms[id]; ok {
+		// Joining keeps the room from being reaped until the client is in.
+		room.Touch()
+		return room, nil
+	}
+	return s.create(id), nil
+}
+
+func (s *MemoryRoomStore) CreateNew(id string) (*Room, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.rooms[id]; ok {
+		return nil, ErrRoomExists
+	}
+	return s.create(id), nil
+}
+
+// create adds a new room. s.lock must be held.
+func (s *MemoryRoomStore) create(id string) *Room {
+	// Fiber reuses the memory of the route parameters id comes from.
+	id = strings.Clone(id)
+	room := NewRoom(id, StreamID(id), s.chat)
+	s.rooms[room.ID] = room
+	s.streams[room.StreamID] = room
+	return room
+}
+
+func (s *MemoryRoomStore) Delete(id string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	room, ok := s.rooms[id]
+	if !ok {
+		return
+	}
+	delete(s.rooms, id)
+	delete(s.streams, room.StreamID)
+}
+
+func (s *MemoryRoomStore) DeleteIf(id string, remove func(*Room) bool) (*Room, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	room, ok := s.rooms[id]
+	if !ok || !remove(room) {
+		return nil, false
+	}
+	delete(s.rooms, id)
+	delete(s.streams, room.StreamID)
+	return room, true
+}
+
+func (s *MemoryRoomStore) List() []*Room {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	rooms := make([]*Room, 0, len(s.rooms))
+	for _, room := range s.rooms {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
+
+func (s *MemoryRoomStore) ByStreamID(suuid string) (*Room, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	room, ok := s.streams[suuid]
+	return room, ok
+}
@@ -0,0 +1,45 @@
+package webrtc
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"quick-video/pkg/chat"
+)
+
+func TestCreateNewOnce(t *testing.T) {
+	s := NewMemoryRoomStore(chat.Options{})
+
+	const creators = 16
+	var (
+		wg      sync.WaitGroup
+		lock    sync.Mutex
+		created []*Room
+	)
+	for i := 0; i < creators; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			room, err := s.CreateNew("room")
+			if err != nil {
+				if !errors.Is(err, ErrRoomExists) {
+					t.Error(err)
+				}
+				return
+			}
+			lock.Lock()
+			created = append(created, room)
+			lock.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if len(created) != 1 {
+		t.Fatalf("created %d rooms, want 1", len(created))
+	}
+	defer created[0].Hub.Stop()
+	if room, _ := s.Get("room"); room != created[0] {
+		t.Error("the store holds another room than the one created")
+	}
+}
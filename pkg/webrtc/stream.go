@@ -1,119 +0,0 @@
-package webrtc
-
-import (
-	"encoding/json"
-	"log"
-	"os"
-	"sync"
-
-	"github.com/gofiber/websocket/v2"
-	"github.com/pion/webrtc/v3"
-)
-
-func StreamConn(c *websocket.Conn, p *Peers) {
-	var config webrtc.Configuration
-	if os.Getenv("ENVIRONMENT") == "PRODUCTION" {
-		config = turnConfig
-	}
-	peerConnection, err := webrtc.NewPeerConnection(config)
-	if err != nil {
-		log.Print(err)
-		return
-	}
-	defer peerConnection.Close()
-
-	for _, typ := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
-		if _, err := peerConnection.AddTransceiverFromKind(typ, webrtc.RTPTransceiverInit{
-			Direction: webrtc.RTPTransceiverDirectionRecvonly,
-		}); err != nil {
-			log.Print(err)
-			return
-		}
-
-		newPeer := PeerConnectionState{
-			PeerConnection: peerConnection,
-			Websocket: &ThreadSafeWriter{
-				Conn:  c,
-				Mutex: sync.Mutex{},
-			},
-		}
-
-		p.ListLock.Lock()
-		p.Connections = append(p.Connections, newPeer)
-		p.ListLock.Unlock()
-
-		log.Println(p.Connections)
-
-		peerConnection.OnICECandidate(func(i *webrtc.ICECandidate) {
-			if i == nil {
-				return
-			}
-
-			candidateString, err := json.Marshal(i.ToJSON())
-			if err != nil {
-				log.Println(err)
-				return
-			}
-
-			if writeErr := newPeer.Websocket.WriteJSON(&WebSocketMessage{
-				Event: "candidate",
-				Data:  string(candidateString),
-			}); writeErr != nil {
-				log.Println(err)
-				return
-			}
-		})
-
-		peerConnection.OnConnectionStateChange(func(pcs webrtc.PeerConnectionState) {
-			switch pcs {
-			case webrtc.PeerConnectionStateFailed:
-				if err := peerConnection.Close(); err != nil {
-					log.Println(err)
-				}
-
-			case webrtc.PeerConnectionStateClosed:
-				p.SignalPeerConnections()
-			}
-		})
-
-		p.SignalPeerConnections()
-		message := &WebSocketMessage{}
-		for {
-			_, raw, err := c.ReadMessage()
-			if err != nil {
-				log.Println(err)
-				return
-			} else if err := json.Unmarshal(raw, &message); err != nil {
-				log.Println(err)
-				return
-			}
-
-			switch message.Event {
-			case "candidate":
-				candidate := webrtc.ICECandidateInit{}
-				if err := json.Unmarshal([]byte(message.Data), &candidate); err != nil {
-					log.Println(err)
-					return
-				}
-
-				if err := peerConnection.AddICECandidate(candidate); err != nil {
-					log.Println(err)
-					return
-				}
-
-			case "answer":
-				answer := webrtc.SessionDescription{}
-				if err := json.Unmarshal([]byte(message.Data), &answer); err != nil {
-					log.Println(err)
-					return
-				}
-
-				if err := peerConnection.SetRemoteDescription(answer); err != nil {
-					log.Println(err)
-					return
-				}
-
-			}
-		}
-	}
-}
@@ -0,0 +1,346 @@
+package webrtc
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// layerEvaluationInterval is how often a subscriber's layer is re-evaluated
+// against its estimated bandwidth, and how long layer bitrates are averaged over.
+const layerEvaluationInterval = time.Second
+
+var ErrUnknownLayer = errors.New("unknown simulcast layer")
+
+// Bandwidth splits the estimated downlink bandwidth of a subscriber between
+// the video tracks it receives.
+type Bandwidth struct {
+	estimator cc.BandwidthEstimator
+	tracks    atomic.Int32
+}
+
+func NewBandwidth(estimator cc.BandwidthEstimator) *Bandwidth {
+	return &Bandwidth{estimator: estimator}
+}
+
+// Share returns the bitrate, in bits per second, each video track may use.
+func (b *Bandwidth) Share() int {
+	if b == nil || b.estimator == nil {
+		return 0
+	}
+
+	n := int(b.tracks.Load())
+	if n < 1 {
+		n = 1
+	}
+	return b.estimator.GetTargetBitrate() / n
+}
+
+// Track is a track received from a publisher. Every subscriber gets it
+// through its own DownTrack. A track published with simulcast has one layer
+// per RID, any other track a single layer with an empty RID.
+type Track struct {
+	lock         sync.RWMutex
+	codec        webrtc.RTPCodecCapability
+	id, streamID string
+	payloadType  webrtc.PayloadType
+	publisher    *webrtc.PeerConnection
+	layers       map[string]*trackLayer
+	downTracks   map[*webrtc.PeerConnection]*DownTrack
+	sinks        map[Sink]*DownTrack
+
+	// muted tracks are not forwarded at all.
+	muted atomic.Bool
+	// counters are those of the peers the track is published to.
+	counters *Counters
+}
+
+type trackLayer struct {
+	rid  string
+	ssrc webrtc.SSRC
+
+	// bitrate is the bitrate measured over the last complete window.
+	bitrate     int
+	windowBytes int
+	windowStart time.Time
+	// frames counts the video frames received, ended by a marker bit.
+	frames uint64
+	// lastPacket is when the layer last received a packet. A layer silent
+	// for layerEvaluationInterval, e.g. dropped by a congested publisher,
+	// is not picked until it sends again.
+	lastPacket time.Time
+}
+
+// layerBitrate is a snapshot of a layer, used to pick the layer of a subscriber.
+type layerBitrate struct {
+	rid     string
+	bitrate int
+}
+
+// NewTrack creates a track received from publisher, whose layers are added
+// as they are received.
+func NewTrack(tr *webrtc.TrackRemote, publisher *webrtc.PeerConnection) *Track {
+	t := newTrack(tr.Codec().RTPCodecCapability, tr.ID(), tr.StreamID())
+	t.payloadType = tr.PayloadType()
+	t.publisher = publisher
+	return t
+}
+
+// NewLocalTrack creates a track fed by the server itself, e.g. from an RTMP
+// ingest, rather than by a PeerConnection, with packets of the payload type
+// of codec. It has a single layer with an empty RID, and key frames cannot
+// be requested from its source.
+func NewLocalTrack(codec webrtc.RTPCodecParameters, id, streamID string) *Track {
+	t := newTrack(codec.RTPCodecCapability, id, streamID)
+	t.payloadType = codec.PayloadType
+	t.layers[""] = &trackLayer{windowStart: time.Now()}
+	return t
+}
+
+func newTrack(codec webrtc.RTPCodecCapability, id, streamID string) *Track {
+	return &Track{
+		codec:      codec,
+		id:         id,
+		streamID:   streamID,
+		layers:     make(map[string]*trackLayer),
+		downTracks: make(map[*webrtc.PeerConnection]*DownTrack),
+		sinks:      make(map[Sink]*DownTrack),
+	}
+}
+
+func (t *Track) ID() string { return t.id }
+
+func (t *Track) StreamID() string { return t.streamID }
+
+func (t *Track) Codec() webrtc.RTPCodecCapability { return t.codec }
+
+// Publisher is the PeerConnection the track is received on, nil for local tracks.
+func (t *Track) Publisher() *webrtc.PeerConnection { return t.publisher }
+
+// Layers returns the RIDs of the simulcast layers of the track, none when
+// it is not simulcast.
+func (t *Track) Layers() []string {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	rids := make([]string, 0, len(t.layers))
+	for rid := range t.layers {
+		if rid != "" {
+			rids = append(rids, rid)
+		}
+	}
+	sort.Strings(rids)
+	return rids
+}
+
+// Subscribers returns the number of subscribers and sinks receiving the track.
+func (t *Track) Subscribers() int {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return len(t.downTracks) + len(t.sinks)
+}
+
+// Mute stops or resumes forwarding the track. Resuming asks the publisher
+// for a key frame on every layer.
+func (t *Track) Mute(muted bool) {
+	if t.muted.Swap(muted) == muted || muted {
+		return
+	}
+	for _, rid := range t.Layers() {
+		go t.requestKeyFrame(rid)
+	}
+}
+
+func (t *Track) Muted() bool { return t.muted.Load() }
+
+func (t *Track) Kind() webrtc.RTPCodecType {
+	if strings.HasPrefix(t.codec.MimeType, "audio/") {
+		return webrtc.RTPCodecTypeAudio
+	}
+	return webrtc.RTPCodecTypeVideo
+}
+
+// AddLayer registers the layer received on tr.
+func (t *Track) AddLayer(tr *webrtc.TrackRemote) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.layers[tr.RID()] = &trackLayer{
+		rid:         tr.RID(),
+		ssrc:        tr.SSRC(),
+		windowStart: time.Now(),
+	}
+}
+
+// RemoveLayer unregisters the layer rid and returns how many layers are left.
+func (t *Track) RemoveLayer(rid string) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	delete(t.layers, rid)
+	return len(t.layers)
+}
+
+// Subscribe returns the DownTrack that sends this track to subscriber.
+func (t *Track) Subscribe(subscriber *webrtc.PeerConnection, bandwidth *Bandwidth) *DownTrack {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	d := &DownTrack{
+		track:      t,
+		subscriber: subscriber,
+		bandwidth:  bandwidth,
+	}
+	t.downTracks[subscriber] = d
+	return d
+}
+
+// DownTrack returns the DownTrack sending this track to subscriber, if any.
+func (t *Track) DownTrack(subscriber *webrtc.PeerConnection) (*DownTrack, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	d, ok := t.downTracks[subscriber]
+	return d, ok
+}
+
+// SetLayer makes subscriber receive layer rid. An empty rid lets the layer
+// follow the subscriber's estimated bandwidth again.
+func (t *Track) SetLayer(subscriber *webrtc.PeerConnection, rid string) error {
+	t.lock.RLock()
+	d, ok := t.downTracks[subscriber]
+	_, known := t.layers[rid]
+	t.lock.RUnlock()
+
+	if !ok {
+		return ErrUnknownLayer
+	}
+	if rid != "" && !known {
+		return ErrUnknownLayer
+	}
+
+	d.pin(rid)
+	return nil
+}
+
+// WriteRTP forwards a packet received on layer rid to every subscriber.
+func (t *Track) WriteRTP(rid string, pkt *rtp.Packet) {
+	if t.muted.Load() {
+		return
+	}
+
+	t.lock.Lock()
+	layer, ok := t.layers[rid]
+	if !ok {
+		t.lock.Unlock()
+		return
+	}
+
+	layer.lastPacket = time.Now()
+	layer.windowBytes += len(pkt.Payload)
+	if pkt.Marker {
+		layer.frames++
+	}
+	if elapsed := time.Since(layer.windowStart); elapsed >= layerEvaluationInterval {
+		layer.bitrate = int(float64(layer.windowBytes*8) / elapsed.Seconds())
+		layer.windowBytes = 0
+		layer.windowStart = time.Now()
+	}
+
+	downTracks := make([]*DownTrack, 0, len(t.downTracks)+len(t.sinks))
+	for _, d := range t.downTracks {
+		downTracks = append(downTracks, d)
+	}
+	for _, d := range t.sinks {
+		downTracks = append(downTracks, d)
+	}
+	t.lock.Unlock()
+
+	keyFrame := isKeyFrame(t.codec.MimeType, pkt.Payload)
+	for _, d := range downTracks {
+		d.writeRTP(rid, pkt, keyFrame)
+	}
+}
+
+// layerBitrates returns the live layers measured at least once, sorted from
+// the lowest to the highest bitrate.
+func (t *Track) layerBitrates() []layerBitrate {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	layers := make([]layerBitrate, 0, len(t.layers))
+	for _, l := range t.layers {
+		if l.bitrate == 0 || time.Since(l.lastPacket) >= layerEvaluationInterval {
+			continue
+		}
+		layers = append(layers, layerBitrate{rid: l.rid, bitrate: l.bitrate})
+	}
+
+	sort.Slice(layers, func(i, j int) bool {
+		return layers[i].bitrate < layers[j].bitrate
+	})
+	return layers
+}
+
+// frames returns the number of frames received on layer rid.
+func (t *Track) frames(rid string) uint64 {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	if layer, ok := t.layers[rid]; ok {
+		return layer.frames
+	}
+	return 0
+}
+
+// requestKeyFrame asks the publisher for a key frame on layer rid.
+func (t *Track) requestKeyFrame(rid string) {
+	if t.Kind() != webrtc.RTPCodecTypeVideo {
+		return
+	}
+
+	t.lock.RLock()
+	layer, ok := t.layers[rid]
+	t.lock.RUnlock()
+	if !ok || t.publisher == nil {
+		return
+	}
+
+	_ = t.publisher.WriteRTCP([]rtcp.Packet{
+		&rtcp.PictureLossIndication{MediaSSRC: uint32(layer.ssrc)},
+	})
+	t.counters.pliSent()
+}
+
+func (t *Track) removeDownTrack(d *DownTrack) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.downTracks[d.subscriber] == d {
+		delete(t.downTracks, d.subscriber)
+	}
+}
+
+// matchCodec finds codec among the negotiated codecs, preferring an exact
+// match of the fmtp line over a match of the mime type only.
+func matchCodec(codec webrtc.RTPCodecCapability, negotiated []webrtc.RTPCodecParameters) (webrtc.RTPCodecParameters, bool) {
+	for _, c := range negotiated {
+		if strings.EqualFold(c.MimeType, codec.MimeType) && c.SDPFmtpLine == codec.SDPFmtpLine {
+			return c, true
+		}
+	}
+	for _, c := range negotiated {
+		if strings.EqualFold(c.MimeType, codec.MimeType) {
+			return c, true
+		}
+	}
+	return webrtc.RTPCodecParameters{}, false
+}
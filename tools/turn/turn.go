@@ -9,6 +9,9 @@ import (
 	"regexp"
 	"strconv"
 	"syscall"
+	"time"
+
+	"quick-video/pkg/turncred"
 
 	"github.com/pion/turn/v2"
 )
@@ -18,14 +21,15 @@ func main() {
 	port := flag.Int("port", 3478, "")
 	users := flag.String("users", "", "") // user=pass,user=pass
 	realm := flag.String("realm", "v.satya.sh", "")
+	authSecret := flag.String("auth-secret", os.Getenv("TURN_SECRET"), "") // shared with the server for time-limited credentials
 	flag.Parse()
 
 	if len(*publicIP) == 0 {
 		log.Fatalf("public-ip is required")
 	}
 
-	if len(*users) == 0 {
-		log.Fatalf("'users' is required")
+	if len(*users) == 0 && len(*authSecret) == 0 {
+		log.Fatalf("'users' or 'auth-secret' is required")
 	}
 
 	udpListner, err := net.ListenPacket("udp4", "0.0.0.0:"+strconv.Itoa(*port))
@@ -44,7 +48,17 @@ func main() {
 			if key, ok := userMap[username]; ok {
 				return key, true
 			}
-			return nil, false
+
+			if len(*authSecret) == 0 {
+				return nil, false
+			}
+
+			password, err := turncred.Validate(*authSecret, username, time.Now())
+			if err != nil {
+				log.Printf("rejected %s from %s: %s", username, srcAddr, err)
+				return nil, false
+			}
+			return turn.GenerateAuthKey(username, realm, password), true
 		},
 		PacketConnConfigs: []turn.PacketConnConfig{
 			{